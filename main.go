@@ -1,8 +1,16 @@
 package main
 
 import (
+	"archive/tar"
+	"archive/zip"
 	"bufio"
 	"bytes"
+	"cmp"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -20,12 +28,20 @@ import (
 	"strings"
 	"sync"
 	"time"
+	"unicode/utf8"
 
 	"main/utils/ampapi"
+	"main/utils/checksum"
+	"main/utils/library"
 	"main/utils/lyrics"
+	"main/utils/mp4meta"
+	"main/utils/nfo"
+	"main/utils/playlistfile"
 	"main/utils/runv2"
 	"main/utils/runv3"
+	"main/utils/storage"
 	"main/utils/structs"
+	"main/utils/subsonic"
 	"main/utils/task"
 
 	"github.com/AlecAivazis/survey/v2"
@@ -40,10 +56,7 @@ import (
 
 var (
 	forbiddenNames = regexp.MustCompile(`[/\\<>:"|?*]`)
-	dl_atmos       bool
-	dl_aac         bool
 	dl_select      bool
-	dl_song        bool
 	artist_select  bool
 	debug_mode     bool
 	alac_max       *int
@@ -54,6 +67,8 @@ var (
 	Config         structs.ConfigSet
 	counter        structs.Counter
 	okDict         = make(map[string][]int)
+	libIndex       *library.Index
+	remoteStorage  storage.Storage
 )
 
 func loadConfig() error {
@@ -68,6 +83,143 @@ func loadConfig() error {
 	if len(Config.Storefront) != 2 {
 		Config.Storefront = "us"
 	}
+	if Config.LibraryIndex == "" {
+		Config.LibraryIndex = "library.json"
+	}
+	if Config.StagingFolder == "" {
+		Config.StagingFolder = ".staging"
+	}
+	if err := checkStagingFolder(); err != nil {
+		return err
+	}
+	if Config.VerifyTolerance <= 0 {
+		Config.VerifyTolerance = 2000
+	}
+	if Config.Tags.SortFields == nil {
+		sortFields := true
+		Config.Tags.SortFields = &sortFields
+	}
+	if Config.Tags.Custom == nil {
+		Config.Tags.Custom = map[string]string{
+			"PERFORMER":   "{ArtistName}",
+			"RELEASETIME": "{ReleaseDate}",
+			"ISRC":        "{ISRC}",
+			"LABEL":       "{Label}",
+			"UPC":         "{UPC}",
+		}
+	}
+	if Config.Tags.CreditRoles == nil {
+		Config.Tags.CreditRoles = map[string]string{
+			"producer":           "PRODUCER",
+			"co-producer":        "PRODUCER",
+			"lyricist":           "LYRICIST",
+			"songwriter":         "WRITER",
+			"arranger":           "ARRANGER",
+			"conductor":          "CONDUCTOR",
+			"mixing engineer":    "MIXER",
+			"recording engineer": "ENGINEER",
+			"mastering engineer": "ENGINEER",
+			"performer":          "PERFORMER",
+		}
+	}
+	// 密码为空时 t=md5(salt) 或 p=enc: 即可通过认证，不允许这样启用
+	if Config.Subsonic.Enabled && (Config.Subsonic.Username == "" || Config.Subsonic.Password == "") {
+		return errors.New("subsonic.enabled requires subsonic.username and subsonic.password")
+	}
+	for _, name := range append(append([]string{}, Config.Tags.Fields...), Config.Tags.Skip...) {
+		if !contains(tagFieldNames, name) {
+			return fmt.Errorf("unknown tag field %q in tags config", name)
+		}
+	}
+	switch Config.SaveDescription {
+	case "", "txt", "md":
+	default:
+		return fmt.Errorf("save-description must be txt, md or empty, got %q", Config.SaveDescription)
+	}
+	for _, f := range Config.PlaylistFiles {
+		if f != "m3u8" && f != "xspf" {
+			return fmt.Errorf("unknown playlist-files format %q (m3u8, xspf)", f)
+		}
+	}
+	switch Config.PlaylistMode {
+	case "":
+		Config.PlaylistMode = "copy"
+	case "copy", "reference":
+	default:
+		return fmt.Errorf("playlist-mode must be copy or reference, got %q", Config.PlaylistMode)
+	}
+	switch Config.PlaylistLinks {
+	case "", "hardlink", "symlink":
+	default:
+		return fmt.Errorf("playlist-links must be hardlink, symlink or empty, got %q", Config.PlaylistLinks)
+	}
+	switch Config.PlaylistSyncRemoved {
+	case "":
+		Config.PlaylistSyncRemoved = "keep"
+	case "keep", "delete", "archive":
+	default:
+		return fmt.Errorf("playlist-sync-removed must be keep, delete or archive, got %q", Config.PlaylistSyncRemoved)
+	}
+	switch Config.PlaylistSyncNumbering {
+	case "":
+		Config.PlaylistSyncNumbering = "stable"
+	case "stable", "position":
+	default:
+		return fmt.Errorf("playlist-sync-numbering must be stable or position, got %q", Config.PlaylistSyncNumbering)
+	}
+	if len(Config.QualityChain) == 0 {
+		Config.QualityChain = []string{"atmos", "hires:192000", "alac", "aac-lc"}
+	}
+	for _, entry := range Config.QualityChain {
+		name, limit, hasLimit := strings.Cut(entry, ":")
+		if chainCodec(name) == "" {
+			return fmt.Errorf("unknown quality-chain entry %q", entry)
+		}
+		if hasLimit {
+			if n, err := strconv.Atoi(limit); err != nil || n <= 0 || !contains([]string{"atmos", "hires", "alac"}, name) {
+				return fmt.Errorf("invalid limit in quality-chain entry %q", entry)
+			}
+		}
+	}
+	switch Config.QualityChainFolder {
+	case "":
+		Config.QualityChainFolder = "majority"
+	case "majority", "highest", "lowest":
+	default:
+		return fmt.Errorf("quality-chain-folder must be majority, highest or lowest, got %q", Config.QualityChainFolder)
+	}
+	switch Config.EditionPreference {
+	case "":
+		Config.EditionPreference = "given"
+	case "given", "explicit", "clean":
+	default:
+		return fmt.Errorf("edition-preference must be given, explicit or clean, got %q", Config.EditionPreference)
+	}
+	switch Config.ChecksumManifest {
+	case "", checksum.SHA256, checksum.MD5, checksum.SFV:
+	default:
+		return fmt.Errorf("checksum-manifest must be sha256, md5, sfv or empty, got %q", Config.ChecksumManifest)
+	}
+	switch Config.Tags.Description {
+	case "", "short", "standard":
+	default:
+		return fmt.Errorf("tags.description must be short, standard or empty, got %q", Config.Tags.Description)
+	}
+	switch Config.AltLanguage.Policy {
+	case "", "sort", "display":
+	default:
+		return fmt.Errorf("alt-language.policy must be sort, display or empty, got %q", Config.AltLanguage.Policy)
+	}
+	switch Config.Tags.PlaylistAlbum {
+	case "":
+		Config.Tags.PlaylistAlbum = "playlist"
+		if Config.UseSongInfoForPlaylist {
+			Config.Tags.PlaylistAlbum = "original"
+		}
+	case "playlist", "original":
+	default:
+		return fmt.Errorf("tags.playlist-album must be playlist or original, got %q", Config.Tags.PlaylistAlbum)
+	}
 	return nil
 }
 
@@ -205,6 +357,7 @@ func checkArtist(artistUrl string, token string, relationship string) ([]string,
 	var args []string
 	var urls []string
 	var options [][]string
+	var rows []discographyEntry
 	for {
 		req, err := http.NewRequest("GET", fmt.Sprintf("https://amp-api.music.apple.com/v1/catalog/%s/artists/%s/%s?limit=100&offset=%d&l=%s", storefront, artistId, relationship, Num, Config.Language), nil)
 		if err != nil {
@@ -227,13 +380,21 @@ func checkArtist(artistUrl string, token string, relationship string) ([]string,
 			return nil, err
 		}
 		for _, album := range obj.Data {
-			options = append(options, []string{album.Attributes.Name, album.Attributes.ReleaseDate, album.ID, album.Attributes.URL})
+			rows = append(rows, discographyEntry{Name: album.Attributes.Name, Date: album.Attributes.ReleaseDate, Editions: []albumEdition{{ID: album.ID, URL: album.Attributes.URL, Rating: album.Attributes.ContentRating}}})
 		}
 		Num = Num + 100
 		if len(obj.Next) == 0 {
 			break
 		}
 	}
+	// 专辑的 explicit / clean 版本合并为一行，按 edition-preference 选择下载的版本
+	if relationship == "albums" {
+		rows = collapseEditions(rows)
+	}
+	for _, r := range rows {
+		ed := r.pick(Config.EditionPreference)
+		options = append(options, []string{r.Name, r.Date, ed.ID, ed.URL})
+	}
 	sort.Slice(options, func(i, j int) bool {
 		// 将日期字符串解析为 time.Time 类型进行比较
 		dateI, _ := time.Parse("2006-01-02", options[i][1])
@@ -333,14 +494,6 @@ func writeCover(sanAlbumFolder, name string, url string) (string, error) {
 		ext = ext[strings.LastIndex(ext, ".")+1:]
 		covPath = filepath.Join(sanAlbumFolder, name+"."+ext)
 	}
-	exists, err := fileExists(covPath)
-	if err != nil {
-		fmt.Println("Failed to check if cover exists.")
-		return "", err
-	}
-	if exists {
-		_ = os.Remove(covPath)
-	}
 	if Config.CoverFormat == "png" {
 		re := regexp.MustCompile(`\{w\}x\{h\}`)
 		parts := re.Split(url, 2)
@@ -364,32 +517,221 @@ func writeCover(sanAlbumFolder, name string, url string) (string, error) {
 	if do.StatusCode != http.StatusOK {
 		return "", errors.New(do.Status)
 	}
-	f, err := os.Create(covPath)
+	// 下载完整后再替换旧封面，避免中断时留下半截文件
+	stageDir, err := newStagingDir("cover")
+	if err != nil {
+		return "", err
+	}
+	defer os.RemoveAll(stageDir)
+	staged := filepath.Join(stageDir, filepath.Base(covPath))
+	f, err := os.Create(staged)
 	if err != nil {
 		return "", err
 	}
-	defer f.Close()
 	_, err = io.Copy(f, do.Body)
+	f.Close()
 	if err != nil {
 		return "", err
 	}
+	if err := publishFile(staged, covPath); err != nil {
+		return "", err
+	}
 	return covPath, nil
 }
 
 func writeLyrics(sanAlbumFolder, filename string, lrc string) error {
 	lyricspath := filepath.Join(sanAlbumFolder, filename)
-	f, err := os.Create(lyricspath)
+	stageDir, err := newStagingDir("lyrics")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(stageDir)
+	staged := filepath.Join(stageDir, filename)
+	if err := os.WriteFile(staged, []byte(lrc), 0644); err != nil {
+		return err
+	}
+	return publishFile(staged, lyricspath)
+}
+
+// stagingPrefixes 是 newStagingDir 使用的目录名前缀；启动清理只删除这些前缀的目录
+var stagingPrefixes = []string{"cover", "lyrics", "track", "station", "shared", "album-json", "mv", "retag"}
+
+// newStagingDir 在 staging 目录下为一次写入创建独立的临时目录，prefix 须以 stagingPrefixes 之一开头
+func newStagingDir(prefix string) (string, error) {
+	if err := os.MkdirAll(Config.StagingFolder, os.ModePerm); err != nil {
+		return "", err
+	}
+	return os.MkdirTemp(Config.StagingFolder, forbiddenNames.ReplaceAllString(prefix, "_")+"-")
+}
+
+// publishFile 把 staging 中的文件原子地移动到最终路径。
+// 跨设备无法 rename 时，先复制到目标目录下的临时文件并落盘，再 rename 覆盖
+func publishFile(src, dst string) error {
+	if err := os.MkdirAll(filepath.Dir(dst), os.ModePerm); err != nil {
+		return err
+	}
+	if err := os.Rename(src, dst); err == nil {
+		return nil
+	}
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	tmp, err := os.CreateTemp(filepath.Dir(dst), "."+filepath.Base(dst)+".*.part")
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(tmp, in); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := os.Rename(tmp.Name(), dst); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Remove(src)
+}
+
+// expectedMedia 根据所选下载类型与 extractMedia 给出的音质（如 "24B-96.0kHz"）推出校验条件
+func expectedMedia(quality string, aac, atmos bool) mp4meta.Expect {
+	want := mp4meta.Expect{ToleranceMs: int64(Config.VerifyTolerance)}
+	switch {
+	case aac:
+		want.Codecs = []string{"mp4a"}
+	case atmos:
+		want.Codecs = []string{"ec-3", "ac-3"}
+	default:
+		want.Codecs = []string{"alac"}
+		var bits int
+		var khz float64
+		if n, _ := fmt.Sscanf(quality, "%dB-%fkHz", &bits, &khz); n == 2 {
+			want.BitDepth = bits
+			want.SampleRate = int(khz*1000 + 0.5)
+		}
+	}
+	return want
+}
+
+// trackFailures 汇总任务中失败的曲目，使任务以明确的原因结束
+func trackFailures(failed []string, total int) error {
+	if len(failed) == 0 {
+		return nil
+	}
+	return fmt.Errorf("%d/%d tracks failed: %s", len(failed), total, strings.Join(failed, "; "))
+}
+
+// verifyStagedFile 在发布前确认文件结构完整：能解析出 moov 和有时长的音轨
+func verifyStagedFile(p string) error {
+	info, err := mp4meta.Probe(p)
+	if err != nil {
+		return err
+	}
+	if info.DurationMs <= 0 {
+		return errors.New("audio track has no samples")
+	}
+	return nil
+}
+
+// cleanupStaging 启动时清理上次进程中断后遗留在 staging 目录里的临时目录，以及保存目录中未完成移动的 .part 文件
+func cleanupStaging() {
+	entries, _ := os.ReadDir(Config.StagingFolder)
+	removed := 0
+	for _, e := range entries {
+		if !e.IsDir() || !isStagingDirName(e.Name()) {
+			continue
+		}
+		if err := os.RemoveAll(filepath.Join(Config.StagingFolder, e.Name())); err != nil {
+			log.Printf("clean staging %s failed: %v", e.Name(), err)
+			continue
+		}
+		removed++
+	}
+	if removed > 0 {
+		log.Printf("removed %d orphaned staging entries", removed)
+	}
+	// publishFile 跨设备复制时在目标目录留下的 .<name>.*.part
+	parts := 0
+	for _, root := range libraryRoots() {
+		filepath.WalkDir(root, func(p string, d os.DirEntry, err error) error {
+			if err != nil || d.IsDir() {
+				return nil
+			}
+			if name := d.Name(); strings.HasPrefix(name, ".") && strings.HasSuffix(name, ".part") {
+				if err := os.Remove(p); err != nil {
+					log.Printf("remove %s failed: %v", p, err)
+				} else {
+					parts++
+				}
+			}
+			return nil
+		})
+	}
+	if parts > 0 {
+		log.Printf("removed %d partial files left by interrupted moves", parts)
+	}
+}
+
+// isStagingDirName 判断目录名是否由 newStagingDir 创建（前缀 + "-" + MkdirTemp 的随机数字）
+func isStagingDirName(name string) bool {
+	for _, p := range stagingPrefixes {
+		rest, ok := strings.CutPrefix(name, p+"-")
+		if !ok {
+			continue
+		}
+		// track-<id>-<random> 等带 id 的前缀，随机部分在最后一个 "-" 之后
+		rest = rest[strings.LastIndexByte(rest, '-')+1:]
+		if rest == "" {
+			continue
+		}
+		if strings.Trim(rest, "0123456789") == "" {
+			return true
+		}
+	}
+	return false
+}
+
+// checkStagingFolder 拒绝等于或包含工作目录、保存目录的 staging-folder：启动时会清空其中的临时目录
+func checkStagingFolder() error {
+	staging, err := filepath.Abs(Config.StagingFolder)
 	if err != nil {
 		return err
 	}
-	defer f.Close()
-	_, err = f.WriteString(lrc)
+	cwd, err := os.Getwd()
 	if err != nil {
 		return err
 	}
+	for _, dir := range append([]string{cwd}, libraryRoots()...) {
+		if dir == "" {
+			continue
+		}
+		abs, err := filepath.Abs(dir)
+		if err != nil {
+			return err
+		}
+		if pathWithin(abs, staging) {
+			return fmt.Errorf("staging-folder %q must not be or contain %s", Config.StagingFolder, abs)
+		}
+	}
 	return nil
 }
 
+// pathWithin 判断 path 是否为 dir 本身或位于 dir 之下（两者均为绝对路径）
+func pathWithin(path, dir string) bool {
+	rel, err := filepath.Rel(dir, path)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
 func contains(slice []string, item string) bool {
 	for _, v := range slice {
 		if v == item {
@@ -416,21 +758,22 @@ type QualityOption struct {
 	Description string
 }
 
-// setDlFlags configures the global download flags based on the user's quality selection.
-func setDlFlags(quality string) {
-	dl_atmos = false
-	dl_aac = false
+// setDlFlags configures the download options based on the user's quality selection.
+func setDlFlags(opts *dlOptions, quality string) {
+	song := opts.Song
+	*opts = qualityOptions(quality)
+	opts.Song = song
 
 	switch quality {
 	case "atmos":
-		dl_atmos = true
 		fmt.Println("Quality set to: Dolby Atmos")
 	case "aac":
-		dl_aac = true
 		*aac_type = "aac"
 		fmt.Println("Quality set to: High-Quality (AAC)")
 	case "alac":
 		fmt.Println("Quality set to: Lossless (ALAC)")
+	case "best":
+		fmt.Println("Quality set to: Best available (" + strings.Join(Config.QualityChain, " > ") + ")")
 	}
 }
 
@@ -447,6 +790,7 @@ func promptForQuality(item SearchResultItem, token string) (string, error) {
 		{ID: "alac", Description: "Lossless (ALAC)"},
 		{ID: "aac", Description: "High-Quality (AAC)"},
 		{ID: "atmos", Description: "Dolby Atmos"},
+		{ID: "best", Description: "Best available (quality-chain)"},
 	}
 	qualityOptions := []string{}
 	for _, q := range qualities {
@@ -469,8 +813,8 @@ func promptForQuality(item SearchResultItem, token string) (string, error) {
 	return qualities[selectedIndex].ID, nil
 }
 
-// handleSearch manages the entire interactive search process.
-func handleSearch(searchType string, queryParts []string, token string) (string, error) {
+// handleSearch manages the entire interactive search process; opts receives the selected quality.
+func handleSearch(searchType string, queryParts []string, token string, opts *dlOptions) (string, error) {
 	query := strings.Join(queryParts, " ")
 	validTypes := map[string]bool{"album": true, "song": true, "artist": true}
 	if !validTypes[searchType] {
@@ -586,7 +930,7 @@ func handleSearch(searchType string, queryParts []string, token string) (string,
 
 		// Automatically set single song download flag
 		if selectedItem.Type == "Song" {
-			dl_song = true
+			opts.Song = true
 		}
 
 		quality, err := promptForQuality(selectedItem, token)
@@ -599,7 +943,7 @@ func handleSearch(searchType string, queryParts []string, token string) (string,
 		}
 
 		if quality != "default" {
-			setDlFlags(quality)
+			setDlFlags(opts, quality)
 		}
 
 		return selectedItem.URL, nil
@@ -608,46 +952,51 @@ func handleSearch(searchType string, queryParts []string, token string) (string,
 
 // END: New functions for search functionality
 
-func ripTrack(track *task.Track, token string, mediaUserToken string, onSub func(int, string)) {
+func ripTrack(track *task.Track, token string, mediaUserToken string, opts dlOptions, onSub func(int, string), onFile func(string)) error {
 	var err error
 	counter.Total++
 	fmt.Printf("Track %d of %d: %s\n", track.TaskNum, track.TaskTotal, track.Type)
 	//提前获取到的播放列表下track所在的专辑信息
         if onSub != nil { onSub(0, track.Resp.Attributes.Name) }
         if onSub != nil { onSub(5, "") }
-    if track.PreType == "playlists" && Config.UseSongInfoForPlaylist {
+    if (track.PreType == "playlists" || track.PreType == "stations") && Config.Tags.PlaylistAlbum == "original" && track.AlbumData.ID == "" {
         track.GetAlbumData(token)
     }
+	if Config.Tags.Credits && tagEnabled("credits") && track.Type == "songs" && track.Credits == nil {
+		if err := track.GetCredits(token); err != nil {
+			fmt.Println("Failed to get credits:", err)
+		}
+	}
 	//mv dl dev
 	if track.Type == "music-videos" {
 		if len(mediaUserToken) <= 50 {
 			fmt.Println("meida-user-token is not set, skip MV dl")
 			counter.Success++
-			return
+			return nil
 		}
 		if _, err := exec.LookPath("mp4decrypt"); err != nil {
 			fmt.Println("mp4decrypt is not found, skip MV dl")
 			counter.Success++
-			return
+			return nil
 		}
-		err := mvDownloader(track.ID, track.SaveDir, token, track.Storefront, mediaUserToken, track)
+		err := mvDownloader(track.ID, track.SaveDir, token, track.Storefront, mediaUserToken, track, onFile)
 		if err != nil {
 			fmt.Println("\u26A0 Failed to dl MV:", err)
 			counter.Error++
-			return
+			return fmt.Errorf("music video: %w", err)
 		}
 		counter.Success++
-		return
+		return nil
 	}
 	needDlAacLc := false
-	if dl_aac && Config.AacType == "aac-lc" {
+	if opts.AAC && Config.AacType == "aac-lc" {
 		needDlAacLc = true
 	}
 	if track.WebM3u8 == "" && !needDlAacLc {
-		if dl_atmos {
+		if opts.Atmos || opts.Best && !contains(Config.QualityChain, "aac-lc") {
 			fmt.Println("Unavailable")
 			counter.Unavailable++
-			return
+			return nil
 		}
 		fmt.Println("Unavailable, trying to dl aac-lc")
 		needDlAacLc = true
@@ -659,26 +1008,50 @@ func ripTrack(track *task.Track, token string, mediaUserToken string, onSub func
 	} else if Config.GetM3u8Mode == "hires" && contains(track.Resp.Attributes.AudioTraits, "hi-res-lossless") {
 		needCheck = true
 	}
+	// best：专辑（歌单）评估时已为这首歌选过版本的，不再取设备 m3u8 和重新选择
+	choice := opts.Choices[track.ID]
 	var EnhancedHls_m3u8 string
-	if needCheck && !needDlAacLc {
+	if needCheck && !needDlAacLc && choice == nil {
 		EnhancedHls_m3u8, _ = checkM3u8(track.ID, "song")
 		if strings.HasSuffix(EnhancedHls_m3u8, ".m3u8") {
 			track.DeviceM3u8 = EnhancedHls_m3u8
 			track.M3u8 = EnhancedHls_m3u8
 		}
 	}
+	// best：按 quality-chain 为这首歌选定版本，{Codec}/{Quality} 与校验都按选中的版本
+	var best *bestChoice
+	if opts.Best {
+		best = choice
+		if best == nil {
+			masterUrl := track.M3u8
+			if needDlAacLc {
+				masterUrl = ""
+			}
+			best, err = chooseTrackQuality(masterUrl)
+			if err != nil {
+				fmt.Println("Unavailable in quality-chain:", err)
+				counter.Unavailable++
+				return nil
+			}
+		}
+		fmt.Printf("Best available: %s %s (%s)\n", best.Codec, best.Quality, best.Entry)
+		needDlAacLc = best.AacLc
+		track.Codec = best.Codec
+	}
 	var Quality string
 	if strings.Contains(Config.SongFileFormat, "Quality") {
-		if dl_atmos {
+		if best != nil {
+			Quality = best.Quality
+		} else if opts.Atmos {
 			Quality = fmt.Sprintf("%dKbps", Config.AtmosMax-2000)
 		} else if needDlAacLc {
 			Quality = "256Kbps"
 		} else {
-			_, Quality, err = extractMedia(track.M3u8, true)
+			_, Quality, err = extractMedia(track.M3u8, true, opts)
 			if err != nil {
 				fmt.Println("Failed to extract quality from manifest.\n", err)
 				counter.Error++
-				return
+				return fmt.Errorf("extract quality: %w", err)
 			}
 		}
 	}
@@ -720,21 +1093,23 @@ func ripTrack(track *task.Track, token string, mediaUserToken string, onSub func
 
 	//get lrc
 	var lrc string = ""
-	if Config.EmbedLrc || Config.SaveLrcFile {
-		lrcStr, err := lyrics.Get(track.Storefront, track.ID, Config.LrcType, Config.Language, Config.LrcFormat, token, mediaUserToken)
-		if err != nil {
+	if (Config.EmbedLrc || Config.SaveLrcFile) && !track.HasLyrics {
+		if lrcStr, err := lyrics.Get(track.Storefront, track.ID, Config.LrcType, Config.Language, Config.LrcFormat, token, mediaUserToken); err != nil {
 			fmt.Println(err)
 		} else {
-			if Config.SaveLrcFile {
-				err := writeLyrics(track.SaveDir, lrcFilename, lrcStr)
-				if err != nil {
-					fmt.Printf("Failed to write lyrics")
-				}
-			}
-			if Config.EmbedLrc {
-				lrc = lrcStr
+			track.Lyrics, track.HasLyrics = lrcStr, true
+		}
+	}
+	if track.HasLyrics {
+		if Config.SaveLrcFile {
+			err := writeLyrics(track.SaveDir, lrcFilename, track.Lyrics)
+			if err != nil {
+				fmt.Printf("Failed to write lyrics")
 			}
 		}
+		if Config.EmbedLrc {
+			lrc = track.Lyrics
+		}
 	}
 
 	exists, err := fileExists(trackPath)
@@ -745,83 +1120,101 @@ func ripTrack(track *task.Track, token string, mediaUserToken string, onSub func
 		fmt.Println("Track already exists locally.")
 		counter.Success++
 		okDict[track.PreID] = append(okDict[track.PreID], track.TaskNum)
-		return
+		if onFile != nil { onFile(trackPath) }
+		return nil
+	}
+	// 先在 staging 中完成下载、打标签与校验，再原子地移动到 trackPath
+	stageDir, err := newStagingDir("track-" + track.ID)
+	if err != nil {
+		fmt.Println("Failed to create staging dir:", err)
+		counter.Error++
+		return err
 	}
+	defer os.RemoveAll(stageDir)
+	stagedPath := filepath.Join(stageDir, track.SaveName)
+	var streamQuality string
 	if needDlAacLc {
 		if len(mediaUserToken) <= 50 {
 			fmt.Println("Invalid media-user-token")
 			counter.Error++
-			return
+			return errors.New("invalid media-user-token")
 		}
         if onSub != nil { onSub(10, "") }
-        _, err := runv3.Run(track.ID, trackPath, token, mediaUserToken, false)
+        _, err := runv3.Run(track.ID, stagedPath, token, mediaUserToken, false)
         if err != nil {
             fmt.Println("Failed to dl aac-lc:", err)
             if err.Error() == "Unavailable" {
                 counter.Unavailable++
-                return
+                return nil
             }
             counter.Error++
-            return
+            return fmt.Errorf("download aac-lc: %w", err)
         }
         if onSub != nil { onSub(90, "") }
     } else {
-        trackM3u8Url, _, err := extractMedia(track.M3u8, false)
+        var trackM3u8Url string
+        if best != nil {
+            trackM3u8Url, streamQuality = best.StreamURL, best.Quality
+        } else {
+            trackM3u8Url, streamQuality, err = extractMedia(track.M3u8, false, opts)
+        }
         if err != nil {
             fmt.Println("\u26A0 Failed to extract info from manifest:", err)
             counter.Unavailable++
-            return
+            return nil
         }
+        track.Quality = streamQuality
         if onSub != nil { onSub(10, "") }
         // 边下载边解密（无法精确进度，这里设置阶段性提示）
-        err = runv2.Run(track.ID, trackM3u8Url, trackPath, Config)
+        err = runv2.Run(track.ID, trackM3u8Url, stagedPath, Config)
         if err != nil {
             fmt.Println("Failed to run v2:", err)
             counter.Error++
-            return
+            return fmt.Errorf("download: %w", err)
         }
         if onSub != nil { onSub(90, "") }
     }
-	tags := []string{
-		"tool=",
-		fmt.Sprintf("artist=%s", track.Resp.Attributes.ArtistName),
-	}
 	if Config.EmbedCover {
 		if (strings.Contains(track.PreID, "pl.") || strings.Contains(track.PreID, "ra.")) && Config.DlAlbumcoverForPlaylist {
-			track.CoverPath, err = writeCover(track.SaveDir, track.ID, track.Resp.Attributes.Artwork.URL)
+			track.CoverPath, err = writeCover(stageDir, track.ID, track.Resp.Attributes.Artwork.URL)
 			if err != nil {
 				fmt.Println("Failed to write cover.")
 			}
 		}
-		tags = append(tags, fmt.Sprintf("cover=%s", track.CoverPath))
 	}
-	tagsString := strings.Join(tags, ":")
-	cmd := exec.Command("MP4Box", "-itags", tagsString, trackPath)
-    if err := cmd.Run(); err != nil {
-        fmt.Printf("Embed failed: %v\n", err)
-        counter.Error++
-        return
-    }
-    if onSub != nil { onSub(100, "") }
-	if (strings.Contains(track.PreID, "pl.") || strings.Contains(track.PreID, "ra.")) && Config.DlAlbumcoverForPlaylist {
-		if err := os.Remove(track.CoverPath); err != nil {
-			fmt.Printf("Error deleting file: %s\n", track.CoverPath)
-			counter.Error++
-			return
-		}
-	}
-	track.SavePath = trackPath
+	track.SavePath = stagedPath
 	err = writeMP4Tags(track, lrc)
 	if err != nil {
 		fmt.Println("\u26A0 Failed to write tags in media:", err)
-		counter.Unavailable++
-		return
+		counter.Error++
+		return fmt.Errorf("write tags: %w", err)
+	}
+    if onSub != nil { onSub(100, "") }
+	wantAac, wantAtmos := needDlAacLc || opts.AAC, opts.Atmos
+	if best != nil {
+		wantAac, wantAtmos = best.Codec == "AAC", best.Codec == "ATMOS" || best.Codec == "DOLBY"
+	}
+	want := expectedMedia(streamQuality, wantAac, wantAtmos)
+	want.DurationMs = int64(track.Resp.Attributes.DurationInMillis)
+	want.Cover = Config.EmbedCover && tagEnabled("cover") && track.CoverPath != ""
+	if _, err := mp4meta.Verify(stagedPath, want); err != nil {
+		fmt.Println("\u26A0 Verification failed:", err)
+		counter.Error++
+		return fmt.Errorf("verify: %w", err)
+	}
+	if err := publishFile(stagedPath, trackPath); err != nil {
+		fmt.Println("\u26A0 Failed to move track into library:", err)
+		counter.Error++
+		return fmt.Errorf("publish: %w", err)
 	}
+	track.SavePath = trackPath
 	counter.Success++
 	okDict[track.PreID] = append(okDict[track.PreID], track.TaskNum)
+	if onFile != nil { onFile(trackPath) }
+	return nil
 }
 
-func ripStation(albumId string, token string, storefront string, mediaUserToken string, onSub func(int, string)) error {
+func ripStation(albumId string, token string, storefront string, mediaUserToken string, opts dlOptions, onSub func(int, string), onFile func(string)) error {
 	station := task.NewStation(storefront, albumId)
 	err := station.GetResp(mediaUserToken, token, Config.Language)
 	if err != nil {
@@ -831,9 +1224,9 @@ func ripStation(albumId string, token string, storefront string, mediaUserToken
 	meta := station.Resp
 
 	var Codec string
-	if dl_atmos {
+	if opts.Atmos {
 		Codec = "ATMOS"
-	} else if dl_aac {
+	} else if opts.AAC {
 		Codec = "AAC"
 	} else {
 		Codec = "ALAC"
@@ -853,10 +1246,10 @@ func ripStation(albumId string, token string, storefront string, mediaUserToken
 		fmt.Println(singerFoldername)
 	}
 	singerFolder := filepath.Join(Config.AlacSaveFolder, forbiddenNames.ReplaceAllString(singerFoldername, "_"))
-	if dl_atmos {
+	if opts.Atmos {
 		singerFolder = filepath.Join(Config.AtmosSaveFolder, forbiddenNames.ReplaceAllString(singerFoldername, "_"))
 	}
-	if dl_aac {
+	if opts.AAC {
 		singerFolder = filepath.Join(Config.AacSaveFolder, forbiddenNames.ReplaceAllString(singerFoldername, "_"))
 	}
 	os.MkdirAll(singerFolder, os.ModePerm)
@@ -938,6 +1331,7 @@ func ripStation(albumId string, token string, storefront string, mediaUserToken
 		if exists {
 			counter.Success++
 			okDict[station.ID] = append(okDict[station.ID], 1)
+			if onFile != nil { onFile(trackPath) }
 
 			fmt.Println("Radio already exists locally.")
 			return nil
@@ -949,34 +1343,49 @@ func ripStation(albumId string, token string, storefront string, mediaUserToken
 			return err
 		}
 		trackM3U8 := strings.ReplaceAll(assetsUrl, "index.m3u8", "256/prog_index.m3u8")
+		stageDir, err := newStagingDir("station-" + station.ID)
+		if err != nil {
+			counter.Error++
+			return err
+		}
+		defer os.RemoveAll(stageDir)
+		stagedPath := filepath.Join(stageDir, filepath.Base(trackPath))
 		keyAndUrls, _ := runv3.Run(station.ID, trackM3U8, token, mediaUserToken, true)
-		err = runv3.ExtMvData(keyAndUrls, trackPath)
+		err = runv3.ExtMvData(keyAndUrls, stagedPath)
 		if err != nil {
 			fmt.Println("Failed to download station stream.", err)
 			counter.Error++
 			return err
 		}
-		tags := []string{
-			"tool=",
-			"disk=1/1",
-			"track=1",
-			"tracknum=1/1",
-			fmt.Sprintf("artist=%s", "Apple Music Station"),
-			fmt.Sprintf("performer=%s", "Apple Music Station"),
-			fmt.Sprintf("album_artist=%s", "Apple Music Station"),
-			fmt.Sprintf("album=%s", station.Name),
-			fmt.Sprintf("title=%s", station.Name),
+		tags := &mp4tag.MP4Tags{
+			Title:       station.Name,
+			Album:       station.Name,
+			Artist:      "Apple Music Station",
+			AlbumArtist: "Apple Music Station",
+			DiscNumber:  1,
+			DiscTotal:   1,
+			TrackNumber: 1,
+			TrackTotal:  1,
+			Custom:      map[string]string{"PERFORMER": "Apple Music Station"},
 		}
+		cover := ""
 		if Config.EmbedCover {
-			tags = append(tags, fmt.Sprintf("cover=%s", station.CoverPath))
+			cover = station.CoverPath
 		}
-		tagsString := strings.Join(tags, ":")
-		cmd := exec.Command("MP4Box", "-itags", tagsString, trackPath)
-		if err := cmd.Run(); err != nil {
+		if err := tagFile(stagedPath, tags, nil, cover); err != nil {
 			fmt.Printf("Embed failed: %v\n", err)
 		}
+		if err := verifyStagedFile(stagedPath); err != nil {
+			counter.Error++
+			return err
+		}
+		if err := publishFile(stagedPath, trackPath); err != nil {
+			counter.Error++
+			return err
+		}
 		counter.Success++
 		okDict[station.ID] = append(okDict[station.ID], 1)
+		if onFile != nil { onFile(trackPath) }
 		return nil
 	}
 
@@ -996,15 +1405,20 @@ func ripStation(albumId string, token string, storefront string, mediaUserToken
 	if true {
 		selected = arr
 	}
+	var failed []string
+	paths := make([]string, len(station.Tracks))
 	for i := range station.Tracks {
 		i++
 		if isInArray(selected, i) {
             if onSub != nil { onSub(0, "") }
-            ripTrack(&station.Tracks[i-1], token, mediaUserToken, onSub)
+            if err := ripTrack(&station.Tracks[i-1], token, mediaUserToken, opts, onSub, recordTrackFile(paths, i-1, onFile)); err != nil {
+                failed = append(failed, fmt.Sprintf("%s: %v", station.Tracks[i-1].Resp.Attributes.Name, err))
+            }
             if onSub != nil { onSub(100, "") }
 		}
 	}
-	return nil
+	writePlaylistFiles(playlistFolderPath, playlistFolder, station.Name, station.Tracks, paths, false)
+	return trackFailures(failed, len(selected))
 }
 
 func ripAlbum(
@@ -1014,14 +1428,28 @@ func ripAlbum(
 	mediaUserToken string,
 	urlArg_i string,
 	selectedFromAPI []int,
+	shared *sharedAssets,
+	opts dlOptions,
 	onProgress func(done, total int, msg string),
 	onSub func(percent int, msg string),
+	onFile func(path string),
 ) error {
-	album := task.NewAlbum(storefront, albumId)
-	if err := album.GetResp(token, Config.Language); err != nil {
+	album, err := shared.album(storefront, albumId, token)
+	if err != nil {
 		fmt.Println("Failed to get album response.")
 		return err
 	}
+	// 版本偏好：专辑另有 explicit / clean 版本时改下该版本，单曲按碟号与曲号对应到新版本
+	if id := preferredEdition(album.Resp.Data[0], storefront, token, opts.edition()); id != albumId {
+		edition, err := shared.album(storefront, id, token)
+		if err != nil {
+			fmt.Println("Failed to get preferred edition, keeping the given one:", err)
+		} else {
+			fmt.Printf("Using %s edition %s instead of %s\n", edition.Resp.Data[0].Attributes.ContentRating, id, albumId)
+			urlArg_i = editionTrackID(album, edition, urlArg_i)
+			album, albumId = edition, id
+		}
+	}
 	meta := album.Resp
 
 	// debug 模式下仅探测音质信息
@@ -1057,7 +1485,7 @@ func ripAlbum(
 				}
 			}
 
-			if _, _, err := extractMedia(m3u8Url, true); err != nil {
+			if _, _, err := extractMedia(m3u8Url, true, opts); err != nil {
 				fmt.Printf("Failed to extract quality info for track %d: %v\n", trackNum, err)
 				continue
 			}
@@ -1065,67 +1493,545 @@ func ripAlbum(
 		return nil
 	}
 
-	// 选择最终编码标签
-	var Codec string
-	switch {
-	case dl_atmos:
-		Codec = "ATMOS"
-	case dl_aac:
-		Codec = "AAC"
-	default:
-		Codec = "ALAC"
-	}
-	album.Codec = Codec
+	layout := albumFolders(album, storefront, token, opts)
+	singerFoldername, singerFolder := layout.SingerFoldername, layout.SingerFolder
+	albumFolderPath, Codec, Quality := layout.FolderPath, layout.Codec, layout.Quality
+	opts.Choices = layout.Choices
 
-	// 生成歌手文件夹
-	var singerFoldername string
-	if Config.ArtistFolderFormat != "" {
-		if len(meta.Data[0].Relationships.Artists.Data) > 0 {
-			singerFoldername = strings.NewReplacer(
-				"{UrlArtistName}", LimitString(meta.Data[0].Attributes.ArtistName),
-				"{ArtistName}", LimitString(meta.Data[0].Attributes.ArtistName),
-				"{ArtistId}", meta.Data[0].Relationships.Artists.Data[0].ID,
-			).Replace(Config.ArtistFolderFormat)
-		} else {
-			singerFoldername = strings.NewReplacer(
-				"{UrlArtistName}", LimitString(meta.Data[0].Attributes.ArtistName),
-				"{ArtistName}", LimitString(meta.Data[0].Attributes.ArtistName),
-				"{ArtistId}", "",
-			).Replace(Config.ArtistFolderFormat)
+	// 封面与动画封面
+	if Config.SaveArtistCover && len(meta.Data[0].Relationships.Artists.Data) > 0 {
+		if _, err := shared.cover(singerFolder, "folder", meta.Data[0].Relationships.Artists.Data[0].Attributes.Artwork.Url); err != nil {
+			fmt.Println("Failed to write artist cover.")
 		}
-		if strings.HasSuffix(singerFoldername, ".") {
-			singerFoldername = strings.ReplaceAll(singerFoldername, ".", "")
+	}
+	covPath, _ := shared.cover(albumFolderPath, "cover", meta.Data[0].Attributes.Artwork.URL)
+	if Config.SaveDescription != "" {
+		if err := writeAlbumDescription(albumFolderPath, meta.Data[0]); err != nil {
+			fmt.Println("Failed to write album description:", err)
 		}
-		singerFoldername = strings.TrimSpace(singerFoldername)
-		fmt.Println(singerFoldername)
 	}
-
-	singerFolder := filepath.Join(Config.AlacSaveFolder, forbiddenNames.ReplaceAllString(singerFoldername, "_"))
-	if dl_atmos {
-		singerFolder = filepath.Join(Config.AtmosSaveFolder, forbiddenNames.ReplaceAllString(singerFoldername, "_"))
+	if Config.SaveNfo {
+		if err := writeAlbumNfo(albumFolderPath, meta.Data[0]); err != nil {
+			fmt.Println("Failed to write album.nfo:", err)
+		}
 	}
-	if dl_aac {
-		singerFolder = filepath.Join(Config.AacSaveFolder, forbiddenNames.ReplaceAllString(singerFoldername, "_"))
+	// 艺人简介与 artist.nfo 和专辑的一样每次重写；没有艺人目录时 singerFolder 是保存根目录，不写
+	if (Config.SaveNfo || Config.SaveDescription != "") && singerFoldername != "" && len(meta.Data[0].Relationships.Artists.Data) > 0 {
+		if artist, err := shared.artist(storefront, meta.Data[0].Relationships.Artists.Data[0].ID, token); err != nil {
+			fmt.Println("Failed to get artist info:", err)
+		} else {
+			if Config.SaveDescription != "" {
+				if err := writeArtistDescription(singerFolder, artist); err != nil {
+					fmt.Println("Failed to write artist description:", err)
+				}
+			}
+			if Config.SaveNfo {
+				if err := writeArtistNfo(singerFolder, artist); err != nil {
+					fmt.Println("Failed to write artist.nfo:", err)
+				}
+			}
+		}
 	}
-	_ = os.MkdirAll(singerFolder, os.ModePerm)
-	album.SaveDir = singerFolder
 
-	// 质量字符串（用于命名）
-	var Quality string
-	if strings.Contains(Config.AlbumFolderFormat, "Quality") {
-		if dl_atmos {
-			Quality = fmt.Sprintf("%dKbps", Config.AtmosMax-2000)
-		} else if dl_aac && Config.AacType == "aac-lc" {
-			Quality = "256Kbps"
-		} else {
-			manifest1, err := ampapi.GetSongResp(storefront, meta.Data[0].Relationships.Tracks.Data[0].ID, album.Language, token)
-			if err == nil {
-				if manifest1.Data[0].Attributes.ExtendedAssetUrls.EnhancedHls == "" {
-					Codec = "AAC"
-					Quality = "256Kbps"
-				} else {
-					needCheck := false
-					if Config.GetM3u8Mode == "all" ||
+	if Config.SaveAnimatedArtwork && meta.Data[0].Attributes.EditorialVideo.MotionDetailSquare.Video != "" {
+		fmt.Println("Found Animation Artwork.")
+		square := filepath.Join(albumFolderPath, "square_animated_artwork.mp4")
+		if ok, _ := fileExists(square); !ok && !shared.reuse("square:"+albumId, square) {
+			if url, err := extractVideo(meta.Data[0].Attributes.EditorialVideo.MotionDetailSquare.Video); err == nil {
+				fmt.Println("Animation Artwork Square Downloading...")
+				cmd := exec.Command("ffmpeg", "-loglevel", "quiet", "-y", "-i", url, "-c", "copy", square)
+				if err := cmd.Run(); err != nil {
+					fmt.Printf("animated artwork square dl err: %v\n", err)
+				} else {
+					fmt.Println("Animation Artwork Square Downloaded")
+					shared.remember("square:"+albumId, square)
+				}
+			}
+		}
+		if Config.EmbyAnimatedArtwork {
+			cmd3 := exec.Command("ffmpeg", "-i", filepath.Join(albumFolderPath, "square_animated_artwork.mp4"), "-vf", "scale=440:-1", "-r", "24", "-f", "gif", filepath.Join(albumFolderPath, "folder.jpg"))
+			_ = cmd3.Run()
+		}
+		tall := filepath.Join(albumFolderPath, "tall_animated_artwork.mp4")
+		if ok, _ := fileExists(tall); !ok && !shared.reuse("tall:"+albumId, tall) {
+			if url, err := extractVideo(meta.Data[0].Attributes.EditorialVideo.MotionDetailTall.Video); err == nil {
+				fmt.Println("Animation Artwork Tall Downloading...")
+				cmd := exec.Command("ffmpeg", "-loglevel", "quiet", "-y", "-i", url, "-c", "copy", tall)
+				if err := cmd.Run(); err != nil {
+					fmt.Printf("animated artwork tall dl err: %v\n", err)
+				} else {
+					fmt.Println("Animation Artwork Tall Downloaded")
+					shared.remember("tall:"+albumId, tall)
+				}
+			}
+		}
+	}
+
+	// 初始化每首曲目的保存参数
+	for i := range album.Tracks {
+		album.Tracks[i].CoverPath = covPath
+		album.Tracks[i].SaveDir = albumFolderPath
+		album.Tracks[i].Codec = Codec
+	}
+
+	// === 从这里开始：进度与选择 ===
+	totalAll := len(meta.Data[0].Relationships.Tracks.Data)
+	if totalAll <= 0 {
+		if onProgress != nil {
+			onProgress(0, 1, "no tracks")
+		}
+		return nil
+	}
+
+	// 下载结束后按需写入 album.json
+	saveSidecar := func() {
+		if !Config.SaveAlbumJson {
+			return
+		}
+		if err := writeAlbumSidecar(album, albumFolderPath, Codec, Quality); err != nil {
+			fmt.Println("Failed to write album.json:", err)
+		}
+	}
+
+	// 单曲模式：仅下载 ?i= 指定的曲目（带进度）
+	if opts.Song && urlArg_i != "" {
+		if onProgress != nil {
+			onProgress(0, 1, "start single track")
+		}
+        for i := range album.Tracks {
+            if urlArg_i == album.Tracks[i].ID {
+                if onSub != nil { onSub(0, album.Tracks[i].Resp.Attributes.Name) }
+                err := ripTrack(&album.Tracks[i], token, mediaUserToken, opts, onSub, onFile)
+                saveSidecar()
+                if onProgress != nil {
+                    onProgress(1, 1, fmt.Sprintf("done: %s", album.Tracks[i].Resp.Attributes.Name))
+                }
+                if onSub != nil { onSub(100, "") }
+                if err != nil {
+                    return trackFailures([]string{fmt.Sprintf("%s: %v", album.Tracks[i].Resp.Attributes.Name, err)}, 1)
+                }
+                return nil
+            }
+        }
+		// 没找到也结束
+		if onProgress != nil {
+			onProgress(1, 1, "single track not found")
+		}
+		return nil
+	}
+
+	// 选曲：如果未指定，则默认全选
+	selected := selectedFromAPI
+	if len(selected) == 0 {
+		selected = make([]int, totalAll)
+		for i := range selected {
+			selected[i] = i + 1
+		}
+	}
+
+	done := 0
+	total := len(selected)
+	var failed []string
+	if onProgress != nil {
+		onProgress(0, total, "start album")
+	}
+    for i := range album.Tracks {
+        idx := i + 1
+        if isInArray(selected, idx) {
+            if onSub != nil { onSub(0, "") }
+            msg := ""
+            if err := ripTrack(&album.Tracks[i], token, mediaUserToken, opts, onSub, onFile); err != nil {
+                failed = append(failed, fmt.Sprintf("%s: %v", album.Tracks[i].Resp.Attributes.Name, err))
+                msg = fmt.Sprintf(" (failed: %v)", err)
+            }
+            done++
+            if onProgress != nil {
+                onProgress(done, total, fmt.Sprintf("done track %d/%d%s", done, total, msg))
+            }
+            if onSub != nil { onSub(100, "") }
+        }
+    }
+	saveSidecar()
+	return trackFailures(failed, total)
+}
+
+// dlOptions 是一次下载（一个任务，或多格式任务中的一个格式）的音质与版本选项；
+// 随调用逐层传递而不放在全局变量中，并发执行的任务之间互不影响
+type dlOptions struct {
+	Atmos   bool
+	AAC     bool
+	Best    bool   // quality "best"：按 quality-chain 逐首选择版本
+	Song    bool   // 单曲模式：专辑链接只下载 ?i= 指定的曲目
+	Edition string // 版本偏好 given/explicit/clean，空=edition-preference
+	// best：专辑（歌单）按曲目 ID 记下的 quality-chain 选择，ripTrack 直接沿用，不再重复读取 m3u8
+	Choices map[string]*bestChoice
+}
+
+// qualityOptions 返回 alac/aac/atmos/best 对应的下载选项
+func qualityOptions(quality string) dlOptions {
+	switch quality {
+	case "atmos":
+		return dlOptions{Atmos: true}
+	case "aac":
+		return dlOptions{AAC: true}
+	case "best":
+		return dlOptions{Best: true}
+	}
+	return dlOptions{}
+}
+
+// edition 返回版本偏好，任务未指定时用 edition-preference
+func (o dlOptions) edition() string {
+	return cmp.Or(o.Edition, Config.EditionPreference)
+}
+
+// preferredEdition 按版本偏好 prefer 在专辑的其他版本中查找 explicit / clean 版本（曲目数相同，优先同名），
+// 不需要替换或找不到时返回原专辑 ID
+func preferredEdition(data ampapi.AlbumRespData, storefront, token, prefer string) string {
+	rating := data.Attributes.ContentRating
+	if prefer == "given" || prefer == rating || prefer == "clean" && rating != "explicit" {
+		return data.ID
+	}
+	versions, err := ampapi.GetAlbumOtherVersions(storefront, data.ID, Config.Language, token)
+	if err != nil {
+		fmt.Println("Failed to get other versions:", err)
+		return data.ID
+	}
+	pick := ""
+	for _, v := range versions.Data {
+		if v.Attributes.ContentRating != prefer || v.Attributes.TrackCount != data.Attributes.TrackCount {
+			continue
+		}
+		if strings.EqualFold(v.Attributes.Name, data.Attributes.Name) {
+			return v.ID
+		}
+		if pick == "" {
+			pick = v.ID
+		}
+	}
+	return cmp.Or(pick, data.ID)
+}
+
+// editionTrackID 把原版本中的曲目 ID 换成另一版本中碟号、曲号相同的曲目 ID
+func editionTrackID(from, to *task.Album, id string) string {
+	if id == "" {
+		return id
+	}
+	for _, t := range from.Resp.Data[0].Relationships.Tracks.Data {
+		if t.ID != id {
+			continue
+		}
+		for _, u := range to.Resp.Data[0].Relationships.Tracks.Data {
+			if u.Attributes.DiscNumber == t.Attributes.DiscNumber && u.Attributes.TrackNumber == t.Attributes.TrackNumber {
+				return u.ID
+			}
+		}
+	}
+	return id
+}
+
+// albumEdition 是艺人专辑列表中的一个版本
+type albumEdition struct {
+	ID     string `json:"id"`
+	URL    string `json:"url"`
+	Rating string `json:"rating,omitempty"` // explicit / clean，空表示无分级
+}
+
+// discographyEntry 是艺人专辑列表中的一行；名称与发行日期都相同的 explicit / clean 版本合并为一行
+type discographyEntry struct {
+	Name     string
+	Date     string
+	Editions []albumEdition
+}
+
+// collapseEditions 合并名称与发行日期相同的版本，保持首次出现的顺序
+func collapseEditions(rows []discographyEntry) []discographyEntry {
+	out := make([]discographyEntry, 0, len(rows))
+	seen := make(map[string]int)
+	for _, r := range rows {
+		key := strings.ToLower(r.Name) + "|" + r.Date
+		if i, ok := seen[key]; ok {
+			out[i].Editions = append(out[i].Editions, r.Editions...)
+			continue
+		}
+		seen[key] = len(out)
+		out = append(out, r)
+	}
+	return out
+}
+
+// pick 按版本偏好选出一个版本，没有对应版本时用第一个；clean 偏好下无分级的版本优先于 explicit
+func (e discographyEntry) pick(prefer string) albumEdition {
+	fallback := e.Editions[0]
+	for _, ed := range e.Editions {
+		if ed.Rating == prefer && prefer != "given" {
+			return ed
+		}
+		if prefer == "clean" && ed.Rating == "" && fallback.Rating == "explicit" {
+			fallback = ed
+		}
+	}
+	return fallback
+}
+
+// ratings 返回该行包含的分级，如 [explicit clean]
+func (e discographyEntry) ratings() []string {
+	var out []string
+	for _, ed := range e.Editions {
+		if ed.Rating != "" && !contains(out, ed.Rating) {
+			out = append(out, ed.Rating)
+		}
+	}
+	return out
+}
+
+// sharedAssets 是一个任务内共用的下载结果：专辑/歌单元数据（曲目上已取得的歌词、制作人员随之复用）
+// 与封面、动画封面等文件。nil 表示不共用，每次都重新获取
+type sharedAssets struct {
+	mu        sync.Mutex
+	albums    map[string]*task.Album
+	playlists map[string]*task.Playlist
+	artists   map[string]ampapi.ArtistRespData
+	files     map[string]string // 资源标识 -> 已下载到的文件
+}
+
+func newSharedAssets() *sharedAssets {
+	return &sharedAssets{
+		albums:    make(map[string]*task.Album),
+		playlists: make(map[string]*task.Playlist),
+		artists:   make(map[string]ampapi.ArtistRespData),
+		files:     make(map[string]string),
+	}
+}
+
+// album 获取专辑元数据（含 alt-language 名称），同一任务内只请求一次
+func (s *sharedAssets) album(storefront, albumId, token string) (*task.Album, error) {
+	key := storefront + "/" + albumId
+	if s != nil {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if album, ok := s.albums[key]; ok {
+			return album, nil
+		}
+	}
+	album := task.NewAlbum(storefront, albumId)
+	if err := album.GetResp(token, Config.Language); err != nil {
+		return nil, err
+	}
+	if Config.AltLanguage.Language != "" {
+		if err := album.GetAltNames(token, Config.AltLanguage.Language); err != nil {
+			fmt.Println("Failed to get alt-language names:", err)
+		}
+	}
+	if s != nil {
+		s.albums[key] = album
+	}
+	return album, nil
+}
+
+// playlist 获取歌单元数据（含 alt-language 名称），同一任务内只请求一次
+func (s *sharedAssets) playlist(storefront, playlistId, token string) (*task.Playlist, error) {
+	key := storefront + "/" + playlistId
+	if s != nil {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if playlist, ok := s.playlists[key]; ok {
+			return playlist, nil
+		}
+	}
+	playlist := task.NewPlaylist(storefront, playlistId)
+	if err := playlist.GetResp(token, Config.Language); err != nil {
+		return nil, err
+	}
+	if Config.AltLanguage.Language != "" {
+		if err := playlist.GetAltNames(token, Config.AltLanguage.Language); err != nil {
+			fmt.Println("Failed to get alt-language names:", err)
+		}
+	}
+	if s != nil {
+		s.playlists[key] = playlist
+	}
+	return playlist, nil
+}
+
+// artist 获取艺人信息（简介、成立时间等），同一任务内只请求一次
+func (s *sharedAssets) artist(storefront, artistID, token string) (ampapi.ArtistRespData, error) {
+	key := storefront + "/" + artistID
+	if s != nil {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if artist, ok := s.artists[key]; ok {
+			return artist, nil
+		}
+	}
+	resp, err := ampapi.GetArtistResp(storefront, artistID, Config.Language, token)
+	if err != nil {
+		return ampapi.ArtistRespData{}, err
+	}
+	if s != nil {
+		s.artists[key] = resp.Data[0]
+	}
+	return resp.Data[0], nil
+}
+
+// remember 记录 key 对应的资源已下载到 path
+func (s *sharedAssets) remember(key, path string) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	s.files[key] = path
+	s.mu.Unlock()
+}
+
+// reuse 把本任务已下载过的 key 复制到 dst；没有下载过或复制失败时返回 false
+func (s *sharedAssets) reuse(key, dst string) bool {
+	if s == nil {
+		return false
+	}
+	s.mu.Lock()
+	src, ok := s.files[key]
+	s.mu.Unlock()
+	if !ok || src == dst {
+		return ok
+	}
+	stageDir, err := newStagingDir("shared")
+	if err != nil {
+		return false
+	}
+	defer os.RemoveAll(stageDir)
+	in, err := os.Open(src)
+	if err != nil {
+		return false
+	}
+	defer in.Close()
+	staged := filepath.Join(stageDir, filepath.Base(dst))
+	out, err := os.Create(staged)
+	if err != nil {
+		return false
+	}
+	_, err = io.Copy(out, in)
+	out.Close()
+	return err == nil && publishFile(staged, dst) == nil
+}
+
+// cover 与 writeCover 相同，但同一任务内同一张封面只下载一次
+func (s *sharedAssets) cover(dir, name, url string) (string, error) {
+	key := name + ":" + url
+	if s != nil {
+		s.mu.Lock()
+		src, ok := s.files[key]
+		s.mu.Unlock()
+		if dst := filepath.Join(dir, filepath.Base(src)); ok && s.reuse(key, dst) {
+			return dst, nil
+		}
+	}
+	covPath, err := writeCover(dir, name, url)
+	if err == nil {
+		s.remember(key, covPath)
+	}
+	return covPath, err
+}
+
+// albumLayout 是按 artist/album 目录模板算出的专辑保存位置
+type albumLayout struct {
+	SingerFoldername string
+	SingerFolder     string
+	FolderPath       string
+	Codec            string
+	Quality          string
+	Choices          map[string]*bestChoice // best：每首歌选出的版本，按曲目 ID
+}
+
+// albumFolders 按当前编码与目录模板计算（并创建）专辑所在的艺人目录与专辑目录，同时设置 album.SaveDir/SaveName
+func albumFolders(album *task.Album, storefront, token string, opts dlOptions) albumLayout {
+	meta := album.Resp
+	albumId := album.ID
+
+	// 选择最终编码标签
+	var Codec string
+	switch {
+	case opts.Atmos:
+		Codec = "ATMOS"
+	case opts.AAC:
+		Codec = "AAC"
+	default:
+		Codec = "ALAC"
+	}
+	var best *bestChoice
+	var choices map[string]*bestChoice
+	if opts.Best {
+		if best, choices = bestAlbumChoice(meta.Data[0].Relationships.Tracks.Data); best != nil {
+			Codec = best.Codec
+		}
+	}
+	album.Codec = Codec
+
+	// 生成歌手文件夹；古典专辑可按作曲家归档
+	var singerFoldername string
+	artistFolderFormat := Config.ArtistFolderFormat
+	if Config.ClassicalFolderFormat != "" && isClassicalAlbum(meta.Data[0].Relationships.Tracks.Data) {
+		artistFolderFormat = Config.ClassicalFolderFormat
+	}
+	// alt-language.folders：目录名使用第二语言的艺人名与专辑名
+	folderArtist, folderAlbum := meta.Data[0].Attributes.ArtistName, meta.Data[0].Attributes.Name
+	if Config.AltLanguage.Folders {
+		if album.Alt.AlbumArtist != "" {
+			folderArtist = album.Alt.AlbumArtist
+		}
+		if album.Alt.Album != "" {
+			folderAlbum = album.Alt.Album
+		}
+	}
+	if artistFolderFormat != "" {
+		composer := albumComposer(meta.Data[0].Relationships.Tracks.Data)
+		if composer == "" {
+			composer = folderArtist
+		}
+		if len(meta.Data[0].Relationships.Artists.Data) > 0 {
+			singerFoldername = strings.NewReplacer(
+				"{UrlArtistName}", LimitString(folderArtist),
+				"{ArtistName}", LimitString(folderArtist),
+				"{ArtistId}", meta.Data[0].Relationships.Artists.Data[0].ID,
+				"{ComposerName}", LimitString(composer),
+			).Replace(artistFolderFormat)
+		} else {
+			singerFoldername = strings.NewReplacer(
+				"{UrlArtistName}", LimitString(folderArtist),
+				"{ArtistName}", LimitString(folderArtist),
+				"{ArtistId}", "",
+				"{ComposerName}", LimitString(composer),
+			).Replace(artistFolderFormat)
+		}
+		if strings.HasSuffix(singerFoldername, ".") {
+			singerFoldername = strings.ReplaceAll(singerFoldername, ".", "")
+		}
+		singerFoldername = strings.TrimSpace(singerFoldername)
+		fmt.Println(singerFoldername)
+	}
+
+	singerFolder := filepath.Join(saveRoot(Codec), forbiddenNames.ReplaceAllString(singerFoldername, "_"))
+	_ = os.MkdirAll(singerFolder, os.ModePerm)
+	album.SaveDir = singerFolder
+
+	// 质量字符串（用于命名）
+	var Quality string
+	if strings.Contains(Config.AlbumFolderFormat, "Quality") {
+		if best != nil {
+			Quality = best.Quality
+		} else if opts.Atmos {
+			Quality = fmt.Sprintf("%dKbps", Config.AtmosMax-2000)
+		} else if opts.AAC && Config.AacType == "aac-lc" {
+			Quality = "256Kbps"
+		} else {
+			manifest1, err := ampapi.GetSongResp(storefront, meta.Data[0].Relationships.Tracks.Data[0].ID, album.Language, token)
+			if err == nil {
+				if manifest1.Data[0].Attributes.ExtendedAssetUrls.EnhancedHls == "" {
+					Codec = "AAC"
+					Quality = "256Kbps"
+				} else {
+					needCheck := false
+					if Config.GetM3u8Mode == "all" ||
 						(Config.GetM3u8Mode == "hires" && contains(meta.Data[0].Relationships.Tracks.Data[0].Attributes.AudioTraits, "hi-res-lossless")) {
 						needCheck = true
 					}
@@ -1134,7 +2040,7 @@ func ripAlbum(
 							manifest1.Data[0].Attributes.ExtendedAssetUrls.EnhancedHls = full
 						}
 					}
-					if _, q, err := extractMedia(manifest1.Data[0].Attributes.ExtendedAssetUrls.EnhancedHls, true); err == nil {
+					if _, q, err := extractMedia(manifest1.Data[0].Attributes.ExtendedAssetUrls.EnhancedHls, true, opts); err == nil {
 						Quality = q
 					}
 				}
@@ -1167,8 +2073,8 @@ func ripAlbum(
 	albumFolderName := strings.NewReplacer(
 		"{ReleaseDate}", meta.Data[0].Attributes.ReleaseDate,
 		"{ReleaseYear}", meta.Data[0].Attributes.ReleaseDate[:4],
-		"{ArtistName}", LimitString(meta.Data[0].Attributes.ArtistName),
-		"{AlbumName}", LimitString(meta.Data[0].Attributes.Name),
+		"{ArtistName}", LimitString(folderArtist),
+		"{AlbumName}", LimitString(folderAlbum),
 		"{UPC}", meta.Data[0].Attributes.Upc,
 		"{RecordLabel}", meta.Data[0].Attributes.RecordLabel,
 		"{Copyright}", meta.Data[0].Attributes.Copyright,
@@ -1186,116 +2092,188 @@ func ripAlbum(
 	_ = os.MkdirAll(albumFolderPath, os.ModePerm)
 	album.SaveName = albumFolderName
 	fmt.Println(albumFolderName)
+	return albumLayout{
+		SingerFoldername: singerFoldername,
+		SingerFolder:     singerFolder,
+		FolderPath:       albumFolderPath,
+		Codec:            Codec,
+		Quality:          Quality,
+		Choices:          choices,
+	}
+}
 
-	// 封面与动画封面
-	if Config.SaveArtistCover && len(meta.Data[0].Relationships.Artists.Data) > 0 {
-		if _, err := writeCover(singerFolder, "folder", meta.Data[0].Relationships.Artists.Data[0].Attributes.Artwork.Url); err != nil {
-			fmt.Println("Failed to write artist cover.")
-		}
+// editorialText 按 mode（short/standard）选出编辑推荐的纯文本，缺少所选版本时用另一个版本
+func editorialText(short, standard, mode string) string {
+	if mode == "short" && short != "" || standard == "" {
+		return nfo.PlainText(short)
 	}
-	covPath, _ := writeCover(albumFolderPath, "cover", meta.Data[0].Attributes.Artwork.URL)
+	return nfo.PlainText(standard)
+}
 
-	if Config.SaveAnimatedArtwork && meta.Data[0].Attributes.EditorialVideo.MotionDetailSquare.Video != "" {
-		fmt.Println("Found Animation Artwork.")
-		if url, err := extractVideo(meta.Data[0].Attributes.EditorialVideo.MotionDetailSquare.Video); err == nil {
-			if ok, _ := fileExists(filepath.Join(albumFolderPath, "square_animated_artwork.mp4")); !ok {
-				fmt.Println("Animation Artwork Square Downloading...")
-				cmd := exec.Command("ffmpeg", "-loglevel", "quiet", "-y", "-i", url, "-c", "copy", filepath.Join(albumFolderPath, "square_animated_artwork.mp4"))
-				if err := cmd.Run(); err != nil {
-					fmt.Printf("animated artwork square dl err: %v\n", err)
-				} else {
-					fmt.Println("Animation Artwork Square Downloaded")
-				}
-			}
+// descriptionName 返回 save-description 对应的文件名（description.txt / description.md）
+func descriptionName() string {
+	return "description." + Config.SaveDescription
+}
+
+// writeDescriptionFile 写入编辑推荐：txt 为纯文本，md 带标题并保留粗体/斜体；没有内容时不写
+func writeDescriptionFile(path, title, short, standard string) error {
+	if short == "" && standard == "" {
+		return nil
+	}
+	var b strings.Builder
+	if Config.SaveDescription == "md" {
+		b.WriteString("# " + title + "\n\n")
+		if short != "" && standard != "" {
+			b.WriteString("*" + nfo.PlainText(short) + "*\n\n")
 		}
-		if Config.EmbyAnimatedArtwork {
-			cmd3 := exec.Command("ffmpeg", "-i", filepath.Join(albumFolderPath, "square_animated_artwork.mp4"), "-vf", "scale=440:-1", "-r", "24", "-f", "gif", filepath.Join(albumFolderPath, "folder.jpg"))
-			_ = cmd3.Run()
+		if standard == "" {
+			standard = short
 		}
-		if url, err := extractVideo(meta.Data[0].Attributes.EditorialVideo.MotionDetailTall.Video); err == nil {
-			if ok, _ := fileExists(filepath.Join(albumFolderPath, "tall_animated_artwork.mp4")); !ok {
-				fmt.Println("Animation Artwork Tall Downloading...")
-				cmd := exec.Command("ffmpeg", "-loglevel", "quiet", "-y", "-i", url, "-c", "copy", filepath.Join(albumFolderPath, "tall_animated_artwork.mp4"))
-				if err := cmd.Run(); err != nil {
-					fmt.Printf("animated artwork tall dl err: %v\n", err)
-				} else {
-					fmt.Println("Animation Artwork Tall Downloaded")
-				}
-			}
+		b.WriteString(nfo.Markdown(standard) + "\n")
+	} else {
+		if short != "" {
+			b.WriteString(nfo.PlainText(short) + "\n\n")
+		}
+		if standard != "" {
+			b.WriteString(nfo.PlainText(standard) + "\n")
 		}
 	}
-
-	// 初始化每首曲目的保存参数
-	for i := range album.Tracks {
-		album.Tracks[i].CoverPath = covPath
-		album.Tracks[i].SaveDir = albumFolderPath
-		album.Tracks[i].Codec = Codec
+	tmp := path + ".part"
+	if err := os.WriteFile(tmp, []byte(b.String()), 0644); err != nil {
+		return err
 	}
-
-	// === 从这里开始：进度与选择 ===
-	totalAll := len(meta.Data[0].Relationships.Tracks.Data)
-	if totalAll <= 0 {
-		if onProgress != nil {
-			onProgress(0, 1, "no tracks")
-		}
-		return nil
-	}
-
-	// 单曲模式：仅下载 ?i= 指定的曲目（带进度）
-	if dl_song && urlArg_i != "" {
-		if onProgress != nil {
-			onProgress(0, 1, "start single track")
-		}
-        for i := range album.Tracks {
-            if urlArg_i == album.Tracks[i].ID {
-                if onSub != nil { onSub(0, album.Tracks[i].Resp.Attributes.Name) }
-                ripTrack(&album.Tracks[i], token, mediaUserToken, onSub)
-                if onProgress != nil {
-                    onProgress(1, 1, fmt.Sprintf("done: %s", album.Tracks[i].Resp.Attributes.Name))
-                }
-                if onSub != nil { onSub(100, "") }
-                return nil
-            }
-        }
-		// 没找到也结束
-		if onProgress != nil {
-			onProgress(1, 1, "single track not found")
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+// writeAlbumDescription 把专辑的编辑推荐写入专辑目录
+func writeAlbumDescription(dir string, data ampapi.AlbumRespData) error {
+	attrs := data.Attributes
+	title := attrs.Name
+	if attrs.ArtistName != "" {
+		title += " - " + attrs.ArtistName
+	}
+	return writeDescriptionFile(filepath.Join(dir, descriptionName()), title, attrs.EditorialNotes.Short, attrs.EditorialNotes.Standard)
+}
+
+// writeArtistDescription 把艺人简介写入艺人目录
+func writeArtistDescription(dir string, data ampapi.ArtistRespData) error {
+	attrs := data.Attributes
+	bio := attrs.ArtistBio
+	if bio == "" {
+		bio = attrs.EditorialNotes.Standard
+	}
+	return writeDescriptionFile(filepath.Join(dir, descriptionName()), attrs.Name, attrs.EditorialNotes.Short, bio)
+}
+
+// writeAlbumNfo 按 Kodi 格式写入 album.nfo
+func writeAlbumNfo(dir string, data ampapi.AlbumRespData) error {
+	attrs := data.Attributes
+	a := nfo.Album{
+		Title:        attrs.Name,
+		ArtistDesc:   attrs.ArtistName,
+		Compilation:  attrs.IsCompilation,
+		ReleaseType:  "album",
+		Review:       nfo.PlainText(attrs.EditorialNotes.Standard),
+		ReleaseDate:  attrs.ReleaseDate,
+		Label:        attrs.RecordLabel,
+		Copyright:    attrs.Copyright,
+		UPC:          attrs.Upc,
+		AppleMusicID: data.ID,
+		URL:          attrs.URL,
+	}
+	if attrs.IsSingle {
+		a.ReleaseType = "single"
+	}
+	if len(attrs.ReleaseDate) >= 4 {
+		a.Year = attrs.ReleaseDate[:4]
+	}
+	for _, g := range attrs.GenreNames {
+		if g != "Music" {
+			a.Genres = append(a.Genres, g)
 		}
-		return nil
 	}
+	if attrs.Artwork.URL != "" {
+		a.Thumbs = append(a.Thumbs, nfo.Thumb{Aspect: "thumb", URL: strings.Replace(attrs.Artwork.URL, "{w}x{h}", Config.CoverSize, 1)})
+	}
+	for _, ar := range data.Relationships.Artists.Data {
+		a.Artists = append(a.Artists, nfo.AlbumArtist{Artist: ar.Attributes.Name, AppleMusicID: ar.ID})
+	}
+	for _, t := range data.Relationships.Tracks.Data {
+		secs := t.Attributes.DurationInMillis / 1000
+		a.Tracks = append(a.Tracks, nfo.Track{
+			Disc:     t.Attributes.DiscNumber,
+			Position: t.Attributes.TrackNumber,
+			Title:    t.Attributes.Name,
+			Duration: fmt.Sprintf("%d:%02d", secs/60, secs%60),
+			ISRC:     t.Attributes.Isrc,
+		})
+	}
+	return nfo.Write(filepath.Join(dir, nfo.AlbumName), a)
+}
 
-	// 选曲：如果未指定，则默认全选
-	selected := selectedFromAPI
-	if len(selected) == 0 {
-		selected = make([]int, totalAll)
-		for i := range selected {
-			selected[i] = i + 1
-		}
-	}
-
-	done := 0
-	total := len(selected)
-	if onProgress != nil {
-		onProgress(0, total, "start album")
-	}
-    for i := range album.Tracks {
-        idx := i + 1
-        if isInArray(selected, idx) {
-            if onSub != nil { onSub(0, "") }
-            ripTrack(&album.Tracks[i], token, mediaUserToken, onSub)
-            done++
-            if onProgress != nil {
-                onProgress(done, total, fmt.Sprintf("done track %d/%d", done, total))
-            }
-            if onSub != nil { onSub(100, "") }
-        }
-    }
-	return nil
+// writeArtistNfo 按 Kodi 格式写入 artist.nfo
+func writeArtistNfo(dir string, data ampapi.ArtistRespData) error {
+	attrs := data.Attributes
+	a := nfo.Artist{
+		Name:         attrs.Name,
+		Type:         "Person",
+		Biography:    nfo.PlainText(attrs.ArtistBio),
+		Origin:       attrs.Origin,
+		AppleMusicID: data.ID,
+		URL:          attrs.URL,
+	}
+	if a.Biography == "" {
+		a.Biography = nfo.PlainText(attrs.EditorialNotes.Standard)
+	}
+	if attrs.IsGroup {
+		a.Type = "Group"
+		a.Formed = attrs.BornOrFormed
+	} else {
+		a.Born = attrs.BornOrFormed
+	}
+	for _, g := range attrs.GenreNames {
+		if g != "Music" {
+			a.Genres = append(a.Genres, g)
+		}
+	}
+	if attrs.Artwork.URL != "" {
+		a.Thumbs = append(a.Thumbs, nfo.Thumb{Aspect: "thumb", URL: strings.Replace(attrs.Artwork.URL, "{w}x{h}", Config.CoverSize, 1)})
+	}
+	return nfo.Write(filepath.Join(dir, nfo.ArtistName), a)
 }
 
-func ripPlaylist(playlistId string, token string, storefront string, mediaUserToken string, selectedFromAPI []int, onProgress func(done, total int, msg string), onSub func(percent int, msg string)) error {
-	playlist := task.NewPlaylist(storefront, playlistId)
-	err := playlist.GetResp(token, Config.Language)
+// writeAlbumSidecar 写入专辑目录下的 album.json；已有的 sidecar 中仍存在的曲目会保留
+func writeAlbumSidecar(album *task.Album, dir, codec, quality string) error {
+	s := task.NewAlbumSidecar(album, codec, quality)
+	path := filepath.Join(dir, task.AlbumSidecarName)
+	if old, err := task.ReadAlbumSidecar(path); err == nil {
+		s.Merge(old, dir)
+	}
+	if len(s.Tracks) == 0 {
+		return nil
+	}
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	stageDir, err := newStagingDir("album-json")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(stageDir)
+	staged := filepath.Join(stageDir, task.AlbumSidecarName)
+	if err := os.WriteFile(staged, data, 0644); err != nil {
+		return err
+	}
+	return publishFile(staged, path)
+}
+
+func ripPlaylist(playlistId string, token string, storefront string, mediaUserToken string, selectedFromAPI []int, syncMode bool, shared *sharedAssets, opts dlOptions, onProgress func(done, total int, msg string), onSub func(percent int, msg string), onFile func(path string)) error {
+	playlist, err := shared.playlist(storefront, playlistId, token)
 	if err != nil {
 		fmt.Println("Failed to get playlist response.")
 		return err
@@ -1337,7 +2315,7 @@ func ripPlaylist(playlistId string, token string, storefront string, mediaUserTo
 				}
 			}
 
-			_, _, err = extractMedia(m3u8Url, true)
+			_, _, err = extractMedia(m3u8Url, true, opts)
 			if err != nil {
 				fmt.Printf("Failed to extract quality info for track %d: %v\n", trackNum, err)
 				continue
@@ -1348,13 +2326,20 @@ func ripPlaylist(playlistId string, token string, storefront string, mediaUserTo
 
 	// 编码类型
 	var Codec string
-	if dl_atmos {
+	if opts.Atmos {
 		Codec = "ATMOS"
-	} else if dl_aac {
+	} else if opts.AAC {
 		Codec = "AAC"
 	} else {
 		Codec = "ALAC"
 	}
+	// best：歌单中混有多种版本时按 quality-chain-folder 决定目录
+	var best *bestChoice
+	if opts.Best {
+		if best, opts.Choices = bestAlbumChoice(meta.Data[0].Relationships.Tracks.Data); best != nil {
+			Codec = best.Codec
+		}
+	}
 	playlist.Codec = Codec
 
 	// “Apple Music” 目录
@@ -1371,22 +2356,18 @@ func ripPlaylist(playlistId string, token string, storefront string, mediaUserTo
 		singerFoldername = strings.TrimSpace(singerFoldername)
 		fmt.Println(singerFoldername)
 	}
-	singerFolder := filepath.Join(Config.AlacSaveFolder, forbiddenNames.ReplaceAllString(singerFoldername, "_"))
-	if dl_atmos {
-		singerFolder = filepath.Join(Config.AtmosSaveFolder, forbiddenNames.ReplaceAllString(singerFoldername, "_"))
-	}
-	if dl_aac {
-		singerFolder = filepath.Join(Config.AacSaveFolder, forbiddenNames.ReplaceAllString(singerFoldername, "_"))
-	}
+	singerFolder := filepath.Join(saveRoot(Codec), forbiddenNames.ReplaceAllString(singerFoldername, "_"))
 	_ = os.MkdirAll(singerFolder, os.ModePerm)
 	playlist.SaveDir = singerFolder
 
 	// 质量标签（仅用于命名）
 	var Quality string
 	if strings.Contains(Config.AlbumFolderFormat, "Quality") {
-		if dl_atmos {
+		if best != nil {
+			Quality = best.Quality
+		} else if opts.Atmos {
 			Quality = fmt.Sprintf("%dKbps", Config.AtmosMax-2000)
-		} else if dl_aac && Config.AacType == "aac-lc" {
+		} else if opts.AAC && Config.AacType == "aac-lc" {
 			Quality = "256Kbps"
 		} else {
 			manifest1, err := ampapi.GetSongResp(storefront, meta.Data[0].Relationships.Tracks.Data[0].ID, playlist.Language, token)
@@ -1408,7 +2389,7 @@ func ripPlaylist(playlistId string, token string, storefront string, mediaUserTo
 							manifest1.Data[0].Attributes.ExtendedAssetUrls.EnhancedHls = enhanced
 						}
 					}
-					if _, q, err := extractMedia(manifest1.Data[0].Attributes.ExtendedAssetUrls.EnhancedHls, true); err == nil {
+					if _, q, err := extractMedia(manifest1.Data[0].Attributes.ExtendedAssetUrls.EnhancedHls, true, opts); err == nil {
 						Quality = q
 					}
 				}
@@ -1514,7 +2495,7 @@ func ripPlaylist(playlistId string, token string, storefront string, mediaUserTo
 	}
 
 	var selected []int
-	if len(selectedFromAPI) > 0 {
+	if len(selectedFromAPI) > 0 && !syncMode {
 		selected = selectedFromAPI
 	} else {
 		selected = fullArr
@@ -1526,109 +2507,909 @@ func ripPlaylist(playlistId string, token string, storefront string, mediaUserTo
 		onProgress(0, trackTotal, "start playlist")
 	}
 
+	// 同步模式：按状态文件找回已有曲目、处理已移除的曲目并分配编号
+	numbers := make([]int, len(playlist.Tracks))
+	for i := range numbers {
+		numbers[i] = i + 1
+	}
+	statePath := filepath.Join(playlistFolderPath, task.PlaylistStateName)
+	var state *task.PlaylistState
+	var kept []string
+	if syncMode {
+		if state, err = task.ReadPlaylistState(statePath); err != nil {
+			fmt.Println("Failed to read playlist sync state, syncing from scratch:", err)
+			state = &task.PlaylistState{}
+		}
+		kept = syncPlaylistState(playlistFolderPath, state, playlist.Tracks, numbers)
+	}
+
     done := 0
+    var failed []string
+    paths := make([]string, len(playlist.Tracks))
+    albums := map[string]*task.Album{}
     for i := range playlist.Tracks {
         idx := i + 1
         if isInArray(selected, idx) {
+            if syncMode && kept[i] != "" {
+                paths[i] = kept[i]
+                if onFile != nil { onFile(kept[i]) }
+                done++
+                if onProgress != nil {
+                    onProgress(done, trackTotal, fmt.Sprintf("kept track %d/%d", done, trackTotal))
+                }
+                continue
+            }
+            playlist.Tracks[i].TaskNum = numbers[i]
             if onSub != nil { onSub(0, playlist.Tracks[i].Resp.Attributes.Name) }
-            ripTrack(&playlist.Tracks[i], token, mediaUserToken, onSub)
+            if Config.PlaylistMode == "reference" && playlist.Tracks[i].Type == "songs" {
+                if err := placeInAlbum(&playlist.Tracks[i], token, opts, shared, albums); err != nil {
+                    fmt.Println("Failed to resolve album folder, saving in playlist folder:", err)
+                }
+            }
+            msg := ""
+            if err := ripTrack(&playlist.Tracks[i], token, mediaUserToken, opts, onSub, recordTrackFile(paths, i, onFile)); err != nil {
+                failed = append(failed, fmt.Sprintf("%s: %v", playlist.Tracks[i].Resp.Attributes.Name, err))
+                msg = fmt.Sprintf(" (failed: %v)", err)
+            }
             done++
             if onProgress != nil {
-                onProgress(done, trackTotal, fmt.Sprintf("done track %d/%d", done, trackTotal))
+                onProgress(done, trackTotal, fmt.Sprintf("done track %d/%d%s", done, trackTotal, msg))
             }
             if onSub != nil { onSub(100, "") }
         }
     }
-	return nil
+	var links []string
+	if Config.PlaylistMode == "reference" {
+		links = linkPlaylistTracks(playlistFolderPath, paths, numbers)
+	}
+	if syncMode {
+		if err := savePlaylistState(statePath, state, playlist, paths, numbers, links); err != nil {
+			fmt.Println("Failed to write playlist sync state:", err)
+		}
+	}
+	// 只选了部分曲目时，未选的曲目按同步状态补上仍存在的文件；仍有找不到的曲目时不覆盖已有的歌单文件
+	incomplete := false
+	if len(selected) < len(playlist.Tracks) {
+		if state == nil {
+			if state, err = task.ReadPlaylistState(statePath); err != nil {
+				state = &task.PlaylistState{}
+			}
+		}
+		for i, t := range playlist.Tracks {
+			if isInArray(selected, i+1) {
+				continue
+			}
+			if e, ok := state.Lookup(t.ID); ok {
+				if file := playlistStatePath(playlistFolderPath, e.File); file != "" {
+					if ok, _ := fileExists(file); ok {
+						paths[i] = file
+						continue
+					}
+				}
+			}
+			incomplete = true
+		}
+	}
+	writePlaylistFiles(playlistFolderPath, playlistFolder, meta.Data[0].Attributes.Name, playlist.Tracks, paths, incomplete)
+	return trackFailures(failed, trackTotal)
+}
+
+// placeInAlbum 把歌单中的曲目换成其所属专辑中的同一首，使其按专辑模板保存到（或复用）专辑目录；
+// albums 记录本次歌单已算好目录的专辑，专辑元数据与封面经 shared 在任务内共用
+func placeInAlbum(track *task.Track, token string, opts dlOptions, shared *sharedAssets, albums map[string]*task.Album) error {
+	albumID := ""
+	if len(track.Resp.Relationships.Albums.Data) > 0 {
+		albumID = track.Resp.Relationships.Albums.Data[0].ID
+	} else {
+		if err := track.GetAlbumData(token); err != nil {
+			return err
+		}
+		albumID = track.AlbumData.ID
+	}
+	if albumID == "" {
+		return errors.New("track has no album")
+	}
+	album, ok := albums[albumID]
+	if !ok {
+		var err error
+		if album, err = shared.album(track.Storefront, albumID, token); err != nil {
+			return err
+		}
+		layout := albumFolders(album, track.Storefront, token, opts)
+		covPath, _ := shared.cover(layout.FolderPath, "cover", album.GetArtwork())
+		for i := range album.Tracks {
+			album.Tracks[i].SaveDir = layout.FolderPath
+			album.Tracks[i].Codec = layout.Codec
+			album.Tracks[i].CoverPath = covPath
+		}
+		albums[albumID] = album
+	}
+	for _, t := range album.Tracks {
+		if t.ID == track.ID {
+			*track = t
+			return nil
+		}
+	}
+	return fmt.Errorf("track %s not found in album %s", track.ID, albumID)
+}
+
+// linkPlaylistTracks 按 playlist-links 在歌单目录中为保存在别处的曲目建立硬链接或符号链接，名称前加编号；
+// 返回每首曲目对应的链接（没有时为空）
+func linkPlaylistTracks(dir string, paths []string, numbers []int) []string {
+	links := make([]string, len(paths))
+	if Config.PlaylistLinks == "" {
+		return links
+	}
+	width := 2
+	for _, n := range numbers {
+		width = max(width, len(strconv.Itoa(n)))
+	}
+	for i, p := range paths {
+		if p == "" || filepath.Dir(p) == dir {
+			continue
+		}
+		link := filepath.Join(dir, fmt.Sprintf("%0*d %s", width, numbers[i], filepath.Base(p)))
+		if _, err := os.Lstat(link); err == nil {
+			links[i] = link
+			continue
+		}
+		var err error
+		if Config.PlaylistLinks == "symlink" {
+			target, rerr := filepath.Rel(dir, p)
+			if rerr != nil {
+				target = p
+			}
+			err = os.Symlink(target, link)
+		} else {
+			err = os.Link(p, link)
+		}
+		if err != nil {
+			fmt.Printf("Failed to link %s: %v\n", link, err)
+			continue
+		}
+		links[i] = link
+	}
+	return links
+}
+
+// playlistStatePath 把同步状态中相对于歌单目录的路径还原为完整路径
+func playlistStatePath(dir, rel string) string {
+	if rel == "" || filepath.IsAbs(rel) {
+		return rel
+	}
+	return filepath.Join(dir, rel)
+}
+
+// syncPlaylistState 对比同步状态与当前歌单：按 playlist-sync-removed 处理已移除的曲目，
+// 按 playlist-sync-numbering 填写 numbers（position 模式会重命名编号变化的文件，
+// playlist-album 为 playlist 时同时改写其 trkn）；返回每首曲目已保存且仍存在的文件，为空表示需要下载
+func syncPlaylistState(dir string, state *task.PlaylistState, tracks []task.Track, numbers []int) []string {
+	current := map[string]bool{}
+	for _, t := range tracks {
+		current[t.ID] = true
+	}
+	next := 0
+	for _, e := range state.Tracks {
+		next = max(next, e.Number)
+		if !current[e.ID] {
+			fmt.Printf("Removed from playlist: %s\n", e.Name)
+			removePlaylistEntry(dir, e)
+		}
+	}
+
+	kept := make([]string, len(tracks))
+	// number 非零的是音频文件，改名时 trkn 一并改为新编号
+	type move struct {
+		from, to string
+		number   int
+	}
+	var moves []move
+	for i, t := range tracks {
+		e, ok := state.Lookup(t.ID)
+		if !ok {
+			if Config.PlaylistSyncNumbering == "stable" && len(state.Tracks) > 0 {
+				next++
+				numbers[i] = next
+			}
+			continue
+		}
+		file := playlistStatePath(dir, e.File)
+		if _, err := os.Stat(file); err != nil {
+			if Config.PlaylistSyncNumbering == "stable" {
+				numbers[i] = e.Number
+			}
+			continue
+		}
+		kept[i] = file
+		if Config.PlaylistSyncNumbering == "stable" {
+			numbers[i] = e.Number
+			continue
+		}
+		// 专辑目录中的文件（reference 模式）不改名，只按新编号重建链接
+		if e.Number == numbers[i] || filepath.Dir(file) != dir {
+			continue
+		}
+		name, ok := renumberedName(filepath.Base(file), e.Number, numbers[i])
+		if !ok {
+			fmt.Printf("Cannot renumber %s, keeping its name\n", filepath.Base(file))
+			numbers[i] = e.Number
+			continue
+		}
+		renamed := filepath.Join(dir, name)
+		number := 0
+		if Config.Tags.PlaylistAlbum == "playlist" {
+			number = numbers[i]
+		}
+		moves = append(moves, move{file, renamed, number})
+		oldBase, newBase := strings.TrimSuffix(file, filepath.Ext(file)), strings.TrimSuffix(renamed, filepath.Ext(renamed))
+		for _, ext := range []string{".lrc", ".ttml"} {
+			if ok, _ := fileExists(oldBase + ext); ok {
+				moves = append(moves, move{oldBase + ext, newBase + ext, 0})
+			}
+		}
+		kept[i] = renamed
+	}
+	// 编号可能互换，先全部移到临时名再改成新名
+	for _, m := range moves {
+		if err := os.Rename(m.from, m.from+".renumber"); err != nil {
+			fmt.Println("Failed to renumber:", err)
+		}
+	}
+	for _, m := range moves {
+		if m.number > 0 {
+			if err := renumberTrackFile(m.from+".renumber", m.to, m.number, len(tracks)); err != nil {
+				fmt.Printf("Failed to update track number of %s: %v\n", filepath.Base(m.to), err)
+			} else {
+				continue
+			}
+		}
+		if err := os.Rename(m.from+".renumber", m.to); err != nil {
+			fmt.Println("Failed to renumber:", err)
+		}
+	}
+	return kept
+}
+
+// renumberTrackFile 在暂存副本上把 trkn 改为 n/total，校验后发布为 dst 并删除 src；
+// 失败时 src 保持不变
+func renumberTrackFile(src, dst string, n, total int) error {
+	stageDir, err := newStagingDir("retag")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(stageDir)
+	staged := filepath.Join(stageDir, filepath.Base(dst))
+	if err := cloneFile(src, staged); err != nil {
+		return err
+	}
+	if err := mp4meta.SetAtoms(staged, []mp4meta.Atom{mp4meta.TrackNumberAtom(n, total)}, nil); err != nil {
+		return err
+	}
+	if err := verifyStagedFile(staged); err != nil {
+		return err
+	}
+	if err := publishFile(staged, dst); err != nil {
+		return err
+	}
+	return os.Remove(src)
+}
+
+// renumberedName 把按 song-file-format 生成的文件名中的编号从 old 改为 n；
+// 只在 {SongNumer} 之前没有其他占位符时才能可靠地定位编号
+func renumberedName(base string, old, n int) (string, bool) {
+	pos := strings.Index(Config.SongFileFormat, "{SongNumer}")
+	if pos < 0 || strings.Contains(Config.SongFileFormat[:pos], "{") {
+		return "", false
+	}
+	prefix := forbiddenNames.ReplaceAllString(Config.SongFileFormat[:pos], "_")
+	oldPrefix := prefix + fmt.Sprintf("%02d", old)
+	if !strings.HasPrefix(base, oldPrefix) {
+		return "", false
+	}
+	return prefix + fmt.Sprintf("%02d", n) + base[len(oldPrefix):], true
+}
+
+// removePlaylistEntry 处理已从歌单移除的曲目：删除其链接，歌单目录中的文件按 playlist-sync-removed 删除或移到 _removed/
+func removePlaylistEntry(dir string, e task.PlaylistStateTrack) {
+	if e.Link != "" {
+		os.Remove(playlistStatePath(dir, e.Link))
+	}
+	file := playlistStatePath(dir, e.File)
+	if file == "" || filepath.Dir(file) != dir {
+		return
+	}
+	base := strings.TrimSuffix(file, filepath.Ext(file))
+	for _, f := range []string{file, base + ".lrc", base + ".ttml"} {
+		if ok, _ := fileExists(f); !ok {
+			continue
+		}
+		var err error
+		switch Config.PlaylistSyncRemoved {
+		case "delete":
+			err = os.Remove(f)
+		case "archive":
+			archived := filepath.Join(dir, "_removed")
+			if err = os.MkdirAll(archived, os.ModePerm); err == nil {
+				err = os.Rename(f, filepath.Join(archived, filepath.Base(f)))
+			}
+		}
+		if err != nil {
+			fmt.Printf("Failed to %s %s: %v\n", Config.PlaylistSyncRemoved, f, err)
+		}
+	}
+}
+
+// savePlaylistState 按当前歌单顺序写入同步状态，只记录已保存的曲目（失败的曲目下次同步时重试）；
+// 编号变化后留下的旧链接一并删除
+func savePlaylistState(path string, old *task.PlaylistState, playlist *task.Playlist, paths []string, numbers []int, links []string) error {
+	dir := filepath.Dir(path)
+	rel := func(p string) string {
+		if p == "" {
+			return ""
+		}
+		if r, err := filepath.Rel(dir, p); err == nil {
+			return r
+		}
+		return p
+	}
+	s := &task.PlaylistState{PlaylistID: playlist.ID, Storefront: playlist.Storefront}
+	for i, t := range playlist.Tracks {
+		if paths[i] == "" {
+			continue
+		}
+		link := ""
+		if i < len(links) {
+			link = links[i]
+		}
+		if e, ok := old.Lookup(t.ID); ok && e.Link != "" && playlistStatePath(dir, e.Link) != link {
+			os.Remove(playlistStatePath(dir, e.Link))
+		}
+		s.Tracks = append(s.Tracks, task.PlaylistStateTrack{
+			ID:     t.ID,
+			Name:   t.Resp.Attributes.Name,
+			Number: numbers[i],
+			File:   rel(paths[i]),
+			Link:   rel(link),
+		})
+	}
+	return s.Write(path)
+}
+
+// recordTrackFile 包装 onFile，记下第 i 首曲目实际保存的位置（曲目可能不在歌单目录中）
+func recordTrackFile(paths []string, i int, onFile func(string)) func(string) {
+	return func(p string) {
+		if paths[i] == "" {
+			paths[i] = p
+		}
+		if onFile != nil {
+			onFile(p)
+		}
+	}
+}
+
+// writePlaylistFiles 按 playlist-files 在歌单目录写入 m3u8/xspf，顺序与来源歌单一致，只包含已保存的曲目；
+// incomplete 表示 paths 缺少可能已保存的曲目，此时已存在的歌单文件保持不变
+func writePlaylistFiles(dir, name, title string, tracks []task.Track, paths []string, incomplete bool) {
+	var entries []playlistfile.Entry
+	for i, p := range paths {
+		if p == "" {
+			continue
+		}
+		attrs := tracks[i].Resp.Attributes
+		entries = append(entries, playlistfile.Entry{
+			Path:       p,
+			Title:      attrs.Name,
+			Artist:     attrs.ArtistName,
+			Album:      attrs.AlbumName,
+			DurationMs: attrs.DurationInMillis,
+		})
+	}
+	if len(entries) == 0 {
+		return
+	}
+	base := forbiddenNames.ReplaceAllString(name, "_")
+	for _, format := range Config.PlaylistFiles {
+		path := filepath.Join(dir, base+"."+format)
+		if incomplete {
+			if ok, _ := fileExists(path); ok {
+				fmt.Printf("Only some tracks selected, keeping %s\n", filepath.Base(path))
+				continue
+			}
+		}
+		if err := playlistfile.Write(path, format, title, entries); err != nil {
+			fmt.Printf("Failed to write %s playlist: %v\n", format, err)
+		}
+	}
+}
+
+// tagFieldNames 是 tags.fields / tags.skip 可用的字段名
+var tagFieldNames = []string{
+	"title", "artist", "album", "album-artist", "composer", "genre", "date", "copyright",
+	"publisher", "lyrics", "track-number", "disc-number", "advisory", "itunes-song-id",
+	"itunes-album-id", "itunes-artist-id", "itunes-genre-id", "storefront-id", "media-kind",
+	"artists", "credits", "work", "description", "cover", "custom",
+}
+
+// tagEnabled 按 tags.fields（白名单，空表示全部）与 tags.skip 判断是否写入某个字段
+func tagEnabled(name string) bool {
+	if len(Config.Tags.Fields) > 0 && !contains(Config.Tags.Fields, name) {
+		return false
+	}
+	return !contains(Config.Tags.Skip, name)
+}
+
+// tagSource 是写标签前整理出的元数据；歌曲与 MV 都先转成它，再经同一套策略生成标签
+type tagSource struct {
+	Title     string
+	Artist    string
+	Artists   []string
+	ArtistIDs []string
+	// 排序字段，为空时与显示值相同（alt-language 会填入另一种语言的名称）
+	TitleSort       string
+	ArtistSort      string
+	AlbumSort       string
+	AlbumArtistSort string
+	ComposerSort    string
+	Album           string
+	AlbumArtist     string
+	Composer        string
+	Genre           string
+	Date            string
+	ReleaseDate     string
+	Copyright       string
+	Label           string
+	ISRC            string
+	UPC             string
+	Lyrics          string
+	SongID          string
+	AlbumID         string
+	ArtistID        string
+	GenreID         string
+	Storefront      string
+	PlaylistName    string
+	ContentRating   string
+	MediaKind       int
+	Credits         map[string][]string
+	// 专辑编辑推荐（纯文本），按 tags.description 选择简短或完整版本
+	Description string
+	// 古典音乐的作品与乐章
+	Work           string
+	Movement       string
+	MovementNumber int
+	MovementCount  int
+	Attribution    string
+	TrackNumber    int
+	TrackTotal     int
+	DiscNumber     int
+	DiscTotal      int
+}
+
+// applyTrackContext 按 tags.playlist-album 填充专辑相关字段：歌单（电台）作为专辑，或使用歌曲原专辑
+func applyTrackContext(src *tagSource, track *task.Track) {
+	inPlaylist := track.PreType == "playlists" || track.PreType == "stations"
+	if inPlaylist {
+		src.PlaylistName = track.PlaylistData.Attributes.Name
+	}
+	if inPlaylist && Config.Tags.PlaylistAlbum == "playlist" {
+		src.Album = track.PlaylistData.Attributes.Name
+		src.AlbumArtist = track.PlaylistData.Attributes.ArtistName
+		src.TrackNumber, src.TrackTotal = track.TaskNum, track.TaskTotal
+		src.DiscNumber, src.DiscTotal = 1, 1
+		return
+	}
+	album := track.AlbumData.Attributes
+	if album.Name != "" {
+		src.Album = album.Name
+	}
+	src.AlbumArtist = album.ArtistName
+	src.TrackTotal = album.TrackCount
+	src.DiscTotal = track.DiscTotal
+	src.Date = album.ReleaseDate
+	src.Copyright = album.Copyright
+	src.Label = album.RecordLabel
+	src.UPC = album.Upc
+	if Config.Tags.Description != "" {
+		src.Description = editorialText(album.EditorialNotes.Short, album.EditorialNotes.Standard, Config.Tags.Description)
+	}
+	if track.AlbumData.ID != "" {
+		src.AlbumID = track.AlbumData.ID
+	}
+}
+
+func songTagSource(track *task.Track, lrc string) tagSource {
+	attrs := track.Resp.Attributes
+	src := tagSource{
+		Title:         attrs.Name,
+		Artist:        attrs.ArtistName,
+		Album:         attrs.AlbumName,
+		Composer:      attrs.ComposerName,
+		ReleaseDate:   attrs.ReleaseDate,
+		ISRC:          attrs.Isrc,
+		Lyrics:        lrc,
+		SongID:        track.ID,
+		GenreID:       primaryGenreID(track.Resp.Relationships.Genres.Data),
+		Storefront:    track.Storefront,
+		ContentRating: attrs.ContentRating,
+		MediaKind:     mediaKindSong,
+		TrackNumber:   attrs.TrackNumber,
+		DiscNumber:    attrs.DiscNumber,
+
+		Work:           attrs.WorkName,
+		Movement:       attrs.MovementName,
+		MovementNumber: attrs.MovementNumber,
+		MovementCount:  attrs.MovementCount,
+		Attribution:    attrs.Attribution,
+	}
+	if len(attrs.GenreNames) > 0 {
+		src.Genre = attrs.GenreNames[0]
+	}
+	if track.PreType == "albums" {
+		src.AlbumID = track.PreID
+	}
+	for _, a := range track.Resp.Relationships.Artists.Data {
+		src.Artists = append(src.Artists, a.Attributes.Name)
+		src.ArtistIDs = append(src.ArtistIDs, a.ID)
+	}
+	if len(src.ArtistIDs) > 0 {
+		src.ArtistID = src.ArtistIDs[0]
+	}
+	src.Credits = creditTags(track.Credits)
+	applyTrackContext(&src, track)
+	applyAltNames(&src, track)
+	return src
+}
+
+// applyAltNames 按 alt-language.policy 合并第二语言的名称：sort 写入排序字段，display 与显示值互换
+func applyAltNames(src *tagSource, track *task.Track) {
+	if Config.AltLanguage.Policy == "" {
+		return
+	}
+	type altPair struct {
+		display, sort *string
+		alt           string
+	}
+	alt := track.Alt
+	pairs := []altPair{
+		{&src.Title, &src.TitleSort, alt.Title},
+		{&src.Artist, &src.ArtistSort, alt.Artist},
+		{&src.Composer, &src.ComposerSort, alt.Composer},
+	}
+	// 歌单作为专辑时专辑名不是曲目本身的属性
+	inPlaylist := track.PreType == "playlists" || track.PreType == "stations"
+	if !inPlaylist || Config.Tags.PlaylistAlbum == "original" {
+		pairs = append(pairs,
+			altPair{&src.Album, &src.AlbumSort, alt.Album},
+			altPair{&src.AlbumArtist, &src.AlbumArtistSort, alt.AlbumArtist},
+		)
+	}
+	for _, p := range pairs {
+		if p.alt == "" || p.alt == *p.display {
+			continue
+		}
+		if Config.AltLanguage.Policy == "display" {
+			*p.sort = *p.display
+			*p.display = p.alt
+		} else {
+			*p.sort = p.alt
+		}
+	}
+}
+
+// primaryGenreID 返回第一个具体流派的 id；34（Music）只在没有其他流派时使用
+func primaryGenreID(genres []struct {
+	ID   string `json:"id"`
+	Type string `json:"type"`
+}) string {
+	id := ""
+	for _, g := range genres {
+		if g.ID != "34" {
+			return g.ID
+		}
+		id = g.ID
+	}
+	return id
+}
+
+// isClassicalAlbum 按流派 id 5（Classical）判断古典专辑；流派名称随 language 变化，不能按名称匹配。
+// 专辑本身不带流派关系，看其中歌曲的流派
+func isClassicalAlbum(tracks []ampapi.TrackRespData) bool {
+	for _, t := range tracks {
+		for _, g := range t.Relationships.Genres.Data {
+			if g.ID == "5" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// albumComposer 返回专辑中署名曲目最多的作曲家（Attribution 优先，其次 ComposerName）
+func albumComposer(tracks []ampapi.TrackRespData) string {
+	count := map[string]int{}
+	best := ""
+	for _, t := range tracks {
+		name := t.Attributes.Attribution
+		if name == "" {
+			name = t.Attributes.ComposerName
+		}
+		if name == "" {
+			continue
+		}
+		count[name]++
+		if count[name] > count[best] {
+			best = name
+		}
+	}
+	return best
+}
+
+// creditTags 按 tags.credit-roles 把制作人员名单整理成 freeform 原子名到多个值的映射
+func creditTags(cats []ampapi.CreditCategory) map[string][]string {
+	out := map[string][]string{}
+	add := func(key, value string) {
+		if !contains(out[key], value) {
+			out[key] = append(out[key], value)
+		}
+	}
+	performerKey := Config.Tags.CreditRoles["performer"]
+	for _, cat := range cats {
+		performers := strings.Contains(strings.ToLower(cat.Attributes.Kind+" "+cat.Attributes.Title), "perform")
+		for _, a := range cat.Relationships.CreditArtists.Data {
+			name := a.Attributes.Name
+			if name == "" {
+				continue
+			}
+			for _, role := range a.Attributes.RoleNames {
+				if key := Config.Tags.CreditRoles[strings.ToLower(role)]; key != "" {
+					add(strings.ToUpper(key), name)
+				} else if performers && performerKey != "" {
+					add(strings.ToUpper(performerKey), fmt.Sprintf("%s (%s)", name, role))
+				}
+			}
+		}
+	}
+	return out
 }
 
-func writeMP4Tags(track *task.Track, lrc string) error {
-	t := &mp4tag.MP4Tags{
-		Title:      track.Resp.Attributes.Name,
-		TitleSort:  track.Resp.Attributes.Name,
-		Artist:     track.Resp.Attributes.ArtistName,
-		ArtistSort: track.Resp.Attributes.ArtistName,
-		Custom: map[string]string{
-			"PERFORMER":   track.Resp.Attributes.ArtistName,
-			"RELEASETIME": track.Resp.Attributes.ReleaseDate,
-			"ISRC":        track.Resp.Attributes.Isrc,
-			"LABEL":       "",
-			"UPC":         "",
-		},
-		Composer:     track.Resp.Attributes.ComposerName,
-		ComposerSort: track.Resp.Attributes.ComposerName,
-		CustomGenre:  track.Resp.Attributes.GenreNames[0],
-		Lyrics:       lrc,
-		TrackNumber:  int16(track.Resp.Attributes.TrackNumber),
-		DiscNumber:   int16(track.Resp.Attributes.DiscNumber),
-		Album:        track.Resp.Attributes.AlbumName,
-		AlbumSort:    track.Resp.Attributes.AlbumName,
+func mvTagSource(mv *ampapi.MusicVideoRespData, storefront string, track *task.Track) tagSource {
+	attrs := mv.Attributes
+	src := tagSource{
+		Title:         attrs.Name,
+		Artist:        attrs.ArtistName,
+		Album:         attrs.AlbumName,
+		ReleaseDate:   attrs.ReleaseDate,
+		Date:          attrs.ReleaseDate,
+		ISRC:          attrs.Isrc,
+		SongID:        mv.ID,
+		GenreID:       primaryGenreID(mv.Relationships.Genres.Data),
+		Storefront:    storefront,
+		ContentRating: attrs.ContentRating,
+		MediaKind:     mediaKindMusicVideo,
+		TrackNumber:   attrs.TrackNumber,
+		DiscNumber:    attrs.DiscNumber,
+	}
+	if len(attrs.GenreNames) > 0 {
+		src.Genre = attrs.GenreNames[0]
+	}
+	for _, a := range mv.Relationships.Artists.Data {
+		src.Artists = append(src.Artists, a.Attributes.Name)
+		src.ArtistIDs = append(src.ArtistIDs, a.ID)
+	}
+	if len(src.ArtistIDs) > 0 {
+		src.ArtistID = src.ArtistIDs[0]
+	}
+	if track != nil {
+		applyTrackContext(&src, track)
 	}
+	return src
+}
 
-	if track.PreType == "albums" {
-		albumID, err := strconv.ParseUint(track.PreID, 10, 32)
-		if err != nil {
-			return err
+// iTunes stik 媒体类型
+const (
+	mediaKindSong       = 1
+	mediaKindMusicVideo = 6
+)
+
+// itunesAtoms 返回由 mp4meta.SetAtoms 直接写入的原子，写标签时总会先清掉旧值；
+// credit-roles 中的制作人员原子也一并清掉，与 custom 同名的由 go-mp4tag 写入，不在此清除，只在有值时覆盖
+func itunesAtoms() []string {
+	remove := []string{
+		"cnID", "plID", "atID", "geID", "sfID", "stik", "rtng",
+		"----:ARTISTS", "----:ARTIST_IDS", "----:PRIMARY_ARTIST",
+		"\xa9wrk", "\xa9mvn", "\xa9mvi", "\xa9mvc", "shwm",
+	}
+	custom := map[string]bool{}
+	for name := range Config.Tags.Custom {
+		custom[strings.ToUpper(name)] = true
+	}
+	for _, key := range Config.Tags.CreditRoles {
+		key = strings.ToUpper(key)
+		if id := "----:" + key; !custom[key] && !contains(remove, id) {
+			remove = append(remove, id)
 		}
-		t.ItunesAlbumID = int32(albumID)
 	}
+	return remove
+}
 
-	if len(track.Resp.Relationships.Artists.Data) > 0 {
-		artistID, err := strconv.ParseUint(track.Resp.Relationships.Artists.Data[0].ID, 10, 32)
-		if err != nil {
-			return err
+// buildTags 把 tagSource 按 tags 配置转换为 go-mp4tag 的标签，以及需要直接写入 ilst 的 iTunes 原子
+func buildTags(src tagSource) (*mp4tag.MP4Tags, []mp4meta.Atom) {
+	t := &mp4tag.MP4Tags{Custom: map[string]string{}}
+	set := func(field string, apply func()) {
+		if tagEnabled(field) {
+			apply()
+		}
+	}
+	// 排序字段：有另一语言的名称时总是写入，否则按 sort-fields 写入显示值
+	sortValue := func(display, sort string) string {
+		if sort != "" {
+			return sort
+		}
+		if *Config.Tags.SortFields {
+			return display
+		}
+		return ""
+	}
+	set("title", func() {
+		t.Title = src.Title
+		t.TitleSort = sortValue(src.Title, src.TitleSort)
+	})
+	set("artist", func() {
+		t.Artist = src.Artist
+		if Config.Tags.ArtistSeparator != "" && len(src.Artists) > 1 {
+			t.Artist = strings.Join(src.Artists, Config.Tags.ArtistSeparator)
+		}
+		t.ArtistSort = sortValue(t.Artist, src.ArtistSort)
+	})
+	set("album", func() {
+		t.Album = src.Album
+		t.AlbumSort = sortValue(src.Album, src.AlbumSort)
+	})
+	set("album-artist", func() {
+		t.AlbumArtist = src.AlbumArtist
+		t.AlbumArtistSort = sortValue(src.AlbumArtist, src.AlbumArtistSort)
+	})
+	set("composer", func() {
+		t.Composer = src.Composer
+		t.ComposerSort = sortValue(src.Composer, src.ComposerSort)
+	})
+	set("genre", func() { t.CustomGenre = src.Genre })
+	set("date", func() { t.Date = src.Date })
+	set("copyright", func() { t.Copyright = src.Copyright })
+	set("publisher", func() { t.Publisher = src.Label })
+	set("lyrics", func() { t.Lyrics = src.Lyrics })
+	set("description", func() { t.Description, t.Comment = src.Description, src.Description })
+	set("track-number", func() { t.TrackNumber, t.TrackTotal = int16(src.TrackNumber), int16(src.TrackTotal) })
+	set("disc-number", func() { t.DiscNumber, t.DiscTotal = int16(src.DiscNumber), int16(src.DiscTotal) })
+
+	// go-mp4tag 把 id 当 int32 写，这些原子改由 mp4meta 按 iTunes 的宽度写入；
+	// 宽度放不下时扩成 8 字节，无法解析的 id 直接跳过
+	var atoms []mp4meta.Atom
+	idAtom := func(field, name, value string, size int) {
+		if !tagEnabled(field) {
+			return
+		}
+		if id, err := strconv.ParseUint(value, 10, 63); err == nil && id > 0 {
+			atoms = append(atoms, mp4meta.IntAtom(name, id, size))
+		}
+	}
+	idAtom("itunes-song-id", "cnID", src.SongID, 4)
+	idAtom("itunes-album-id", "plID", src.AlbumID, 8)
+	idAtom("itunes-artist-id", "atID", src.ArtistID, 4)
+	idAtom("itunes-genre-id", "geID", src.GenreID, 4)
+	if tagEnabled("storefront-id") {
+		if id, ok := ampapi.StorefrontID(src.Storefront); ok {
+			atoms = append(atoms, mp4meta.IntAtom("sfID", uint64(id), 4))
+		}
+	}
+	if tagEnabled("media-kind") && src.MediaKind != 0 {
+		atoms = append(atoms, mp4meta.IntAtom("stik", uint64(src.MediaKind), 1))
+	}
+	if tagEnabled("advisory") {
+		rating := uint64(0)
+		switch src.ContentRating {
+		case "explicit":
+			rating = 1
+		case "clean":
+			rating = 2
+		}
+		atoms = append(atoms, mp4meta.IntAtom("rtng", rating, 1))
+	}
+	// 作品与乐章（©wrk/©mvn/©mvi/©mvc），shwm=1 让播放器按“作品：乐章”显示
+	if tagEnabled("work") && src.Work != "" {
+		atoms = append(atoms, mp4meta.TextAtom("\xa9wrk", src.Work), mp4meta.IntAtom("shwm", 1, 1))
+		if src.Movement != "" {
+			atoms = append(atoms, mp4meta.TextAtom("\xa9mvn", src.Movement))
+		}
+		if src.MovementNumber > 0 {
+			atoms = append(atoms, mp4meta.IntAtom("\xa9mvi", uint64(src.MovementNumber), 2))
+		}
+		if src.MovementCount > 0 {
+			atoms = append(atoms, mp4meta.IntAtom("\xa9mvc", uint64(src.MovementCount), 2))
+		}
+	}
+	// 多值标签：每个关联艺人、艺人 id 各写一个 data 原子
+	if tagEnabled("artists") && len(src.Artists) > 0 {
+		atoms = append(atoms,
+			mp4meta.FreeformAtom("ARTISTS", src.Artists...),
+			mp4meta.FreeformAtom("ARTIST_IDS", src.ArtistIDs...),
+			mp4meta.FreeformAtom("PRIMARY_ARTIST", src.Artists[0]),
+		)
+	}
+	if tagEnabled("credits") {
+		keys := make([]string, 0, len(src.Credits))
+		for key := range src.Credits {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			atoms = append(atoms, mp4meta.FreeformAtom(key, src.Credits[key]...))
 		}
-		t.ItunesArtistID = int32(artistID)
-	}
-
-	if (track.PreType == "playlists" || track.PreType == "stations") && !Config.UseSongInfoForPlaylist {
-		t.DiscNumber = 1
-		t.DiscTotal = 1
-		t.TrackNumber = int16(track.TaskNum)
-		t.TrackTotal = int16(track.TaskTotal)
-		t.Album = track.PlaylistData.Attributes.Name
-		t.AlbumSort = track.PlaylistData.Attributes.Name
-		t.AlbumArtist = track.PlaylistData.Attributes.ArtistName
-		t.AlbumArtistSort = track.PlaylistData.Attributes.ArtistName
-	} else if (track.PreType == "playlists" || track.PreType == "stations") && Config.UseSongInfoForPlaylist {
-		t.DiscTotal = int16(track.DiscTotal)
-		t.TrackTotal = int16(track.AlbumData.Attributes.TrackCount)
-		t.AlbumArtist = track.AlbumData.Attributes.ArtistName
-		t.AlbumArtistSort = track.AlbumData.Attributes.ArtistName
-		t.Custom["UPC"] = track.AlbumData.Attributes.Upc
-		t.Custom["LABEL"] = track.AlbumData.Attributes.RecordLabel
-		t.Date = track.AlbumData.Attributes.ReleaseDate
-		t.Copyright = track.AlbumData.Attributes.Copyright
-		t.Publisher = track.AlbumData.Attributes.RecordLabel
-	} else {
-		t.DiscTotal = int16(track.DiscTotal)
-		t.TrackTotal = int16(track.AlbumData.Attributes.TrackCount)
-		t.AlbumArtist = track.AlbumData.Attributes.ArtistName
-		t.AlbumArtistSort = track.AlbumData.Attributes.ArtistName
-		t.Custom["UPC"] = track.AlbumData.Attributes.Upc
-		t.Date = track.AlbumData.Attributes.ReleaseDate
-		t.Copyright = track.AlbumData.Attributes.Copyright
-		t.Publisher = track.AlbumData.Attributes.RecordLabel
 	}
+	if tagEnabled("custom") {
+		r := strings.NewReplacer(
+			"{Title}", src.Title,
+			"{ArtistName}", src.Artist,
+			"{AlbumName}", src.Album,
+			"{AlbumArtist}", src.AlbumArtist,
+			"{Composer}", src.Composer,
+			"{Genre}", src.Genre,
+			"{ReleaseDate}", src.ReleaseDate,
+			"{ISRC}", src.ISRC,
+			"{UPC}", src.UPC,
+			"{Label}", src.Label,
+			"{Copyright}", src.Copyright,
+			"{SongId}", src.SongID,
+			"{AlbumId}", src.AlbumID,
+			"{PlaylistName}", src.PlaylistName,
+			"{TrackNumber}", strconv.Itoa(src.TrackNumber),
+			"{DiscNumber}", strconv.Itoa(src.DiscNumber),
+			"{WorkName}", src.Work,
+			"{MovementName}", src.Movement,
+			"{Attribution}", src.Attribution,
+		)
+		for name, tmpl := range Config.Tags.Custom {
+			// go-mp4tag 不写空值
+			t.Custom[name] = strings.TrimSpace(r.Replace(tmpl))
+		}
+	}
+	return t, atoms
+}
 
-	if track.Resp.Attributes.ContentRating == "explicit" {
-		t.ItunesAdvisory = mp4tag.ItunesAdvisoryExplicit
-	} else if track.Resp.Attributes.ContentRating == "clean" {
-		t.ItunesAdvisory = mp4tag.ItunesAdvisoryClean
-	} else {
-		t.ItunesAdvisory = mp4tag.ItunesAdvisoryNone
+// writeMP4Tags 按标签策略为歌曲写入元数据与封面
+func writeMP4Tags(track *task.Track, lrc string) error {
+	t, atoms := buildTags(songTagSource(track, lrc))
+	cover := ""
+	if Config.EmbedCover && tagEnabled("cover") {
+		cover = track.CoverPath
 	}
+	return tagFile(track.SavePath, t, atoms, cover)
+}
 
-	mp4, err := mp4tag.Open(track.SavePath)
+// tagFile 是写入元数据的唯一入口：先由 mp4meta 整理文件布局（合并分片、补齐 ilst），
+// 再通过 go-mp4tag 写入标签，最后由 mp4meta 写入 iTunes 原子；coverPath 非空时替换已有封面
+func tagFile(path string, t *mp4tag.MP4Tags, atoms []mp4meta.Atom, coverPath string) error {
+	if err := mp4meta.Prepare(path); err != nil {
+		return fmt.Errorf("prepare %s: %w", filepath.Base(path), err)
+	}
+	var del []string
+	if coverPath != "" {
+		data, err := os.ReadFile(coverPath)
+		if err != nil {
+			return fmt.Errorf("read cover: %w", err)
+		}
+		t.Pictures = []*mp4tag.MP4Picture{{Data: data}}
+		del = append(del, "allpictures")
+	}
+	mp4, err := mp4tag.Open(path)
 	if err != nil {
 		return err
 	}
-	defer mp4.Close()
-	err = mp4.Write(t, []string{})
+	err = mp4.Write(t, del)
+	mp4.Close()
 	if err != nil {
 		return err
 	}
-	return nil
+	return mp4meta.SetAtoms(path, atoms, itunesAtoms())
 }
 
 func main() {
@@ -1646,24 +3427,26 @@ func main() {
 		}
 	}
 
+	cleanupStaging()
+
 	// 初始化任务管理器与下载执行器
 	mgr := NewTaskManager(2, 128) // 2 个 worker，队列 128
 
     mgr.BindRunner(func(t *Task) error {
-		dl_atmos, dl_aac, dl_song = false, false, false
-		switch t.Quality {
-		case "atmos":
-			dl_atmos = true
-		case "aac":
-			dl_aac = true
-		}
-
-		if t.SongOnly {
-			dl_song = true
+		// 本任务的下载选项；多格式任务每个格式换一份
+		songOnly := t.SongOnly
+		setQuality := func(quality string) dlOptions {
+			opts := qualityOptions(quality)
+			opts.Song, opts.Edition = songOnly, t.Edition
+			return opts
 		}
+		qualities := strings.Split(t.Quality, "+")
+		opts := setQuality(qualities[0])
+		started := time.Now()
 
         appendLog := func(msg string) { mgr.AppendLog(t.ID, msg) }
         setSub := func(p int, msg string) { mgr.SetSubProgress(t.ID, p, msg) }
+        addOutput := func(path string) { mgr.AddOutput(t.ID, path) }
 
 		// 取消检查辅助
 		canceled := func() bool {
@@ -1674,17 +3457,33 @@ func main() {
 			return false
 		}
 
+		// 多格式任务：cur 为正在下载的格式，总进度为各格式进度的平均值
+		cur := 0
 		setProgress := func(done, total int, msg string) {
 			mgr.mu.Lock()
 			if total <= 0 {
 				total = 1
 			}
-			t.TotalUnits = total
-			t.DoneUnits = done
-			t.Progress = int(float64(done) / float64(total) * 100.0)
-			if t.Progress > 100 {
-				t.Progress = 100
+			progress := min(int(float64(done)/float64(total)*100.0), 100)
+			if len(t.Formats) > 1 {
+				f := &t.Formats[cur]
+				f.TotalUnits, f.DoneUnits, f.Progress = total, done, progress
+				if msg != "" {
+					f.Message = msg
+				}
+				t.TotalUnits, t.DoneUnits, progress = 0, 0, 0
+				for _, f := range t.Formats {
+					// 尚未开始的格式按当前格式的曲目数估算
+					t.TotalUnits += cmp.Or(f.TotalUnits, total)
+					t.DoneUnits += f.DoneUnits
+					progress += f.Progress
+				}
+				progress /= len(t.Formats)
+			} else {
+				t.TotalUnits = total
+				t.DoneUnits = done
 			}
+			t.Progress = progress
 			if msg != "" {
 				t.Logs = append(t.Logs, msg)
 				t.Message = msg
@@ -1695,6 +3494,24 @@ func main() {
 			mgr.mu.Unlock()
 		}
 
+		switch t.Type {
+		case "verify":
+			return verifyLibrary(setProgress, canceled)
+		case "verify-checksums":
+			return verifyChecksums(setProgress, canceled)
+		case "retag":
+			err := retagLibrary(t, setProgress, canceled, appendLog, addOutput)
+			// 部分失败时已改写的文件同样需要更新校验清单与索引
+			mgr.mu.RLock()
+			outputs := append([]string(nil), t.Outputs...)
+			mgr.mu.RUnlock()
+			if len(outputs) > 0 && Config.ChecksumManifest != "" {
+				writeChecksumManifests(outputs, started, appendLog)
+			}
+			go rescanLibrary()
+			return err
+		}
+
 		urlRaw := t.URL
 		if strings.Contains(urlRaw, "/song/") {
 			u, err := getUrlSong(urlRaw, t.Token)
@@ -1703,7 +3520,19 @@ func main() {
 				return err
 			}
 			urlRaw = u
-			dl_song = true
+			songOnly = true
+			opts.Song = true
+		}
+
+		// 任务内共用元数据、封面、歌词与动画封面：多格式任务的各个格式、歌单引用模式下的同一张专辑
+		shared := newSharedAssets()
+		if len(qualities) > 1 {
+			mgr.mu.Lock()
+			t.Formats = make([]FormatProgress, len(qualities))
+			for i, q := range qualities {
+				t.Formats[i] = FormatProgress{Quality: q, Status: StatusQueued}
+			}
+			mgr.mu.Unlock()
 		}
 
 		var urlArg_i string
@@ -1725,7 +3554,7 @@ func main() {
                 }
                 _, mvID := checkUrlMv(urlRaw)
                 saveDir := Config.AlacSaveFolder
-                if err := mvDownloader(mvID, saveDir, t.Token, Config.Storefront, Config.MediaUserToken, nil); err != nil {
+                if err := mvDownloader(mvID, saveDir, t.Token, Config.Storefront, Config.MediaUserToken, nil, addOutput); err != nil {
                     return err
                 }
                 setProgress(4, 4, "mv done")
@@ -1735,12 +3564,12 @@ func main() {
             case strings.Contains(urlRaw, "/album/"):
                 appendLog("Type: Album")
                 storefront, albumId := checkUrl(urlRaw)
-                return ripAlbum(albumId, t.Token, storefront, Config.MediaUserToken, urlArg_i, t.Tracks, setProgress, setSub)
+                return ripAlbum(albumId, t.Token, storefront, Config.MediaUserToken, urlArg_i, t.Tracks, shared, opts, setProgress, setSub, addOutput)
 
             case strings.Contains(urlRaw, "/playlist/"):
                 appendLog("Type: Playlist")
                 storefront, pid := checkUrlPlaylist(urlRaw)
-                return ripPlaylist(pid, t.Token, storefront, Config.MediaUserToken, t.Tracks, setProgress, setSub)
+                return ripPlaylist(pid, t.Token, storefront, Config.MediaUserToken, t.Tracks, t.Sync, shared, opts, setProgress, setSub, addOutput)
 
             case strings.Contains(urlRaw, "/station/"):
                 appendLog("Type: Station")
@@ -1750,7 +3579,7 @@ func main() {
                     return nil
                 }
                 setProgress(0, 3, "prepare station")
-                if err := ripStation(sid, t.Token, storefront, Config.MediaUserToken, setSub); err != nil {
+                if err := ripStation(sid, t.Token, storefront, Config.MediaUserToken, opts, setSub, addOutput); err != nil {
                     return err
                 }
                 setProgress(3, 3, "station done")
@@ -1762,40 +3591,102 @@ func main() {
 			}
 		}
 
+		runFormat := func() error {
+			var err error
+			for attempt := 0; attempt <= t.MaxRetries; attempt++ {
+				if canceled() {
+					return fmt.Errorf("canceled")
+				}
+				if attempt > 0 {
+					appendLog(fmt.Sprintf("retry %d...", attempt))
+					for i := 0; i < 3; i++ { // 可中断等待
+						if canceled() { return fmt.Errorf("canceled") }
+						time.Sleep(time.Second)
+					}
+				}
+				err = runOnce()
+				if err == nil {
+					break
+				}
+				appendLog("error: " + err.Error())
+			}
+			return err
+		}
+
 		var err error
-		for attempt := 0; attempt <= t.MaxRetries; attempt++ {
-			if canceled() {
-				return fmt.Errorf("canceled")
-			}
-			if attempt > 0 {
-				appendLog(fmt.Sprintf("retry %d...", attempt))
-				for i := 0; i < 3; i++ { // 可中断等待
-					if canceled() { return fmt.Errorf("canceled") }
-					time.Sleep(time.Second)
+		if len(qualities) == 1 {
+			err = runFormat()
+		} else {
+			// 逐个格式下载；某个格式失败不影响后续格式，最后汇总错误
+			var errs []error
+			for i, q := range qualities {
+				cur = i
+				opts = setQuality(q)
+				mgr.mu.Lock()
+				t.Formats[i].Status = StatusRunning
+				mgr.mu.Unlock()
+				appendLog("format: " + q)
+				ferr := runFormat()
+				mgr.mu.Lock()
+				t.Formats[i].Status = StatusSucceeded
+				if ferr != nil {
+					t.Formats[i].Status = StatusFailed
+					t.Formats[i].Message = ferr.Error()
+				}
+				mgr.mu.Unlock()
+				if ferr != nil {
+					errs = append(errs, fmt.Errorf("%s: %w", q, ferr))
+					if t.Canceled {
+						break
+					}
 				}
 			}
-			err = runOnce()
-			if err == nil {
-				break
+			err = errors.Join(errs...)
+		}
+		// 部分失败时已发布的曲目同样需要写入校验清单、上传并更新索引，错误仍然返回
+		mgr.mu.RLock()
+		outputs := append([]string(nil), t.Outputs...)
+		mgr.mu.RUnlock()
+		if len(outputs) > 0 && Config.ChecksumManifest != "" {
+			writeChecksumManifests(outputs, started, appendLog)
+		}
+		if len(outputs) > 0 && remoteStorage != nil {
+			if uerr := uploadTaskOutputs(t, outputs, appendLog); uerr != nil {
+				err = errors.Join(err, uerr)
 			}
-			appendLog("error: " + err.Error())
+		}
+		if err == nil || len(outputs) > 0 {
+			go rescanLibrary()
 		}
 		return err
 	})
 
+	remoteStorage, err = storage.New(Config.Storage)
+	if err != nil {
+		log.Fatalf("init storage failed: %v", err)
+	}
+
+	// 打开曲库索引并在后台做一次增量扫描
+	libIndex, err = library.Open(Config.LibraryIndex)
+	if err != nil {
+		log.Printf("load library index failed: %v", err)
+	}
+	go rescanLibrary()
+
 	// 启动 HTTP API
 	r := gin.Default()
 	// Web UI 静态资源
     r.Static("/static", "./web")
     r.GET("/", func(c *gin.Context) { c.File("web/index.html") })
 	registerRoutes(r, mgr, token)
+	subsonic.Register(r, libIndex, Config.Subsonic)
 	log.Println("HTTP server listening on :8080")
 	if err := r.Run(":8080"); err != nil {
 		log.Fatal(err)
 	}
 }
 
-func mvDownloader(adamID string, saveDir string, token string, storefront string, mediaUserToken string, track *task.Track) error {
+func mvDownloader(adamID string, saveDir string, token string, storefront string, mediaUserToken string, track *task.Track, onFile func(string)) error {
 	MVInfo, err := ampapi.GetMusicVideoResp(storefront, adamID, Config.Language, token)
 	if err != nil {
 		fmt.Println("\u26A0 Failed to get MV manifest:", err)
@@ -1807,8 +3698,13 @@ func mvDownloader(adamID string, saveDir string, token string, storefront string
 	}
 	saveDir = strings.TrimSpace(saveDir)
 
-	vidPath := filepath.Join(saveDir, fmt.Sprintf("%s_vid.mp4", adamID))
-	audPath := filepath.Join(saveDir, fmt.Sprintf("%s_aud.mp4", adamID))
+	stageDir, err := newStagingDir("mv-" + adamID)
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(stageDir)
+	vidPath := filepath.Join(stageDir, fmt.Sprintf("%s_vid.mp4", adamID))
+	audPath := filepath.Join(stageDir, fmt.Sprintf("%s_aud.mp4", adamID))
 	mvSaveName := fmt.Sprintf("%s (%s)", MVInfo.Data[0].Attributes.Name, adamID)
 	if track != nil {
 		mvSaveName = fmt.Sprintf("%02d. %s", track.TaskNum, MVInfo.Data[0].Attributes.Name)
@@ -1821,6 +3717,9 @@ func mvDownloader(adamID string, saveDir string, token string, storefront string
 	exists, _ := fileExists(mvOutPath)
 	if exists {
 		fmt.Println("MV already exists locally.")
+		if onFile != nil {
+			onFile(mvOutPath)
+		}
 		return nil
 	}
 
@@ -1837,82 +3736,38 @@ func mvDownloader(adamID string, saveDir string, token string, storefront string
 	audiokeyAndUrls, _ := runv3.Run(adamID, audiom3u8url, token, mediaUserToken, true)
 	_ = runv3.ExtMvData(audiokeyAndUrls, audPath)
 
-	tags := []string{
-		"tool=",
-		fmt.Sprintf("artist=%s", MVInfo.Data[0].Attributes.ArtistName),
-		fmt.Sprintf("title=%s", MVInfo.Data[0].Attributes.Name),
-		fmt.Sprintf("genre=%s", MVInfo.Data[0].Attributes.GenreNames[0]),
-		fmt.Sprintf("created=%s", MVInfo.Data[0].Attributes.ReleaseDate),
-		fmt.Sprintf("ISRC=%s", MVInfo.Data[0].Attributes.Isrc),
-	}
-
-	if MVInfo.Data[0].Attributes.ContentRating == "explicit" {
-		tags = append(tags, "rating=1")
-	} else if MVInfo.Data[0].Attributes.ContentRating == "clean" {
-		tags = append(tags, "rating=2")
-	} else {
-		tags = append(tags, "rating=0")
-	}
-
-	if track != nil {
-		if track.PreType == "playlists" && !Config.UseSongInfoForPlaylist {
-			tags = append(tags, "disk=1/1")
-			tags = append(tags, fmt.Sprintf("album=%s", track.PlaylistData.Attributes.Name))
-			tags = append(tags, fmt.Sprintf("track=%d", track.TaskNum))
-			tags = append(tags, fmt.Sprintf("tracknum=%d/%d", track.TaskNum, track.TaskTotal))
-			tags = append(tags, fmt.Sprintf("album_artist=%s", track.PlaylistData.Attributes.ArtistName))
-			tags = append(tags, fmt.Sprintf("performer=%s", track.Resp.Attributes.ArtistName))
-		} else if track.PreType == "playlists" && Config.UseSongInfoForPlaylist {
-			tags = append(tags, fmt.Sprintf("album=%s", track.AlbumData.Attributes.Name))
-			tags = append(tags, fmt.Sprintf("disk=%d/%d", track.Resp.Attributes.DiscNumber, track.DiscTotal))
-			tags = append(tags, fmt.Sprintf("track=%d", track.Resp.Attributes.TrackNumber))
-			tags = append(tags, fmt.Sprintf("tracknum=%d/%d", track.Resp.Attributes.TrackNumber, track.AlbumData.Attributes.TrackCount))
-			tags = append(tags, fmt.Sprintf("album_artist=%s", track.AlbumData.Attributes.ArtistName))
-			tags = append(tags, fmt.Sprintf("performer=%s", track.Resp.Attributes.ArtistName))
-			tags = append(tags, fmt.Sprintf("copyright=%s", track.AlbumData.Attributes.Copyright))
-			tags = append(tags, fmt.Sprintf("UPC=%s", track.AlbumData.Attributes.Upc))
-		} else {
-			tags = append(tags, fmt.Sprintf("album=%s", track.AlbumData.Attributes.Name))
-			tags = append(tags, fmt.Sprintf("disk=%d/%d", track.Resp.Attributes.DiscNumber, track.DiscTotal))
-			tags = append(tags, fmt.Sprintf("track=%d", track.Resp.Attributes.TrackNumber))
-			tags = append(tags, fmt.Sprintf("tracknum=%d/%d", track.Resp.Attributes.TrackNumber, track.AlbumData.Attributes.TrackCount))
-			tags = append(tags, fmt.Sprintf("album_artist=%s", track.AlbumData.Attributes.ArtistName))
-			tags = append(tags, fmt.Sprintf("performer=%s", track.Resp.Attributes.ArtistName))
-			tags = append(tags, fmt.Sprintf("copyright=%s", track.AlbumData.Attributes.Copyright))
-			tags = append(tags, fmt.Sprintf("UPC=%s", track.AlbumData.Attributes.Upc))
-		}
-	} else {
-		tags = append(tags, fmt.Sprintf("album=%s", MVInfo.Data[0].Attributes.AlbumName))
-		tags = append(tags, fmt.Sprintf("disk=%d", MVInfo.Data[0].Attributes.DiscNumber))
-		tags = append(tags, fmt.Sprintf("track=%d", MVInfo.Data[0].Attributes.TrackNumber))
-		tags = append(tags, fmt.Sprintf("tracknum=%d", MVInfo.Data[0].Attributes.TrackNumber))
-		tags = append(tags, fmt.Sprintf("performer=%s", MVInfo.Data[0].Attributes.ArtistName))
-	}
+	tags, atoms := buildTags(mvTagSource(&MVInfo.Data[0], storefront, track))
 
 	var covPath string
-	if true {
+	if tagEnabled("cover") {
 		thumbURL := MVInfo.Data[0].Attributes.Artwork.URL
 		baseThumbName := forbiddenNames.ReplaceAllString(mvSaveName, "_") + "_thumbnail"
-		covPath, err = writeCover(saveDir, baseThumbName, thumbURL)
+		covPath, err = writeCover(stageDir, baseThumbName, thumbURL)
 		if err != nil {
 			fmt.Println("Failed to save MV thumbnail:", err)
-		} else {
-			tags = append(tags, fmt.Sprintf("cover=%s", covPath))
+			covPath = ""
 		}
 	}
 
-	tagsString := strings.Join(tags, ":")
-	muxCmd := exec.Command("MP4Box", "-itags", tagsString, "-quiet", "-add", vidPath, "-add", audPath, "-keep-utc", "-new", mvOutPath)
+	// MP4Box 只负责把音视频轨封装到一起，元数据统一由 tagFile 写入
+	stagedOutPath := filepath.Join(stageDir, filepath.Base(mvOutPath))
+	muxCmd := exec.Command("MP4Box", "-quiet", "-add", vidPath, "-add", audPath, "-keep-utc", "-new", stagedOutPath)
 	fmt.Printf("MV Remuxing...")
 	if err := muxCmd.Run(); err != nil {
 		fmt.Printf("MV mux failed: %v\n", err)
 		return err
 	}
+	if err := tagFile(stagedOutPath, tags, atoms, covPath); err != nil {
+		fmt.Printf("MV tagging failed: %v\n", err)
+		return err
+	}
 	fmt.Printf("\rMV Remuxed.   \n")
-	defer os.Remove(vidPath)
-	defer os.Remove(audPath)
-	defer os.Remove(covPath)
-
+	if err := publishFile(stagedOutPath, mvOutPath); err != nil {
+		return err
+	}
+	if onFile != nil {
+		onFile(mvOutPath)
+	}
 	return nil
 }
 
@@ -2042,14 +3897,363 @@ func checkM3u8(b string, f string) (string, error) {
 	return EnhancedHls, nil
 }
 
-func formatAvailability(available bool, quality string) string {
-	if !available {
+// qualityTrack 是查询可用格式的一首曲目
+type qualityTrack struct {
+	Index  int      `json:"index"`
+	ID     string   `json:"id"`
+	Name   string   `json:"name"`
+	Type   string   `json:"type"`
+	Traits []string `json:"traits"`
+	hls    string
+}
+
+// qualityTracks 按链接类型（专辑、歌单、歌曲）取出曲目及其 enhanced m3u8
+func qualityTracks(urlRaw, token string) (string, []qualityTrack, error) {
+	var tracks []qualityTrack
+	fromTracks := func(data []ampapi.TrackRespData) {
+		for i, tr := range data {
+			tracks = append(tracks, qualityTrack{Index: i + 1, ID: tr.ID, Name: tr.Attributes.Name, Type: tr.Type,
+				Traits: tr.Attributes.AudioTraits, hls: tr.Attributes.ExtendedAssetUrls.EnhancedHls})
+		}
+	}
+	if storefront, id := checkUrlPlaylist(urlRaw); id != "" {
+		playlist := task.NewPlaylist(storefront, id)
+		if err := playlist.GetResp(token, Config.Language); err != nil {
+			return "", nil, err
+		}
+		fromTracks(playlist.Resp.Data[0].Relationships.Tracks.Data)
+		return playlist.Resp.Data[0].Attributes.Name, tracks, nil
+	}
+	if storefront, id := checkUrlSong(urlRaw); id != "" {
+		resp, err := ampapi.GetSongResp(storefront, id, Config.Language, token)
+		if err != nil {
+			return "", nil, err
+		}
+		attrs := resp.Data[0].Attributes
+		tracks = append(tracks, qualityTrack{Index: 1, ID: id, Name: attrs.Name, Type: resp.Data[0].Type,
+			Traits: attrs.AudioTraits, hls: attrs.ExtendedAssetUrls.EnhancedHls})
+		return attrs.Name, tracks, nil
+	}
+	if storefront, id := checkUrl(urlRaw); id != "" {
+		album := task.NewAlbum(storefront, id)
+		if err := album.GetResp(token, Config.Language); err != nil {
+			return "", nil, err
+		}
+		fromTracks(album.Resp.Data[0].Relationships.Tracks.Data)
+		return album.Name, tracks, nil
+	}
+	return "", nil, errors.New("unsupported url, expected an album, playlist or song link")
+}
+
+// probeTracksAvailability 并发读取每首歌的 master m3u8；get-m3u8-mode 要求时先向设备端口取完整的 m3u8
+func probeTracksAvailability(tracks []qualityTrack) []gin.H {
+	out := make([]gin.H, len(tracks))
+	sem := make(chan struct{}, 4)
+	var wg sync.WaitGroup
+	for i, tr := range tracks {
+		if tr.Type != "songs" {
+			out[i] = gin.H{"index": tr.Index, "id": tr.ID, "name": tr.Name, "type": tr.Type}
+			continue
+		}
+		wg.Add(1)
+		go func(i int, tr qualityTrack) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			hls := deviceM3u8(tr.ID, tr.hls, tr.Traits)
+			row := gin.H{"index": tr.Index, "id": tr.ID, "name": tr.Name, "type": tr.Type, "traits": tr.Traits}
+			if avail, err := probeAvailability(hls); err != nil {
+				row["error"] = err.Error()
+			} else {
+				row["formats"] = avail
+			}
+			out[i] = row
+		}(i, tr)
+	}
+	wg.Wait()
+	return out
+}
+
+// bestChoice 是按 quality-chain 为一首歌选出的版本
+type bestChoice struct {
+	Entry     string // 命中的 quality-chain 条目
+	Rank      int    // 条目在 quality-chain 中的位置，越小越优先
+	Codec     string // ATMOS / DOLBY / ALAC / AAC，用于 {Codec} 与保存目录
+	Quality   string // 命名与校验用的规格，如 768Kbps、24B-96.0kHz、256Kbps
+	StreamURL string // 选中的 variant；aac-lc 为空，走 runv3
+	AacLc     bool
+}
+
+// chainCodec 返回 quality-chain 条目对应的编码标签，未知条目返回空；
+// dolby-audio（ac-3）不是全景声，单独标为 DOLBY
+func chainCodec(name string) string {
+	switch name {
+	case "atmos":
+		return "ATMOS"
+	case "dolby-audio":
+		return "DOLBY"
+	case "hires", "alac":
+		return "ALAC"
+	case "aac", "aac-lc":
+		return "AAC"
+	}
+	return ""
+}
+
+// saveRoot 返回编码标签对应的保存根目录；没有单独的 ac-3 目录，DOLBY 与 ATMOS 同放在杜比编码的 atmos 目录，
+// 文件名和目录名中的 {Codec} 仍能区分两者
+func saveRoot(codec string) string {
+	switch codec {
+	case "ATMOS", "DOLBY":
+		return Config.AtmosSaveFolder
+	case "AAC":
+		return Config.AacSaveFolder
+	}
+	return Config.AlacSaveFolder
+}
+
+// deviceM3u8 按 get-m3u8-mode 决定是否向设备端口取完整的 m3u8，取不到时用 Web API 的 enhanced m3u8
+func deviceM3u8(id, hls string, traits []string) string {
+	if hls != "" && (Config.GetM3u8Mode == "all" || Config.GetM3u8Mode == "hires" && contains(traits, "hi-res-lossless")) {
+		if full, err := checkM3u8(id, "song"); err == nil && strings.HasSuffix(full, ".m3u8") {
+			return full
+		}
+	}
+	return hls
+}
+
+// matchChainVariant 判断 variant 是否符合 quality-chain 条目（limit 为 0 时用 atmos-max / alac-max），符合时返回规格
+func matchChainVariant(name string, limit int, v *m3u8.Variant) (string, bool) {
+	split := strings.Split(v.Audio, "-")
+	last := split[len(split)-1]
+	switch name {
+	case "atmos":
+		if v.Codecs != "ec-3" || !strings.Contains(v.Audio, "atmos") {
+			return "", false
+		}
+		raw, err := strconv.Atoi(last)
+		if limit == 0 {
+			limit = Config.AtmosMax
+		}
+		if err != nil || raw > limit {
+			return "", false
+		}
+		if len(last) == 4 && last[0] == '2' {
+			last = last[1:]
+		}
+		return last + "Kbps", true
+	case "dolby-audio":
+		return last + "Kbps", v.Codecs == "ac-3"
+	case "hires", "alac":
+		if v.Codecs != "alac" || len(split) < 3 {
+			return "", false
+		}
+		rate, err := strconv.Atoi(split[len(split)-2])
+		if limit == 0 {
+			limit = Config.AlacMax
+		}
+		if err != nil || rate > limit || (name == "hires") != (rate > 48000) {
+			return "", false
+		}
+		return fmt.Sprintf("%sB-%.1fkHz", last, float64(rate)/1000), true
+	case "aac":
+		return split[len(split)-1] + "Kbps", v.Codecs == "mp4a.40.2" && len(split) == 3 && split[1] == "stereo"
+	}
+	return "", false
+}
+
+// chooseTrackQuality 读取 master m3u8，按 quality-chain 找第一个可用的版本；
+// masterUrl 为空（没有 enhanced m3u8）时只有 aac-lc 可用
+func chooseTrackQuality(masterUrl string) (*bestChoice, error) {
+	var master *m3u8.MasterPlaylist
+	var base *url.URL
+	if masterUrl != "" {
+		var err error
+		if master, base, err = fetchMaster(masterUrl); err != nil {
+			return nil, err
+		}
+		sort.Slice(master.Variants, func(i, j int) bool {
+			return master.Variants[i].AverageBandwidth > master.Variants[j].AverageBandwidth
+		})
+	}
+	for rank, entry := range Config.QualityChain {
+		name, limitStr, _ := strings.Cut(entry, ":")
+		limit, _ := strconv.Atoi(limitStr)
+		if name == "aac-lc" {
+			return &bestChoice{Entry: entry, Rank: rank, Codec: "AAC", Quality: "256Kbps", AacLc: true}, nil
+		}
+		if master == nil {
+			continue
+		}
+		for _, v := range master.Variants {
+			quality, ok := matchChainVariant(name, limit, v)
+			if !ok {
+				continue
+			}
+			stream, err := base.Parse(v.URI)
+			if err != nil {
+				return nil, err
+			}
+			return &bestChoice{Entry: entry, Rank: rank, Codec: chainCodec(name), Quality: quality, StreamURL: stream.String()}, nil
+		}
+	}
+	return nil, errors.New("no version matches quality-chain")
+}
+
+// bestAlbumChoice 为专辑（歌单）的每首歌评估 quality-chain，再按 quality-chain-folder 选出决定目录与命名的版本，
+// 同时返回按曲目 ID 记下的每首歌的选择；一首都评估不出时返回 nil
+func bestAlbumChoice(tracks []ampapi.TrackRespData) (*bestChoice, map[string]*bestChoice) {
+	choices := make([]*bestChoice, len(tracks))
+	sem := make(chan struct{}, 4)
+	var wg sync.WaitGroup
+	for i, tr := range tracks {
+		if tr.Type != "songs" {
+			continue
+		}
+		wg.Add(1)
+		go func(i int, tr ampapi.TrackRespData) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			hls := deviceM3u8(tr.ID, tr.Attributes.ExtendedAssetUrls.EnhancedHls, tr.Attributes.AudioTraits)
+			if c, err := chooseTrackQuality(hls); err == nil {
+				choices[i] = c
+			}
+		}(i, tr)
+	}
+	wg.Wait()
+	count := map[string]int{}
+	for _, c := range choices {
+		if c != nil {
+			count[c.Codec]++
+		}
+	}
+	var pick *bestChoice
+	byID := map[string]*bestChoice{}
+	for i, c := range choices {
+		if c == nil {
+			continue
+		}
+		byID[tracks[i].ID] = c
+		switch {
+		case pick == nil,
+			Config.QualityChainFolder == "highest" && c.Rank < pick.Rank,
+			Config.QualityChainFolder == "lowest" && c.Rank > pick.Rank,
+			Config.QualityChainFolder == "majority" && (count[c.Codec] > count[pick.Codec] || count[c.Codec] == count[pick.Codec] && c.Rank < pick.Rank):
+			pick = c
+		}
+	}
+	if pick != nil {
+		fmt.Printf("Best available folder: %s %s (%s, %s)\n", pick.Codec, pick.Quality, pick.Entry, Config.QualityChainFolder)
+	}
+	return pick, byID
+}
+
+// fetchMaster 下载并解析 master m3u8，同时返回用于解析 variant 相对地址的 URL
+func fetchMaster(masterUrl string) (*m3u8.MasterPlaylist, *url.URL, error) {
+	base, err := url.Parse(masterUrl)
+	if err != nil {
+		return nil, nil, err
+	}
+	resp, err := http.Get(masterUrl)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, nil, errors.New(resp.Status)
+	}
+	from, listType, err := m3u8.DecodeFrom(resp.Body, true)
+	if err != nil || listType != m3u8.MASTER {
+		return nil, nil, errors.New("m3u8 not of master type")
+	}
+	return from.(*m3u8.MasterPlaylist), base, nil
+}
+
+// formatQuality 是某种格式可用的最高规格：有损格式填 Bitrate（Kbps），ALAC 填位深与采样率（Hz）
+type formatQuality struct {
+	Bitrate    int `json:"bitrate,omitempty"`
+	BitDepth   int `json:"bitDepth,omitempty"`
+	SampleRate int `json:"sampleRate,omitempty"`
+}
+
+// describe 生成 debug 表格中的一行，q 为 nil 表示不可用
+func (q *formatQuality) describe(prefix string) string {
+	if q == nil {
 		return "Not Available"
 	}
-	return quality
+	if q.SampleRate > 0 {
+		return fmt.Sprintf("%s | %d-bit/%d kHz", prefix, q.BitDepth, q.SampleRate/1000)
+	}
+	return fmt.Sprintf("%s | %d Kbps", prefix, q.Bitrate)
+}
+
+// mediaAvailability 是一首歌在 master m3u8 中可用的格式，nil 表示不可用
+type mediaAvailability struct {
+	AAC        *formatQuality `json:"aac,omitempty"`
+	Lossless   *formatQuality `json:"lossless,omitempty"`
+	HiRes      *formatQuality `json:"hiRes,omitempty"`
+	Atmos      *formatQuality `json:"atmos,omitempty"`
+	DolbyAudio *formatQuality `json:"dolbyAudio,omitempty"`
+}
+
+// variantAvailability 从 master m3u8 的 variant 中整理出各格式的最高规格
+func variantAvailability(variants []*m3u8.Variant) mediaAvailability {
+	var a mediaAvailability
+	better := func(cur *formatQuality, q formatQuality) *formatQuality {
+		if cur == nil || q.SampleRate > cur.SampleRate || q.SampleRate == cur.SampleRate && (q.BitDepth > cur.BitDepth || q.Bitrate > cur.Bitrate) {
+			return &q
+		}
+		return cur
+	}
+	for _, variant := range variants {
+		split := strings.Split(variant.Audio, "-")
+		last := split[len(split)-1]
+		switch {
+		case variant.Codecs == "mp4a.40.2": // AAC
+			if len(split) >= 3 {
+				bitrate, _ := strconv.Atoi(split[2])
+				a.AAC = better(a.AAC, formatQuality{Bitrate: bitrate})
+			}
+		case variant.Codecs == "ec-3" && strings.Contains(variant.Audio, "atmos"): // Dolby Atmos
+			// 形如 2768 的码率前缀 2 表示声道布局
+			if len(last) == 4 && last[0] == '2' {
+				last = last[1:]
+			}
+			bitrate, _ := strconv.Atoi(last)
+			a.Atmos = better(a.Atmos, formatQuality{Bitrate: bitrate})
+		case variant.Codecs == "alac": // ALAC（Lossless 或 Hi-Res）
+			if len(split) >= 3 {
+				bitDepth, _ := strconv.Atoi(last)
+				sampleRate, _ := strconv.Atoi(split[len(split)-2])
+				q := formatQuality{BitDepth: bitDepth, SampleRate: sampleRate}
+				if sampleRate > 48000 {
+					a.HiRes = better(a.HiRes, q)
+				} else {
+					a.Lossless = better(a.Lossless, q)
+				}
+			}
+		case variant.Codecs == "ac-3": // Dolby Audio
+			bitrate, _ := strconv.Atoi(last)
+			a.DolbyAudio = better(a.DolbyAudio, formatQuality{Bitrate: bitrate})
+		}
+	}
+	return a
 }
 
-func extractMedia(b string, more_mode bool) (string, string, error) {
+// probeAvailability 下载 master m3u8 并返回可用格式；没有 enhanced m3u8 的曲目只有 256Kbps AAC
+func probeAvailability(masterUrl string) (mediaAvailability, error) {
+	if masterUrl == "" {
+		return mediaAvailability{AAC: &formatQuality{Bitrate: 256}}, nil
+	}
+	master, _, err := fetchMaster(masterUrl)
+	if err != nil {
+		return mediaAvailability{}, err
+	}
+	return variantAvailability(master.Variants), nil
+}
+
+func extractMedia(b string, more_mode bool, opts dlOptions) (string, string, error) {
 	masterUrl, err := url.Parse(b)
 	if err != nil {
 		return "", "", err
@@ -2071,99 +4275,39 @@ func extractMedia(b string, more_mode bool) (string, string, error) {
 	if err != nil || listType != m3u8.MASTER {
 		return "", "", errors.New("m3u8 not of master type")
 	}
-	master := from.(*m3u8.MasterPlaylist)
-	var streamUrl *url.URL
-	sort.Slice(master.Variants, func(i, j int) bool {
-		return master.Variants[i].AverageBandwidth > master.Variants[j].AverageBandwidth
-	})
-	if debug_mode && more_mode {
-		fmt.Println("\nDebug: All Available Variants:")
-		var data [][]string
-		for _, variant := range master.Variants {
-			data = append(data, []string{variant.Codecs, variant.Audio, fmt.Sprint(variant.Bandwidth)})
-		}
-		table := tablewriter.NewWriter(os.Stdout)
-		table.SetHeader([]string{"Codec", "Audio", "Bandwidth"})
-		table.SetAutoMergeCells(true)
-		table.SetRowLine(true)
-		table.AppendBulk(data)
-		table.Render()
-
-		var hasAAC, hasLossless, hasHiRes, hasAtmos, hasDolbyAudio bool
-		var aacQuality, losslessQuality, hiResQuality, atmosQuality, dolbyAudioQuality string
-
-		for _, variant := range master.Variants {
-			if variant.Codecs == "mp4a.40.2" { // AAC
-				hasAAC = true
-				split := strings.Split(variant.Audio, "-")
-				if len(split) >= 3 {
-					bitrate, _ := strconv.Atoi(split[2])
-					currentBitrate := 0
-					if aacQuality != "" {
-						current := strings.Split(aacQuality, " | ")[2]
-						current = strings.Split(current, " ")[0]
-						currentBitrate, _ = strconv.Atoi(current)
-					}
-					if bitrate > currentBitrate {
-						aacQuality = fmt.Sprintf("AAC | 2 Channel | %d Kbps", bitrate)
-					}
-				}
-			} else if variant.Codecs == "ec-3" && strings.Contains(variant.Audio, "atmos") { // Dolby Atmos
-				hasAtmos = true
-				split := strings.Split(variant.Audio, "-")
-				if len(split) > 0 {
-					bitrateStr := split[len(split)-1]
-					if len(bitrateStr) == 4 && bitrateStr[0] == '2' {
-						bitrateStr = bitrateStr[1:]
-					}
-					bitrate, _ := strconv.Atoi(bitrateStr)
-					currentBitrate := 0
-					if atmosQuality != "" {
-						current := strings.Split(strings.Split(atmosQuality, " | ")[2], " ")[0]
-						currentBitrate, _ = strconv.Atoi(current)
-					}
-					if bitrate > currentBitrate {
-						atmosQuality = fmt.Sprintf("E-AC-3 | 16 Channel | %d Kbps", bitrate)
-					}
-				}
-			} else if variant.Codecs == "alac" { // ALAC (Lossless or Hi-Res)
-				split := strings.Split(variant.Audio, "-")
-				if len(split) >= 3 {
-					bitDepth := split[len(split)-1]
-					sampleRate := split[len(split)-2]
-					sampleRateInt, _ := strconv.Atoi(sampleRate)
-					if sampleRateInt > 48000 { // Hi-Res
-						hasHiRes = true
-						hiResQuality = fmt.Sprintf("ALAC | 2 Channel | %s-bit/%d kHz", bitDepth, sampleRateInt/1000)
-					} else { // Standard Lossless
-						hasLossless = true
-						losslessQuality = fmt.Sprintf("ALAC | 2 Channel | %s-bit/%d kHz", bitDepth, sampleRateInt/1000)
-					}
-				}
-			} else if variant.Codecs == "ac-3" { // Dolby Audio
-				hasDolbyAudio = true
-				split := strings.Split(variant.Audio, "-")
-				if len(split) > 0 {
-					bitrate, _ := strconv.Atoi(split[len(split)-1])
-					dolbyAudioQuality = fmt.Sprintf("AC-3 |  16 Channel | %d Kbps", bitrate)
-				}
-			}
+	master := from.(*m3u8.MasterPlaylist)
+	var streamUrl *url.URL
+	sort.Slice(master.Variants, func(i, j int) bool {
+		return master.Variants[i].AverageBandwidth > master.Variants[j].AverageBandwidth
+	})
+	if debug_mode && more_mode {
+		fmt.Println("\nDebug: All Available Variants:")
+		var data [][]string
+		for _, variant := range master.Variants {
+			data = append(data, []string{variant.Codecs, variant.Audio, fmt.Sprint(variant.Bandwidth)})
 		}
+		table := tablewriter.NewWriter(os.Stdout)
+		table.SetHeader([]string{"Codec", "Audio", "Bandwidth"})
+		table.SetAutoMergeCells(true)
+		table.SetRowLine(true)
+		table.AppendBulk(data)
+		table.Render()
 
+		avail := variantAvailability(master.Variants)
 		fmt.Println("Available Audio Formats:")
 		fmt.Println("------------------------")
-		fmt.Printf("AAC             : %s\n", formatAvailability(hasAAC, aacQuality))
-		fmt.Printf("Lossless        : %s\n", formatAvailability(hasLossless, losslessQuality))
-		fmt.Printf("Hi-Res Lossless : %s\n", formatAvailability(hasHiRes, hiResQuality))
-		fmt.Printf("Dolby Atmos     : %s\n", formatAvailability(hasAtmos, atmosQuality))
-		fmt.Printf("Dolby Audio     : %s\n", formatAvailability(hasDolbyAudio, dolbyAudioQuality))
+		fmt.Printf("AAC             : %s\n", avail.AAC.describe("AAC | 2 Channel"))
+		fmt.Printf("Lossless        : %s\n", avail.Lossless.describe("ALAC | 2 Channel"))
+		fmt.Printf("Hi-Res Lossless : %s\n", avail.HiRes.describe("ALAC | 2 Channel"))
+		fmt.Printf("Dolby Atmos     : %s\n", avail.Atmos.describe("E-AC-3 | 16 Channel"))
+		fmt.Printf("Dolby Audio     : %s\n", avail.DolbyAudio.describe("AC-3 |  16 Channel"))
 		fmt.Println("------------------------")
 
 		return "", "", nil
 	}
 	var Quality string
 	for _, variant := range master.Variants {
-		if dl_atmos {
+		if opts.Atmos {
 			if variant.Codecs == "ec-3" && strings.Contains(variant.Audio, "atmos") {
 				if debug_mode && !more_mode {
 					fmt.Printf("Debug: Found Dolby Atmos variant - %s (Bitrate: %d Kbps)\n",
@@ -2201,7 +4345,7 @@ func extractMedia(b string, more_mode bool) (string, string, error) {
 				Quality = fmt.Sprintf("%s Kbps", split[len(split)-1])
 				break
 			}
-		} else if dl_aac {
+		} else if opts.AAC {
 			if variant.Codecs == "mp4a.40.2" {
 				if debug_mode && !more_mode {
 					fmt.Printf("Debug: Found AAC variant - %s (Bitrate: %d)\n", variant.Audio, variant.Bandwidth)
@@ -2330,7 +4474,7 @@ const (
 type Task struct {
 	ID         string     `json:"id"`
 	URL        string     `json:"url"`
-	Quality    string     `json:"quality"` // alac/aac/atmos
+	Quality    string     `json:"quality"` // alac/aac/atmos/best；多格式任务用 + 连接，如 alac+atmos
 	Status     TaskStatus `json:"status"`
 	Progress   int        `json:"progress"`
 	TotalUnits int        `json:"totalUnits"` // 总曲目数/阶段数
@@ -2347,6 +4491,25 @@ type Task struct {
     Canceled   bool      `json:"canceled"`
     SubPercent int       `json:"subPercent"`
     SubMessage string    `json:"subMessage,omitempty"`
+	Outputs    []string  `json:"outputs,omitempty"` // 本任务写出（或已存在）的曲目/MV 文件路径
+	Type       string    `json:"type"`              // download（默认）/ verify / verify-checksums / retag
+	// retag 选项：URL 为专辑链接、曲库内的目录或空（整个曲库）
+	RefreshCover bool `json:"refreshCover,omitempty"`
+	Offline      bool `json:"offline,omitempty"` // 只使用 album.json，不联网
+	Sync         bool   `json:"sync,omitempty"`    // 歌单同步：只下载新增曲目，见 playlist-sync-*
+	Edition      string `json:"edition,omitempty"` // 版本偏好 given/explicit/clean，空=edition-preference
+	// 多格式任务：各格式依次下载，分别记录进度
+	Formats []FormatProgress `json:"formats,omitempty"`
+}
+
+// FormatProgress 是多格式任务中单个格式的进度
+type FormatProgress struct {
+	Quality    string     `json:"quality"`
+	Status     TaskStatus `json:"status"`
+	Progress   int        `json:"progress"`
+	TotalUnits int        `json:"totalUnits"`
+	DoneUnits  int        `json:"doneUnits"`
+	Message    string     `json:"message,omitempty"`
 }
 
 type TaskManager struct {
@@ -2372,22 +4535,24 @@ func NewTaskManager(workers, queueSize int) *TaskManager {
 func (m *TaskManager) BindRunner(r func(*Task) error) { m.runner = r }
 
 func (m *TaskManager) Create(url, quality, token string) *Task {
-	id := uuid.New().String()
-	t := &Task{
-		ID:       id,
-		URL:      url,
-		Quality:  quality,
-		Status:   StatusQueued,
-		Progress: 0,
-        Logs:     []string{"queued"},
-        Token:    token,
-        CreatedAt: time.Now(),
-        UpdatedAt: time.Now(),
-    }
+	return m.enqueue(&Task{URL: url, Quality: quality, Token: token, Type: "download"})
+}
+
+// CreateJob 创建一个针对整个曲库、不需要 url 的任务（verify / verify-checksums）
+func (m *TaskManager) CreateJob(typ string) *Task {
+	return m.enqueue(&Task{Type: typ})
+}
+
+func (m *TaskManager) enqueue(t *Task) *Task {
+	t.ID = uuid.New().String()
+	t.Status = StatusQueued
+	t.Logs = []string{"queued"}
+	t.CreatedAt = time.Now()
+	t.UpdatedAt = t.CreatedAt
 	m.mu.Lock()
-	m.tasks[id] = t
+	m.tasks[t.ID] = t
 	m.mu.Unlock()
-	m.queue <- id
+	m.queue <- t.ID
 	return t
 }
 
@@ -2414,132 +4579,845 @@ func (m *TaskManager) List() []*Task {
     })
     return out
 }
+
+func (m *TaskManager) AppendLog(id, msg string) {
+    m.mu.Lock()
+    if t, ok := m.tasks[id]; ok {
+        t.Logs = append(t.Logs, msg)
+        t.Message = msg
+        t.UpdatedAt = time.Now()
+        if len(t.Logs) > 1000 {
+            t.Logs = t.Logs[len(t.Logs)-1000:]
+        }
+    }
+    m.mu.Unlock()
+}
+
+// AddOutput 记录任务产出的文件路径（去重），用于打包下载
+func (m *TaskManager) AddOutput(id, path string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	t, ok := m.tasks[id]
+	if !ok {
+		return
+	}
+	for _, p := range t.Outputs {
+		if p == path {
+			return
+		}
+	}
+	t.Outputs = append(t.Outputs, path)
+}
+
+// ClearCompleted 删除状态为 succeeded/failed 的任务，返回删除数量
+func (m *TaskManager) ClearCompleted() int {
+    m.mu.Lock()
+    defer m.mu.Unlock()
+    removed := 0
+    for id, t := range m.tasks {
+        if t.Status == StatusSucceeded || t.Status == StatusFailed {
+            delete(m.tasks, id)
+            removed++
+        }
+    }
+    return removed
+}
+
+// SetSubProgress 更新子进度（当前曲目标记），仅用于运行中任务
+func (m *TaskManager) SetSubProgress(id string, percent int, msg string) {
+    if percent < 0 { percent = 0 }
+    if percent > 100 { percent = 100 }
+    m.mu.Lock()
+    if t, ok := m.tasks[id]; ok {
+        t.SubPercent = percent
+        if msg != "" { t.SubMessage = msg }
+        t.UpdatedAt = time.Now()
+    }
+    m.mu.Unlock()
+}
+
+// Cancel 标记任务为取消。对排队任务会直接标记失败；对运行中任务标记为取消中
+func (m *TaskManager) Cancel(id string) bool {
+    m.mu.Lock()
+    defer m.mu.Unlock()
+    if t, ok := m.tasks[id]; ok {
+        t.Canceled = true
+        if t.Status == StatusQueued {
+            t.Status = StatusFailed
+            t.Message = "canceled"
+            t.Logs = append(t.Logs, "canceled")
+        } else if t.Status == StatusRunning {
+            t.Message = "canceling"
+            t.Logs = append(t.Logs, "cancel requested")
+        }
+        t.UpdatedAt = time.Now()
+        return true
+    }
+    return false
+}
+
+// Delete 删除一个非运行中的任务（包括排队/已完成/失败）。运行中返回 false
+func (m *TaskManager) Delete(id string) bool {
+    m.mu.Lock()
+    defer m.mu.Unlock()
+    if t, ok := m.tasks[id]; ok {
+        if t.Status == StatusRunning {
+            return false
+        }
+        delete(m.tasks, id)
+        return true
+    }
+    return false
+}
+
+func (m *TaskManager) setStatus(t *Task, s TaskStatus, msg string) {
+    m.mu.Lock()
+    t.Status = s
+    t.Message = msg
+    if msg != "" {
+        t.Logs = append(t.Logs, msg)
+    }
+    t.UpdatedAt = time.Now()
+    if len(t.Logs) > 1000 {
+        t.Logs = t.Logs[len(t.Logs)-1000:]
+    }
+    m.mu.Unlock()
+}
+
+func (m *TaskManager) worker() {
+    for id := range m.queue {
+        m.mu.RLock()
+        t := m.tasks[id]
+        m.mu.RUnlock()
+        if t == nil {
+            continue
+        }
+        // 若已被取消，直接标记并跳过
+        if t.Canceled {
+            m.setStatus(t, StatusFailed, "canceled")
+            continue
+        }
+        m.setStatus(t, StatusRunning, "started")
+        if t.Canceled {
+            m.setStatus(t, StatusFailed, "canceled")
+            continue
+        }
+        if m.runner == nil {
+            m.setStatus(t, StatusFailed, "runner not bound")
+            continue
+        }
+        if err := m.runner(t); err != nil {
+            m.setStatus(t, StatusFailed, err.Error())
+        } else {
+            m.setStatus(t, StatusSucceeded, "done")
+        }
+    }
+}
+
+// libraryRoots 返回曲库扫描的根目录（即三个保存目录）
+func libraryRoots() []string {
+	return []string{Config.AlacSaveFolder, Config.AacSaveFolder, Config.AtmosSaveFolder}
+}
+
+// rescanLibrary 增量扫描曲库；已有扫描在进行时直接返回
+func rescanLibrary() {
+	if libIndex == nil {
+		return
+	}
+	res, err := libIndex.Scan(libraryRoots())
+	if errors.Is(err, library.ErrScanning) {
+		return
+	}
+	if err != nil {
+		log.Printf("library scan failed: %v", err)
+		return
+	}
+	log.Printf("library scan: %d files, %d updated, %d removed, %d failed (%s)", res.Scanned, res.Updated, res.Removed, res.Failed, res.Took)
+}
+
+// scanLibraryAndWait 扫描曲库；已有扫描在进行时等它结束
+func scanLibraryAndWait() error {
+	if libIndex == nil {
+		return errors.New("library index not available")
+	}
+	if _, err := libIndex.Scan(libraryRoots()); errors.Is(err, library.ErrScanning) {
+		for running, _ := libIndex.Scanning(); running; running, _ = libIndex.Scanning() {
+			time.Sleep(time.Second)
+		}
+	} else if err != nil {
+		return err
+	}
+	return nil
+}
+
+// verifyLibrary 重新扫描曲库并逐个校验文件结构、时长与封面，汇总失败的文件。
+// 编码不做校验：保存目录与文件名模板可以让不同编码落在同一目录，按目录推断编码并不可靠；
+// 专辑目录中的文件按 album.json 记录的目录时长校验
+func verifyLibrary(onProgress func(done, total int, msg string), canceled func() bool) error {
+	if err := scanLibraryAndWait(); err != nil {
+		return err
+	}
+	sidecars := map[string]map[string]int64{}
+	catalogDuration := func(path string) int64 {
+		dir := filepath.Dir(path)
+		durations, ok := sidecars[dir]
+		if !ok {
+			if sc, err := task.ReadAlbumSidecar(filepath.Join(dir, task.AlbumSidecarName)); err == nil {
+				durations = map[string]int64{}
+				for _, t := range sc.Tracks {
+					durations[t.File] = int64(t.Resp.Attributes.DurationInMillis)
+				}
+			}
+			sidecars[dir] = durations
+		}
+		return durations[filepath.Base(path)]
+	}
+	tracks := libIndex.Tracks("", "")
+	var failed []string
+	onProgress(0, len(tracks), fmt.Sprintf("verifying %d tracks", len(tracks)))
+	for i, tr := range tracks {
+		if canceled() {
+			return fmt.Errorf("canceled")
+		}
+		want := mp4meta.Expect{
+			DurationMs:  catalogDuration(tr.Path),
+			ToleranceMs: int64(Config.VerifyTolerance),
+			Cover:       Config.EmbedCover,
+		}
+		msg := ""
+		if _, err := mp4meta.Verify(tr.Path, want); err != nil {
+			failed = append(failed, fmt.Sprintf("%s: %v", tr.Path, err))
+			msg = fmt.Sprintf("FAIL %s: %v", tr.Path, err)
+		}
+		onProgress(i+1, len(tracks), msg)
+	}
+	return trackFailures(failed, len(tracks))
+}
+
+// checkRetagTarget 校验 retag 的目标：空（整个曲库）、专辑链接或曲库内的目录
+func checkRetagTarget(target string) error {
+	if target == "" {
+		return nil
+	}
+	if strings.HasPrefix(target, "https://") {
+		if _, id := checkUrl(target); id == "" {
+			return errors.New("retag url must be an album url")
+		}
+		return nil
+	}
+	if libraryRootOf(target) == "" {
+		return errors.New("retag folder must be inside one of the save folders")
+	}
+	return nil
+}
+
+// libraryRootOf 返回 path 所在的保存目录，不在任何保存目录内时返回空
+func libraryRootOf(path string) string {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return ""
+	}
+	for _, root := range libraryRoots() {
+		r, err := filepath.Abs(root)
+		if err != nil {
+			continue
+		}
+		if pathWithin(abs, r) {
+			return root
+		}
+	}
+	return ""
+}
+
+// retagLibrary 按嵌入的 cnID/plID 匹配曲库文件，用最新的目录数据（或 album.json）重写标签，
+// 只改写 moov 中的元数据，不动音频数据；每个文件记录改动了哪些字段
+func retagLibrary(t *Task, onProgress func(done, total int, msg string), canceled func() bool, appendLog func(string), addOutput func(string)) error {
+	if err := scanLibraryAndWait(); err != nil {
+		return err
+	}
+	storefront := Config.Storefront
+	var albumFilter, dirFilter string
+	if strings.HasPrefix(t.URL, "https://") {
+		storefront, albumFilter = checkUrl(t.URL)
+	} else if t.URL != "" {
+		abs, err := filepath.Abs(t.URL)
+		if err != nil {
+			return err
+		}
+		dirFilter = abs
+	}
+
+	// 按专辑分组；专辑目录中没有 plID 的文件联网时按 cnID 反查所属专辑
+	groups := map[string][]library.Track{}
+	var order []string
+	var failed []string
+	skipped, playlistSkipped := 0, 0
+	for _, tr := range libIndex.Tracks("", "") {
+		if dirFilter != "" {
+			abs, _ := filepath.Abs(tr.Path)
+			if rel, err := filepath.Rel(dirFilter, abs); err != nil || strings.HasPrefix(rel, "..") {
+				continue
+			}
+		}
+		if tr.SongID == "" {
+			skipped++
+			continue
+		}
+		// 歌单模式（playlist-album: playlist）保存的文件没有 plID，专辑、曲号来自歌单，
+		// 按原专辑重写会覆盖这些字段；只有专辑目录（有 album.json）中的文件才反查专辑
+		if tr.AlbumID == "" {
+			if _, err := os.Stat(filepath.Join(filepath.Dir(tr.Path), task.AlbumSidecarName)); err != nil {
+				playlistSkipped++
+				continue
+			}
+		}
+		albumID := tr.AlbumID
+		if albumID == "" && !t.Offline {
+			song, err := ampapi.GetSongResp(storefront, tr.SongID, Config.Language, t.Token)
+			if err != nil || len(song.Data) == 0 || len(song.Data[0].Relationships.Albums.Data) == 0 {
+				failed = append(failed, fmt.Sprintf("%s: album not found for song %s", tr.Path, tr.SongID))
+				continue
+			}
+			albumID = song.Data[0].Relationships.Albums.Data[0].ID
+		}
+		if albumFilter != "" && albumID != albumFilter {
+			continue
+		}
+		// 离线时按目录读取 album.json
+		key := albumID
+		if t.Offline {
+			key = filepath.Dir(tr.Path)
+		}
+		if _, ok := groups[key]; !ok {
+			order = append(order, key)
+		}
+		groups[key] = append(groups[key], tr)
+	}
+	total := len(failed)
+	for _, files := range groups {
+		total += len(files)
+	}
+	if skipped > 0 {
+		appendLog(fmt.Sprintf("%d files without an embedded catalog id skipped", skipped))
+	}
+	if playlistSkipped > 0 {
+		appendLog(fmt.Sprintf("%d files saved in playlist mode (no album id) skipped", playlistSkipped))
+	}
+	onProgress(len(failed), total, fmt.Sprintf("retagging %d files in %d albums", total, len(order)))
+
+	done := len(failed)
+	for _, key := range order {
+		if canceled() {
+			return fmt.Errorf("canceled")
+		}
+		files := groups[key]
+		var tracks map[string]task.Track
+		var err error
+		if t.Offline {
+			tracks, err = retagTracksFromSidecar(key, t.RefreshCover)
+		} else {
+			tracks, err = retagTracksFromCatalog(storefront, key, files, t.Token, t.RefreshCover)
+		}
+		for _, f := range files {
+			var changed []string
+			ferr := err
+			if ferr == nil {
+				changed, ferr = retagFile(f, tracks)
+			}
+			msg := ""
+			switch {
+			case ferr != nil:
+				failed = append(failed, fmt.Sprintf("%s: %v", f.Path, ferr))
+				msg = fmt.Sprintf("FAIL %s: %v", f.Path, ferr)
+			case len(changed) > 0:
+				addOutput(f.Path)
+				msg = fmt.Sprintf("RETAG %s: %s", f.Path, strings.Join(changed, "; "))
+			}
+			done++
+			onProgress(done, total, msg)
+		}
+	}
+	return trackFailures(failed, total)
+}
+
+// retagTracksFromCatalog 重新获取专辑数据，返回按曲目 id 索引的 Track；refreshCover 时同时更新目录中的封面
+func retagTracksFromCatalog(storefront, albumID string, files []library.Track, token string, refreshCover bool) (map[string]task.Track, error) {
+	album := task.NewAlbum(storefront, albumID)
+	if err := album.GetResp(token, Config.Language); err != nil {
+		return nil, err
+	}
+	if Config.AltLanguage.Language != "" {
+		if err := album.GetAltNames(token, Config.AltLanguage.Language); err != nil {
+			fmt.Println("Failed to get alt-language names:", err)
+		}
+	}
+	tracks := map[string]task.Track{}
+	for _, tr := range album.Tracks {
+		if Config.Tags.Credits && tagEnabled("credits") && tr.Type == "songs" {
+			if err := tr.GetCredits(token); err != nil {
+				fmt.Println("Failed to get credits:", err)
+			}
+		}
+		tracks[tr.ID] = tr
+	}
+	if !refreshCover || !Config.EmbedCover || !tagEnabled("cover") {
+		return tracks, nil
+	}
+	// 同一专辑可能在多个保存目录中，封面按目录分别更新，Track 以 "id@目录" 为键
+	covers := map[string]string{}
+	for _, f := range files {
+		dir := filepath.Dir(f.Path)
+		if _, ok := covers[dir]; !ok {
+			covPath, err := writeCover(dir, "cover", album.GetArtwork())
+			if err != nil {
+				return nil, fmt.Errorf("refresh cover: %w", err)
+			}
+			covers[dir] = covPath
+		}
+		if tr, ok := tracks[f.SongID]; ok {
+			tr.CoverPath = covers[dir]
+			tracks[f.SongID+"@"+dir] = tr
+		}
+	}
+	return tracks, nil
+}
+
+// retagTracksFromSidecar 从目录中的 album.json 还原 Track；refreshCover 时嵌入目录中已有的封面
+func retagTracksFromSidecar(dir string, refreshCover bool) (map[string]task.Track, error) {
+	sc, err := task.ReadAlbumSidecar(filepath.Join(dir, task.AlbumSidecarName))
+	if err != nil {
+		return nil, err
+	}
+	cover := ""
+	if refreshCover && Config.EmbedCover && tagEnabled("cover") {
+		for _, name := range []string{"cover.jpg", "cover.png"} {
+			if _, err := os.Stat(filepath.Join(dir, name)); err == nil {
+				cover = filepath.Join(dir, name)
+				break
+			}
+		}
+	}
+	tracks := map[string]task.Track{}
+	for i := range sc.Tracks {
+		tr := sc.Track(i, dir)
+		tr.CoverPath = cover
+		tracks[tr.ID] = tr
+	}
+	return tracks, nil
+}
+
+// retagFile 用 tracks 中对应的数据重写 f 的标签，返回改动的字段
+func retagFile(f library.Track, tracks map[string]task.Track) ([]string, error) {
+	tr, ok := tracks[f.SongID+"@"+filepath.Dir(f.Path)]
+	if !ok {
+		tr, ok = tracks[f.SongID]
+	}
+	if !ok {
+		return nil, fmt.Errorf("song %s not found in album data", f.SongID)
+	}
+	before, err := mp4meta.Probe(f.Path)
+	if err != nil {
+		return nil, err
+	}
+	// 在 staging 中的副本上改写，校验通过后再替换曲库中的文件，中途失败不会损坏原文件
+	stageDir, err := newStagingDir("retag-" + f.SongID)
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(stageDir)
+	staged := filepath.Join(stageDir, filepath.Base(f.Path))
+	if err := cloneFile(f.Path, staged); err != nil {
+		return nil, err
+	}
+	tr.SaveDir = filepath.Dir(f.Path)
+	tr.SaveName = filepath.Base(f.Path)
+	tr.SavePath = staged
+	// 歌词留空：go-mp4tag 会保留文件中已有的歌词
+	if err := writeMP4Tags(&tr, ""); err != nil {
+		return nil, err
+	}
+	want := mp4meta.Expect{
+		Codecs:     []string{before.Codec},
+		SampleRate: before.SampleRate,
+		BitDepth:   before.BitDepth,
+		DurationMs: before.DurationMs,
+		Cover:      before.HasCover,
+	}
+	after, err := mp4meta.Verify(staged, want)
+	if err != nil {
+		return nil, fmt.Errorf("verify: %w", err)
+	}
+	if err := publishFile(staged, f.Path); err != nil {
+		return nil, err
+	}
+	return atomDiff(before.Atoms, after.Atoms), nil
+}
+
+// cloneFile 把 src 复制为 dst 并落盘
+func cloneFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Sync(); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// atomDiff 列出两组 ilst 原子的差异；短文本显示新旧值，其余只给出原子名
+func atomDiff(before, after map[string][]byte) []string {
+	keys := make([]string, 0, len(after))
+	for k := range after {
+		keys = append(keys, k)
+	}
+	for k := range before {
+		if _, ok := after[k]; !ok {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	show := func(b []byte) string {
+		if len(b) > 80 || !utf8.Valid(b) {
+			return fmt.Sprintf("<%d bytes>", len(b))
+		}
+		for _, c := range b {
+			if c < 0x20 && c != 0 {
+				return fmt.Sprintf("<%d bytes>", len(b))
+			}
+		}
+		// 多值以 0 字节分隔
+		return strconv.Quote(strings.ReplaceAll(string(b), "\x00", " / "))
+	}
+	var out []string
+	for _, k := range keys {
+		old, hadOld := before[k]
+		cur, hasNew := after[k]
+		name := strings.Replace(k, "\xa9", "©", 1)
+		switch {
+		case !hadOld:
+			out = append(out, fmt.Sprintf("+%s %s", name, show(cur)))
+		case !hasNew:
+			out = append(out, "-"+name)
+		case !bytes.Equal(old, cur):
+			out = append(out, fmt.Sprintf("%s %s -> %s", name, show(old), show(cur)))
+		}
+	}
+	return out
+}
+
+// writeChecksumManifests 为任务写出文件所在的目录更新校验清单，只写入任务开始后改动过的文件。
+// 任务输出中还有"已存在"的曲目与同步时保留的曲目，它们的条目保持不变：
+// 重新计算会把之后发生的损坏当作正确的校验和写进清单
+func writeChecksumManifests(outputs []string, since time.Time, appendLog func(string)) {
+	// 部分文件系统的修改时间精度为 2 秒
+	since = since.Add(-2 * time.Second)
+	seen := map[string]bool{}
+	for _, p := range outputs {
+		dir := filepath.Dir(p)
+		if seen[dir] {
+			continue
+		}
+		seen[dir] = true
+		path, n, err := checksum.Update(dir, Config.ChecksumManifest, since)
+		if err != nil {
+			appendLog(fmt.Sprintf("write checksum manifest in %s failed: %v", dir, err))
+			continue
+		}
+		appendLog(fmt.Sprintf("checksums: %s (%d files)", path, n))
+	}
+}
+
+// verifyChecksums 逐个核对曲库中的校验清单，列出缺失或内容已变化的文件
+func verifyChecksums(onProgress func(done, total int, msg string), canceled func() bool) error {
+	manifests, err := checksum.FindManifests(libraryRoots())
+	if err != nil {
+		return err
+	}
+	onProgress(0, len(manifests), fmt.Sprintf("verifying %d checksum manifests", len(manifests)))
+	var failed []string
+	checked := 0
+	for i, m := range manifests {
+		if canceled() {
+			return fmt.Errorf("canceled")
+		}
+		n, bad, err := checksum.Verify(m)
+		checked += n
+		if err != nil {
+			failed = append(failed, fmt.Sprintf("%s: %v", m, err))
+			onProgress(i+1, len(manifests), fmt.Sprintf("FAIL %s: %v", m, err))
+			continue
+		}
+		for _, b := range bad {
+			p := filepath.Join(filepath.Dir(b.Manifest), b.File)
+			failed = append(failed, fmt.Sprintf("%s: %s", p, b.Reason))
+			onProgress(i, len(manifests), fmt.Sprintf("MISMATCH %s: %s", p, b.Reason))
+		}
+		onProgress(i+1, len(manifests), "")
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("%d of %d files failed checksum verification: %s", len(failed), checked, strings.Join(failed, "; "))
+	}
+	onProgress(len(manifests), len(manifests), fmt.Sprintf("all %d files match", checked))
+	return nil
+}
+
+// serveLibraryCover 优先输出嵌入封面，没有时回退到目录下的 cover 文件
+func serveLibraryCover(c *gin.Context, trackPath, coverPath string) {
+	if data, err := library.EmbeddedCover(trackPath); err == nil {
+		c.Header("Cache-Control", "max-age=86400")
+		c.Data(http.StatusOK, http.DetectContentType(data), data)
+		return
+	}
+	if coverPath != "" {
+		c.Header("Cache-Control", "max-age=86400")
+		c.File(coverPath)
+		return
+	}
+	c.JSON(http.StatusNotFound, gin.H{"error": "no cover"})
+}
 
-func (m *TaskManager) AppendLog(id, msg string) {
-    m.mu.Lock()
-    if t, ok := m.tasks[id]; ok {
-        t.Logs = append(t.Logs, msg)
-        t.Message = msg
-        t.UpdatedAt = time.Now()
-        if len(t.Logs) > 1000 {
-            t.Logs = t.Logs[len(t.Logs)-1000:]
-        }
-    }
-    m.mu.Unlock()
+// archiveEntry 是打包中的一个文件：磁盘路径与包内路径
+type archiveEntry struct {
+	Path string
+	Name string
 }
 
-// ClearCompleted 删除状态为 succeeded/failed 的任务，返回删除数量
-func (m *TaskManager) ClearCompleted() int {
-    m.mu.Lock()
-    defer m.mu.Unlock()
-    removed := 0
-    for id, t := range m.tasks {
-        if t.Status == StatusSucceeded || t.Status == StatusFailed {
-            delete(m.tasks, id)
-            removed++
-        }
-    }
-    return removed
+// archiveSidecars 是与曲目同目录、需要一并打包的附属文件
+var archiveSidecars = []string{"cover.jpg", "cover.png", "folder.jpg", "folder.png", "square_animated_artwork.mp4", "tall_animated_artwork.mp4", "checksums.sha256", "checksums.md5", "checksums.sfv", "album.json", "album.nfo", "description.txt", "description.md"}
+
+// taskArchiveEntries 以任务记录的曲目路径为基础，补上同名歌词与目录内的封面/动态封面
+func taskArchiveEntries(outputs []string) []archiveEntry {
+	roots := []string{Config.AlacSaveFolder, Config.AacSaveFolder, Config.AtmosSaveFolder}
+	seen := map[string]bool{}
+	entries := []archiveEntry{}
+	add := func(p string) {
+		if seen[p] {
+			return
+		}
+		info, err := os.Stat(p)
+		if err != nil || info.IsDir() {
+			return
+		}
+		seen[p] = true
+		name := filepath.Base(p)
+		for _, root := range roots {
+			if rel, err := filepath.Rel(root, p); err == nil && !strings.HasPrefix(rel, "..") {
+				name = rel
+				break
+			}
+		}
+		entries = append(entries, archiveEntry{Path: p, Name: filepath.ToSlash(name)})
+	}
+	for _, p := range outputs {
+		add(p)
+		base := strings.TrimSuffix(p, filepath.Ext(p))
+		add(base + ".lrc")
+		add(base + ".ttml")
+		dir := filepath.Dir(p)
+		for _, name := range archiveSidecars {
+			add(filepath.Join(dir, name))
+		}
+	}
+	return entries
 }
 
-// SetSubProgress 更新子进度（当前曲目标记），仅用于运行中任务
-func (m *TaskManager) SetSubProgress(id string, percent int, msg string) {
-    if percent < 0 { percent = 0 }
-    if percent > 100 { percent = 100 }
-    m.mu.Lock()
-    if t, ok := m.tasks[id]; ok {
-        t.SubPercent = percent
-        if msg != "" { t.SubMessage = msg }
-        t.UpdatedAt = time.Now()
-    }
-    m.mu.Unlock()
+// writeTaskArchive 以 zip（仅存储，不压缩音频）或 tar 格式把文件流式写入 w
+func writeTaskArchive(w io.Writer, format string, entries []archiveEntry) error {
+	copyFile := func(dst io.Writer, p string) error {
+		f, err := os.Open(p)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = io.Copy(dst, f)
+		return err
+	}
+	switch format {
+	case "tar":
+		tw := tar.NewWriter(w)
+		for _, e := range entries {
+			info, err := os.Stat(e.Path)
+			if err != nil {
+				continue
+			}
+			hdr, err := tar.FileInfoHeader(info, "")
+			if err != nil {
+				return err
+			}
+			hdr.Name = e.Name
+			if err := tw.WriteHeader(hdr); err != nil {
+				return err
+			}
+			if err := copyFile(tw, e.Path); err != nil {
+				return err
+			}
+		}
+		return tw.Close()
+	default:
+		zw := zip.NewWriter(w)
+		for _, e := range entries {
+			info, err := os.Stat(e.Path)
+			if err != nil {
+				continue
+			}
+			hdr, err := zip.FileInfoHeader(info)
+			if err != nil {
+				return err
+			}
+			hdr.Name = e.Name
+			hdr.Method = zip.Store
+			fw, err := zw.CreateHeader(hdr)
+			if err != nil {
+				return err
+			}
+			if err := copyFile(fw, e.Path); err != nil {
+				return err
+			}
+		}
+		return zw.Close()
+	}
 }
 
-// Cancel 标记任务为取消。对排队任务会直接标记失败；对运行中任务标记为取消中
-func (m *TaskManager) Cancel(id string) bool {
-    m.mu.Lock()
-    defer m.mu.Unlock()
-    if t, ok := m.tasks[id]; ok {
-        t.Canceled = true
-        if t.Status == StatusQueued {
-            t.Status = StatusFailed
-            t.Message = "canceled"
-            t.Logs = append(t.Logs, "canceled")
-        } else if t.Status == StatusRunning {
-            t.Message = "canceling"
-            t.Logs = append(t.Logs, "cancel requested")
-        }
-        t.UpdatedAt = time.Now()
-        return true
-    }
-    return false
+var (
+	archiveSecretOnce sync.Once
+	archiveSecret     []byte
+)
+
+// archiveSign 对 任务ID/格式/过期时间 做 HMAC-SHA256；未配置密钥时使用进程内随机密钥（重启后链接失效）
+func archiveSign(id, format string, expires int64) string {
+	archiveSecretOnce.Do(func() {
+		if Config.ArchiveSecret != "" {
+			archiveSecret = []byte(Config.ArchiveSecret)
+			return
+		}
+		archiveSecret = make([]byte, 32)
+		rand.Read(archiveSecret)
+	})
+	mac := hmac.New(sha256.New, archiveSecret)
+	fmt.Fprintf(mac, "%s\n%s\n%d", id, format, expires)
+	return hex.EncodeToString(mac.Sum(nil))
 }
 
-// Delete 删除一个非运行中的任务（包括排队/已完成/失败）。运行中返回 false
-func (m *TaskManager) Delete(id string) bool {
-    m.mu.Lock()
-    defer m.mu.Unlock()
-    if t, ok := m.tasks[id]; ok {
-        if t.Status == StatusRunning {
-            return false
-        }
-        delete(m.tasks, id)
-        return true
-    }
-    return false
+// serveTaskArchive 输出任务的打包文件，文件名取任务的第一个目录名
+func serveTaskArchive(c *gin.Context, mgr *TaskManager, id, format string) {
+	if format != "tar" {
+		format = "zip"
+	}
+	mgr.mu.RLock()
+	t, ok := mgr.tasks[id]
+	var outputs []string
+	var running bool
+	if ok {
+		outputs = append(outputs, t.Outputs...)
+		running = t.Status == StatusRunning || t.Status == StatusQueued
+	}
+	mgr.mu.RUnlock()
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "not found"})
+		return
+	}
+	if running {
+		c.JSON(http.StatusConflict, gin.H{"error": "task is not finished"})
+		return
+	}
+	entries := taskArchiveEntries(outputs)
+	if len(entries) == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "task has no output files"})
+		return
+	}
+	name := "task-" + strings.Split(id, "-")[0]
+	if len(outputs) > 0 {
+		name = filepath.Base(filepath.Dir(outputs[0]))
+	}
+	c.Header("Content-Type", map[string]string{"zip": "application/zip", "tar": "application/x-tar"}[format])
+	c.Header("Content-Disposition", fmt.Sprintf("attachment; filename*=UTF-8''%s.%s", url.PathEscape(name), format))
+	c.Status(http.StatusOK)
+	if err := writeTaskArchive(c.Writer, format, entries); err != nil {
+		// 响应头已发出，只能中断连接并记录
+		log.Printf("archive task %s failed: %v", id, err)
+	}
 }
 
-func (m *TaskManager) setStatus(t *Task, s TaskStatus, msg string) {
-    m.mu.Lock()
-    t.Status = s
-    t.Message = msg
-    if msg != "" {
-        t.Logs = append(t.Logs, msg)
-    }
-    t.UpdatedAt = time.Now()
-    if len(t.Logs) > 1000 {
-        t.Logs = t.Logs[len(t.Logs)-1000:]
-    }
-    m.mu.Unlock()
+// uploadTaskOutputs 把任务产出（含歌词、封面等附属文件）上传到远端存储，按需删除本地文件
+func uploadTaskOutputs(t *Task, outputs []string, appendLog func(string)) error {
+	entries := taskArchiveEntries(outputs)
+	if len(entries) == 0 {
+		return nil
+	}
+	appendLog(fmt.Sprintf("uploading %d files to %s", len(entries), remoteStorage.Name()))
+	files := make([]storage.File, 0, len(entries))
+	for _, e := range entries {
+		files = append(files, storage.File{Name: e.Name, Path: e.Path})
+	}
+	// 上传失败的文件保留在本地；delete-local 只删除已上传成功的文件
+	removed, err := storage.Upload(context.Background(), remoteStorage, Config.Storage.Prefix, files, Config.Storage.DeleteLocal, func() bool { return t.Canceled })
+	if err == nil {
+		appendLog("upload done")
+	}
+	dirs := map[string]bool{}
+	for _, p := range removed {
+		dirs[filepath.Dir(p)] = true
+	}
+	// 删除上传后变空的目录（只删空目录，不会越过保存目录）
+	for dir := range dirs {
+		for _, root := range libraryRoots() {
+			rootAbs, _ := filepath.Abs(root)
+			d, _ := filepath.Abs(dir)
+			for strings.HasPrefix(d, rootAbs+string(os.PathSeparator)) {
+				if os.Remove(d) != nil {
+					break
+				}
+				d = filepath.Dir(d)
+			}
+		}
+	}
+	return err
 }
 
-func (m *TaskManager) worker() {
-    for id := range m.queue {
-        m.mu.RLock()
-        t := m.tasks[id]
-        m.mu.RUnlock()
-        if t == nil {
-            continue
-        }
-        // 若已被取消，直接标记并跳过
-        if t.Canceled {
-            m.setStatus(t, StatusFailed, "canceled")
-            continue
-        }
-        m.setStatus(t, StatusRunning, "started")
-        if t.Canceled {
-            m.setStatus(t, StatusFailed, "canceled")
-            continue
-        }
-        if m.runner == nil {
-            m.setStatus(t, StatusFailed, "runner not bound")
-            continue
-        }
-        if err := m.runner(t); err != nil {
-            m.setStatus(t, StatusFailed, err.Error())
-        } else {
-            m.setStatus(t, StatusSucceeded, "done")
-        }
-    }
+// qualityList 接受 "alac" 或 ["alac","atmos"] 两种写法
+type qualityList []string
+
+func (q *qualityList) UnmarshalJSON(data []byte) error {
+	var one string
+	if err := json.Unmarshal(data, &one); err == nil {
+		*q = nil
+		if one != "" {
+			*q = qualityList{one}
+		}
+		return nil
+	}
+	var list []string
+	if err := json.Unmarshal(data, &list); err != nil {
+		return errors.New("quality must be a string or a list of strings")
+	}
+	*q = list
+	return nil
 }
 
 type createTaskReq struct {
 	URLs       []string `json:"urls"`
 	URL        string   `json:"url,omitempty"`
-	Quality    string   `json:"quality" binding:"required,oneof=alac aac atmos"`
+	Type       string   `json:"type,omitempty"`                                  // download（默认）/ verify / verify-checksums / retag
+	Quality    qualityList `json:"quality"`              // 单个格式或格式列表，如 ["alac","atmos"]
 	Tracks     []int    `json:"tracks,omitempty"`     // 选曲，如 [1,3,5]；空=全下
 	SongOnly   bool     `json:"songOnly,omitempty"`   // 单曲模式（等价 CLI 的 --song）
 	MaxRetries int      `json:"maxRetries,omitempty"` // 自动重试次数（可选，默认 1）
+	// retag：url 为专辑链接、曲库内目录或留空（整个曲库）
+	RefreshCover bool `json:"refreshCover,omitempty"`
+	Offline      bool `json:"offline,omitempty"`
+	Sync         bool   `json:"sync,omitempty"` // 歌单链接按同步模式下载
+	Edition      string `json:"edition,omitempty" binding:"omitempty,oneof=given explicit clean"`
 }
 
 func registerRoutes(r *gin.Engine, mgr *TaskManager, token string) {
@@ -2705,6 +5583,26 @@ func registerRoutes(r *gin.Engine, mgr *TaskManager, token string) {
 				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 				return
 			}
+			switch req.Type {
+			case "", "download":
+			case "verify", "verify-checksums":
+				// 校验任务不需要 url，针对整个曲库
+				t := mgr.CreateJob(req.Type)
+				c.JSON(http.StatusCreated, gin.H{"taskIds": []string{t.ID}, "count": 1})
+				return
+			case "retag":
+				target := strings.TrimSpace(req.URL)
+				if err := checkRetagTarget(target); err != nil {
+					c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+					return
+				}
+				t := mgr.enqueue(&Task{Type: "retag", URL: target, Token: token, RefreshCover: req.RefreshCover, Offline: req.Offline})
+				c.JSON(http.StatusCreated, gin.H{"taskIds": []string{t.ID}, "count": 1})
+				return
+			default:
+				c.JSON(http.StatusBadRequest, gin.H{"error": "type must be one of: download|verify|verify-checksums|retag"})
+				return
+			}
 
 			// 兼容：如果老字段 url 传了而 urls 为空，就塞到 urls 里
 			if len(req.URLs) == 0 && strings.TrimSpace(req.URL) != "" {
@@ -2742,14 +5640,20 @@ func registerRoutes(r *gin.Engine, mgr *TaskManager, token string) {
 					return
 				}
 			}
-			if req.Quality == "" {
-				req.Quality = "alac"
+			if len(req.Quality) == 0 {
+				req.Quality = qualityList{"alac"}
 			}
-			switch req.Quality {
-			case "alac", "aac", "atmos":
-			default:
-				c.JSON(http.StatusBadRequest, gin.H{"error": "quality must be one of: alac|aac|atmos"})
-				return
+			var qualities []string
+			for _, q := range req.Quality {
+				switch q {
+				case "alac", "aac", "atmos", "best":
+				default:
+					c.JSON(http.StatusBadRequest, gin.H{"error": "quality must be one of: alac|aac|atmos|best"})
+					return
+				}
+				if !contains(qualities, q) {
+					qualities = append(qualities, q)
+				}
 			}
 			if req.MaxRetries < 0 {
 				req.MaxRetries = 0
@@ -2764,12 +5668,14 @@ func registerRoutes(r *gin.Engine, mgr *TaskManager, token string) {
 					continue
 				}
 				// 创建任务（确保你的 mgr.Create 返回 *Task）
-				t := mgr.Create(u, req.Quality, token)
+				t := mgr.Create(u, strings.Join(qualities, "+"), token)
 
 				// 把可选字段塞进任务，供 Runner 使用
 				mgr.mu.Lock()
 				t.Tracks = append([]int(nil), req.Tracks...)
 				t.SongOnly = req.SongOnly
+				t.Sync = req.Sync
+				t.Edition = req.Edition
 				t.MaxRetries = req.MaxRetries
 				t.Token = token // Runner 用 t.Token
 				mgr.mu.Unlock()
@@ -2851,6 +5757,7 @@ func registerRoutes(r *gin.Engine, mgr *TaskManager, token string) {
 				t.Progress = 0
 				t.DoneUnits = 0
 				t.TotalUnits = 0
+				t.Formats = nil
 				t.Message = "manual retry"
 				t.Logs = append(t.Logs, "manual retry")
 				mgr.mu.Unlock()
@@ -2862,6 +5769,49 @@ func registerRoutes(r *gin.Engine, mgr *TaskManager, token string) {
 			c.JSON(http.StatusNotFound, gin.H{"error": "not found"})
 		})
 
+		// 打包下载任务产出：format=zip（默认）或 tar
+		v1.GET("/tasks/:id/archive", func(c *gin.Context) {
+			serveTaskArchive(c, mgr, c.Param("id"), c.Query("format"))
+		})
+
+		// 生成带签名、会过期的打包下载链接，便于下载工具或分享
+		v1.POST("/tasks/:id/archive/link", func(c *gin.Context) {
+			id := c.Param("id")
+			if _, ok := mgr.Get(id); !ok {
+				c.JSON(http.StatusNotFound, gin.H{"error": "not found"})
+				return
+			}
+			format := c.DefaultQuery("format", "zip")
+			if format != "zip" && format != "tar" {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "format must be zip or tar"})
+				return
+			}
+			ttl := Config.ArchiveLinkTTL
+			if v, err := strconv.Atoi(c.Query("ttl")); err == nil && v > 0 {
+				ttl = v
+			}
+			if ttl <= 0 {
+				ttl = 86400
+			}
+			expires := time.Now().Add(time.Duration(ttl) * time.Second).Unix()
+			link := fmt.Sprintf("/v1/archive/%s?format=%s&expires=%d&sig=%s", id, format, expires, archiveSign(id, format, expires))
+			c.JSON(http.StatusOK, gin.H{"url": link, "expiresAt": time.Unix(expires, 0)})
+		})
+
+		v1.GET("/archive/:id", func(c *gin.Context) {
+			id, format := c.Param("id"), c.Query("format")
+			expires, err := strconv.ParseInt(c.Query("expires"), 10, 64)
+			if err != nil || !hmac.Equal([]byte(c.Query("sig")), []byte(archiveSign(id, format, expires))) {
+				c.JSON(http.StatusForbidden, gin.H{"error": "invalid signature"})
+				return
+			}
+			if time.Now().Unix() > expires {
+				c.JSON(http.StatusGone, gin.H{"error": "link expired"})
+				return
+			}
+			serveTaskArchive(c, mgr, id, format)
+		})
+
 		// 单任务 SSE 进度（简单实现：每秒推送一次快照，直到结束/断开）
 		v1.GET("/tasks/:id/stream", func(c *gin.Context) {
 			id := c.Param("id")
@@ -2932,14 +5882,34 @@ func registerRoutes(r *gin.Engine, mgr *TaskManager, token string) {
 					"name":  tr.Attributes.Name,
 				})
 			}
+			notes := meta.Data[0].Attributes.EditorialNotes
 			c.JSON(http.StatusOK, gin.H{
 				"title":  meta.Data[0].Attributes.Name,
 				"artist": meta.Data[0].Attributes.ArtistName,
 				"cover":  meta.Data[0].Attributes.Artwork.URL,
+				"notes": gin.H{
+					"short":    nfo.PlainText(notes.Short),
+					"standard": nfo.PlainText(notes.Standard),
+				},
 				"tracks": tracks,
 			})
 		})
 
+		// 元数据：专辑/歌单/歌曲链接中每首歌可用的格式与规格（AAC、Lossless、Hi-Res、Atmos、Dolby Audio）
+		v1.GET("/meta/quality", func(c *gin.Context) {
+			urlRaw := strings.TrimSpace(c.Query("url"))
+			if urlRaw == "" {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "url required"})
+				return
+			}
+			title, tracks, err := qualityTracks(urlRaw, token)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+				return
+			}
+			c.JSON(http.StatusOK, gin.H{"title": title, "tracks": probeTracksAvailability(tracks)})
+		})
+
 		// 元数据：根据艺术家链接返回其专辑列表（时间升序）
 		v1.GET("/meta/artist", func(c *gin.Context) {
 			artistUrl := strings.TrimSpace(c.Query("url"))
@@ -2952,8 +5922,10 @@ func registerRoutes(r *gin.Engine, mgr *TaskManager, token string) {
 				c.JSON(http.StatusBadRequest, gin.H{"error": "invalid artist url"})
 				return
 			}
+			// 版本偏好：edition 参数优先，否则用 edition-preference
+			prefer := cmp.Or(c.Query("edition"), Config.EditionPreference)
 			// 直接调 Apple API 获取专辑列表，简化为 100/批 的分页
-			options := make([][]string, 0)
+			rows := make([]discographyEntry, 0)
 			offset := 0
 			for {
 				req, err := http.NewRequest("GET", fmt.Sprintf("https://amp-api.music.apple.com/v1/catalog/%s/artists/%s/albums?limit=100&offset=%d&l=%s", storefront, artistId, offset, Config.Language), nil)
@@ -2980,28 +5952,115 @@ func registerRoutes(r *gin.Engine, mgr *TaskManager, token string) {
 					return
 				}
 				for _, album := range obj.Data {
-					options = append(options, []string{album.Attributes.Name, album.Attributes.ReleaseDate, album.ID, album.Attributes.URL})
+					rows = append(rows, discographyEntry{Name: album.Attributes.Name, Date: album.Attributes.ReleaseDate, Editions: []albumEdition{{ID: album.ID, URL: album.Attributes.URL, Rating: album.Attributes.ContentRating}}})
 				}
 				if len(obj.Next) == 0 {
 					break
 				}
 				offset += 100
 			}
-			sort.Slice(options, func(i, j int) bool {
-				dateI, _ := time.Parse("2006-01-02", options[i][1])
-				dateJ, _ := time.Parse("2006-01-02", options[j][1])
+			rows = collapseEditions(rows)
+			sort.SliceStable(rows, func(i, j int) bool {
+				dateI, _ := time.Parse("2006-01-02", rows[i].Date)
+				dateJ, _ := time.Parse("2006-01-02", rows[j].Date)
 				return dateI.Before(dateJ)
 			})
-			out := make([]gin.H, 0, len(options))
-			for _, v := range options {
+			out := make([]gin.H, 0, len(rows))
+			for _, r := range rows {
+				ed := r.pick(prefer)
 				out = append(out, gin.H{
-					"name": v[0],
-					"date": v[1],
-					"id":   v[2],
-					"url":  v[3],
+					"name":     r.Name,
+					"date":     r.Date,
+					"id":       ed.ID,
+					"url":      ed.URL,
+					"rating":   ed.Rating,
+					"ratings":  r.ratings(),
+					"editions": r.Editions,
 				})
 			}
 			c.JSON(http.StatusOK, gin.H{"albums": out})
 		})
+
+		// 曲库：基于本地索引浏览已下载的文件
+		v1.GET("/library/artists", func(c *gin.Context) {
+			c.JSON(http.StatusOK, gin.H{"artists": libIndex.Artists()})
+		})
+		v1.GET("/library/albums", func(c *gin.Context) {
+			c.JSON(http.StatusOK, gin.H{"albums": libIndex.Albums(c.Query("artist"))})
+		})
+		v1.GET("/library/tracks", func(c *gin.Context) {
+			if songID := c.Query("songId"); songID != "" {
+				c.JSON(http.StatusOK, gin.H{"tracks": libIndex.FindSong(songID)})
+				return
+			}
+			c.JSON(http.StatusOK, gin.H{"tracks": libIndex.Tracks(c.Query("album"), c.Query("artist"))})
+		})
+		// 手动触发增量扫描；wait=1 时同步返回扫描结果
+		v1.POST("/library/scan", func(c *gin.Context) {
+			if c.Query("wait") == "" {
+				go rescanLibrary()
+				c.JSON(http.StatusAccepted, gin.H{"ok": true})
+				return
+			}
+			res, err := libIndex.Scan(libraryRoots())
+			if errors.Is(err, library.ErrScanning) {
+				c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+				return
+			}
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				return
+			}
+			c.JSON(http.StatusOK, res)
+		})
+		v1.GET("/library/scan", func(c *gin.Context) {
+			scanning, last := libIndex.Scanning()
+			c.JSON(http.StatusOK, gin.H{"scanning": scanning, "last": last})
+		})
+		// 核对曲库中所有校验清单；结果（不一致的文件）记录在返回的任务日志中
+		v1.POST("/library/verify-checksums", func(c *gin.Context) {
+			t := mgr.CreateJob("verify-checksums")
+			c.JSON(http.StatusAccepted, gin.H{"taskId": t.ID})
+		})
+
+		// 曲库播放：按索引 id 输出音频，http.ServeFile 负责 Range 请求
+		v1.GET("/library/tracks/:id/stream", func(c *gin.Context) {
+			t, ok := libIndex.Track(c.Param("id"))
+			if !ok {
+				c.JSON(http.StatusNotFound, gin.H{"error": "not found"})
+				return
+			}
+			c.Header("Content-Type", "audio/mp4")
+			c.File(t.Path)
+		})
+		v1.GET("/library/tracks/:id/cover", func(c *gin.Context) {
+			t, ok := libIndex.Track(c.Param("id"))
+			if !ok {
+				c.JSON(http.StatusNotFound, gin.H{"error": "not found"})
+				return
+			}
+			serveLibraryCover(c, t.Path, t.CoverPath)
+		})
+		v1.GET("/library/tracks/:id/lyrics", func(c *gin.Context) {
+			t, ok := libIndex.Track(c.Param("id"))
+			if !ok {
+				c.JSON(http.StatusNotFound, gin.H{"error": "not found"})
+				return
+			}
+			lrc, source, err := library.Lyrics(t)
+			if err != nil {
+				c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+				return
+			}
+			c.JSON(http.StatusOK, gin.H{"lrc": lrc, "source": source})
+		})
+		v1.GET("/library/albums/:id/cover", func(c *gin.Context) {
+			tracks := libIndex.Tracks(c.Param("id"), "")
+			if len(tracks) == 0 {
+				c.JSON(http.StatusNotFound, gin.H{"error": "not found"})
+				return
+			}
+			serveLibraryCover(c, tracks[0].Path, tracks[0].CoverPath)
+		})
 	}
 }
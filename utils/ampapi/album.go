@@ -28,11 +28,11 @@ func GetAlbumResp(storefront string, id string, language string, token string) (
 	query := url.Values{}
 	query.Set("omit[resource]", "autos")
 	query.Set("include", "tracks,artists,record-labels")
-	query.Set("include[songs]", "artists")
+	query.Set("include[songs]", "artists,genres")
 	//query.Set("fields[artists]", "name,artwork")
 	//query.Set("fields[albums:albums]", "artistName,artwork,name,releaseDate,url")
 	//query.Set("fields[record-labels]", "name")
-	query.Set("extend", "editorialVideo,extendedAssetUrls")
+	query.Set("extend", "editorialNotes,editorialVideo,extendedAssetUrls")
 	query.Set("l", language)
 	req.URL.RawQuery = query.Encode()
 	do, err := http.DefaultClient.Do(req)
@@ -105,11 +105,11 @@ func GetAlbumRespByHref(href string, language string, token string) (*AlbumResp,
 	query := url.Values{}
 	query.Set("omit[resource]", "autos")
 	query.Set("include", "tracks,artists,record-labels")
-	query.Set("include[songs]", "artists")
+	query.Set("include[songs]", "artists,genres")
 	//query.Set("fields[artists]", "name,artwork")
 	//query.Set("fields[albums:albums]", "artistName,artwork,name,releaseDate,url")
 	//query.Set("fields[record-labels]", "name")
-	query.Set("extend", "editorialVideo,extendedAssetUrls")
+	query.Set("extend", "editorialNotes,editorialVideo,extendedAssetUrls")
 	query.Set("l", language)
 	req.URL.RawQuery = query.Encode()
 	do, err := http.DefaultClient.Do(req)
@@ -163,6 +163,42 @@ func GetAlbumRespByHref(href string, language string, token string) (*AlbumResp,
 	return obj, nil
 }
 
+// GetAlbumOtherVersions 获取专辑的其他版本（explicit / clean、豪华版等）
+func GetAlbumOtherVersions(storefront string, id string, language string, token string) (*AlbumResp, error) {
+	var err error
+	if token == "" {
+		token, err = GetToken()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	req, err := http.NewRequest("GET", fmt.Sprintf("https://amp-api.music.apple.com/v1/catalog/%s/albums/%s/view/other-versions", storefront, id), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", token))
+	req.Header.Set("User-Agent", "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/91.0.4472.124 Safari/537.36")
+	req.Header.Set("Origin", "https://music.apple.com")
+	query := url.Values{}
+	query.Set("l", language)
+	req.URL.RawQuery = query.Encode()
+	do, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer do.Body.Close()
+	if do.StatusCode != http.StatusOK {
+		return nil, errors.New(do.Status)
+	}
+	obj := new(AlbumResp)
+	err = json.NewDecoder(do.Body).Decode(&obj)
+	if err != nil {
+		return nil, err
+	}
+	return obj, nil
+}
+
 type AlbumResp struct {
 	Href string          `json:"href"`
 	Next string          `json:"next"`
@@ -218,6 +254,10 @@ type AlbumRespData struct {
 				Video string `json:"video"`
 			} `json:"motionDetailSquare"`
 		} `json:"editorialVideo"`
+		EditorialNotes struct {
+			Standard string `json:"standard"`
+			Short    string `json:"short"`
+		} `json:"editorialNotes"`
 	} `json:"attributes"`
 	Relationships struct {
 		RecordLabels struct {
@@ -1 +1,78 @@
 package ampapi
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+)
+
+// GetArtistResp 获取艺人信息，附带简介、出生/成立时间与来源地
+func GetArtistResp(storefront string, id string, language string, token string) (*ArtistResp, error) {
+	var err error
+	if token == "" {
+		token, err = GetToken()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	req, err := http.NewRequest("GET", fmt.Sprintf("https://amp-api.music.apple.com/v1/catalog/%s/artists/%s", storefront, id), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", token))
+	req.Header.Set("User-Agent", "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/91.0.4472.124 Safari/537.36")
+	req.Header.Set("Origin", "https://music.apple.com")
+	query := url.Values{}
+	query.Set("extend", "artistBio,bornOrFormed,editorialNotes,origin,isGroup")
+	query.Set("l", language)
+	req.URL.RawQuery = query.Encode()
+	do, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer do.Body.Close()
+	if do.StatusCode != http.StatusOK {
+		return nil, errors.New(do.Status)
+	}
+	obj := new(ArtistResp)
+	err = json.NewDecoder(do.Body).Decode(&obj)
+	if err != nil {
+		return nil, err
+	}
+	if len(obj.Data) == 0 {
+		return nil, errors.New("empty artist response")
+	}
+	return obj, nil
+}
+
+type ArtistResp struct {
+	Href string           `json:"href"`
+	Data []ArtistRespData `json:"data"`
+}
+
+type ArtistRespData struct {
+	ID         string `json:"id"`
+	Type       string `json:"type"`
+	Href       string `json:"href"`
+	Attributes struct {
+		Name       string   `json:"name"`
+		GenreNames []string `json:"genreNames"`
+		URL        string   `json:"url"`
+		Artwork    struct {
+			Width  int    `json:"width"`
+			Height int    `json:"height"`
+			URL    string `json:"url"`
+		} `json:"artwork"`
+		ArtistBio      string `json:"artistBio"`
+		BornOrFormed   string `json:"bornOrFormed"`
+		Origin         string `json:"origin"`
+		IsGroup        bool   `json:"isGroup"`
+		EditorialNotes struct {
+			Standard string `json:"standard"`
+			Short    string `json:"short"`
+		} `json:"editorialNotes"`
+	} `json:"attributes"`
+}
@@ -0,0 +1,76 @@
+package ampapi
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+)
+
+// GetSongCredits 获取歌曲的制作人员名单（演奏、词曲、制作与工程等分类）
+func GetSongCredits(storefront string, id string, language string, token string) (*CreditsResp, error) {
+	var err error
+	if token == "" {
+		token, err = GetToken()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	req, err := http.NewRequest("GET", fmt.Sprintf("https://amp-api.music.apple.com/v1/catalog/%s/songs/%s/credits", storefront, id), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", token))
+	req.Header.Set("User-Agent", "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/91.0.4472.124 Safari/537.36")
+	req.Header.Set("Origin", "https://music.apple.com")
+	query := url.Values{}
+	query.Set("l", language)
+	req.URL.RawQuery = query.Encode()
+	do, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer do.Body.Close()
+	if do.StatusCode == http.StatusNotFound {
+		// 没有名单的歌曲返回 404
+		return &CreditsResp{}, nil
+	}
+	if do.StatusCode != http.StatusOK {
+		return nil, errors.New(do.Status)
+	}
+	obj := new(CreditsResp)
+	err = json.NewDecoder(do.Body).Decode(&obj)
+	if err != nil {
+		return nil, err
+	}
+	return obj, nil
+}
+
+type CreditsResp struct {
+	Data []CreditCategory `json:"data"`
+}
+
+type CreditCategory struct {
+	ID         string `json:"id"`
+	Type       string `json:"type"`
+	Attributes struct {
+		Title string `json:"title"`
+		Kind  string `json:"kind"`
+	} `json:"attributes"`
+	Relationships struct {
+		CreditArtists struct {
+			Data []CreditArtist `json:"data"`
+		} `json:"credit-artists"`
+	} `json:"relationships"`
+}
+
+type CreditArtist struct {
+	ID         string `json:"id"`
+	Type       string `json:"type"`
+	Attributes struct {
+		Name      string   `json:"name"`
+		RoleNames []string `json:"roleNames"`
+	} `json:"attributes"`
+}
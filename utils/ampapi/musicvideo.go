@@ -26,7 +26,7 @@ func GetMusicVideoResp(storefront string, id string, language string, token stri
 	req.Header.Set("Origin", "https://music.apple.com")
 	query := url.Values{}
 	//query.Set("omit[resource]", "autos")
-	query.Set("include", "albums,artists")
+	query.Set("include", "albums,artists,genres")
 	//query.Set("extend", "extendedAssetUrls")
 	//query.Set("include[songs]", "artists")
 	//query.Set("fields[artists]", "name,artwork")
@@ -141,5 +141,11 @@ type MusicVideoRespData struct {
 				} `json:"attributes"`
 			} `json:"data"`
 		} `json:"albums"`
+		Genres struct {
+			Data []struct {
+				ID   string `json:"id"`
+				Type string `json:"type"`
+			} `json:"data"`
+		} `json:"genres"`
 	} `json:"relationships"`
 }
@@ -50,6 +50,12 @@ type TrackRespData struct {
 		TrackNumber  int    `json:"trackNumber"`
 		AudioLocale  string `json:"audioLocale"`
 		ComposerName string `json:"composerName"`
+		// 古典音乐才有的作品与乐章信息
+		WorkName       string `json:"workName"`
+		MovementName   string `json:"movementName"`
+		MovementNumber int    `json:"movementNumber"`
+		MovementCount  int    `json:"movementCount"`
+		Attribution    string `json:"attribution"`
 	} `json:"attributes"`
 	Relationships struct {
 		Artists struct {
@@ -99,5 +105,11 @@ type TrackRespData struct {
 				} `json:"attributes"`
 			} `json:"data"`
 		} `json:"albums"`
+		Genres struct {
+			Data []struct {
+				ID   string `json:"id"`
+				Type string `json:"type"`
+			} `json:"data"`
+		} `json:"genres"`
 	} `json:"relationships"`
 }
@@ -0,0 +1,262 @@
+package checksum
+
+import (
+	"bufio"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// 支持的清单格式；清单文件名为 checksums.<algo>
+const (
+	SHA256 = "sha256"
+	MD5    = "md5"
+	SFV    = "sfv"
+)
+
+// Extensions 是清单覆盖的文件类型：音频、封面与歌词
+var Extensions = []string{".m4a", ".mp4", ".jpg", ".jpeg", ".png", ".webp", ".lrc", ".ttml"}
+
+// Mismatch 描述清单中一个无法通过校验的条目
+type Mismatch struct {
+	Manifest string `json:"manifest"`
+	File     string `json:"file"`
+	Reason   string `json:"reason"`
+}
+
+// ManifestName 返回某种格式的清单文件名
+func ManifestName(algo string) string {
+	return "checksums." + algo
+}
+
+func newHash(algo string) (hash.Hash, error) {
+	switch algo {
+	case SHA256:
+		return sha256.New(), nil
+	case MD5:
+		return md5.New(), nil
+	case SFV:
+		return crc32.NewIEEE(), nil
+	}
+	return nil, fmt.Errorf("unknown checksum algorithm %q", algo)
+}
+
+func sum(path, algo string) (string, error) {
+	h, err := newHash(algo)
+	if err != nil {
+		return "", err
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	s := hex.EncodeToString(h.Sum(nil))
+	if algo == SFV {
+		s = strings.ToUpper(s)
+	}
+	return s, nil
+}
+
+func covered(name string) bool {
+	ext := strings.ToLower(filepath.Ext(name))
+	for _, e := range Extensions {
+		if ext == e {
+			return true
+		}
+	}
+	return false
+}
+
+// formatLine 按清单格式写出一个条目
+func formatLine(algo, name, sum string) string {
+	if algo == SFV {
+		return name + " " + sum
+	}
+	// 与 sha256sum/md5sum 的输出格式一致，可直接用 -c 校验
+	return sum + "  " + name
+}
+
+// parseLine 解析清单中的一个条目；空行与注释返回 ok=false、malformed=false
+func parseLine(algo, line string) (name, want string, ok, malformed bool) {
+	if line == "" || strings.HasPrefix(line, ";") || strings.HasPrefix(line, "#") {
+		return "", "", false, false
+	}
+	if algo == SFV {
+		i := strings.LastIndexByte(line, ' ')
+		if i <= 0 {
+			return "", "", false, true
+		}
+		return line[:i], line[i+1:], true, false
+	}
+	i := strings.IndexByte(line, ' ')
+	if i <= 0 || i+2 > len(line) {
+		return "", "", false, true
+	}
+	// "<hash>  <name>"（文本模式）或 "<hash> *<name>"（二进制模式）
+	return line[i+2:], line[:i], true, false
+}
+
+// Update 为 dir 下（不递归）since 之后修改过的音频、封面和歌词更新清单：已有条目原地替换，
+// 新文件追加在末尾，其他行保持原样，因此未改动文件的校验和不会被重新计算后覆盖。
+// 返回清单路径与写入的条目数
+func Update(dir, algo string, since time.Time) (string, int, error) {
+	if _, err := newHash(algo); err != nil {
+		return "", 0, err
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return "", 0, err
+	}
+	sums := map[string]string{}
+	for _, e := range entries {
+		if !e.Type().IsRegular() || !covered(e.Name()) {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil {
+			return "", 0, err
+		}
+		if info.ModTime().Before(since) {
+			continue
+		}
+		name := e.Name()
+		s, err := sum(filepath.Join(dir, name), algo)
+		if err != nil {
+			return "", 0, err
+		}
+		sums[name] = s
+	}
+	out := filepath.Join(dir, ManifestName(algo))
+	if len(sums) == 0 {
+		return out, 0, nil
+	}
+	var lines []string
+	data, err := os.ReadFile(out)
+	switch {
+	case err == nil:
+		lines = strings.Split(strings.TrimRight(string(data), "\n"), "\n")
+	case errors.Is(err, fs.ErrNotExist):
+		if algo == SFV {
+			lines = []string{"; generated by apple-music-download-center"}
+		}
+	default:
+		return "", 0, err
+	}
+	written := map[string]bool{}
+	for i, line := range lines {
+		name, _, ok, _ := parseLine(algo, strings.TrimRight(line, "\r"))
+		if s := sums[name]; ok && s != "" && !written[name] {
+			lines[i] = formatLine(algo, name, s)
+			written[name] = true
+		}
+	}
+	var added []string
+	for name := range sums {
+		if !written[name] {
+			added = append(added, name)
+		}
+	}
+	sort.Strings(added)
+	for _, name := range added {
+		lines = append(lines, formatLine(algo, name, sums[name]))
+	}
+	tmp := out + ".part"
+	if err := os.WriteFile(tmp, []byte(strings.Join(lines, "\n")+"\n"), 0644); err != nil {
+		return "", 0, err
+	}
+	if err := os.Rename(tmp, out); err != nil {
+		os.Remove(tmp)
+		return "", 0, err
+	}
+	return out, len(sums), nil
+}
+
+// Verify 重新计算清单中每个文件的校验和，返回检查的条目数与不一致的条目
+func Verify(manifest string) (int, []Mismatch, error) {
+	algo := strings.TrimPrefix(filepath.Ext(manifest), ".")
+	if _, err := newHash(algo); err != nil {
+		return 0, nil, err
+	}
+	f, err := os.Open(manifest)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer f.Close()
+	dir := filepath.Dir(manifest)
+	checked := 0
+	var bad []Mismatch
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		line := strings.TrimRight(sc.Text(), "\r")
+		name, want, ok, malformed := parseLine(algo, line)
+		if malformed {
+			bad = append(bad, Mismatch{Manifest: manifest, File: line, Reason: "malformed line"})
+		}
+		if !ok {
+			continue
+		}
+		checked++
+		got, err := sum(filepath.Join(dir, name), algo)
+		switch {
+		case errors.Is(err, fs.ErrNotExist):
+			bad = append(bad, Mismatch{Manifest: manifest, File: name, Reason: "missing"})
+		case err != nil:
+			bad = append(bad, Mismatch{Manifest: manifest, File: name, Reason: err.Error()})
+		case !strings.EqualFold(got, want):
+			bad = append(bad, Mismatch{Manifest: manifest, File: name, Reason: fmt.Sprintf("checksum mismatch (expected %s, got %s)", want, got)})
+		}
+	}
+	return checked, bad, sc.Err()
+}
+
+// FindManifests 在各根目录下递归查找所有清单文件
+func FindManifests(roots []string) ([]string, error) {
+	seen, found := map[string]bool{}, map[string]bool{}
+	var out []string
+	for _, root := range roots {
+		if root == "" || seen[root] {
+			continue
+		}
+		seen[root] = true
+		err := filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+			if err != nil {
+				if errors.Is(err, fs.ErrNotExist) {
+					return nil
+				}
+				return err
+			}
+			if d.IsDir() {
+				return nil
+			}
+			switch d.Name() {
+			case ManifestName(SHA256), ManifestName(MD5), ManifestName(SFV):
+				// 根目录可能互相嵌套，同一清单只记一次
+				if !found[p] {
+					found[p] = true
+					out = append(out, p)
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return out, err
+		}
+	}
+	sort.Strings(out)
+	return out, nil
+}
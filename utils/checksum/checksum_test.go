@@ -0,0 +1,62 @@
+package checksum
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestUpdateKeepsUntouchedEntries(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, data string, mtime time.Time) {
+		p := filepath.Join(dir, name)
+		if err := os.WriteFile(p, []byte(data), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(p, mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	old := time.Now().Add(-time.Hour)
+	// 01 的内容在写清单后损坏；02 在本次任务中重新写入；03 是新文件
+	write("01.m4a", "rotten", old)
+	write("02.m4a", "new", time.Now())
+	write("03.m4a", "added", time.Now())
+	write("notes.txt", "ignored", time.Now())
+	manifest := filepath.Join(dir, ManifestName(MD5))
+	orig := "# kept comment\n" +
+		"0cc175b9c0f1b6a831c399e269772661  01.m4a\n" +
+		"92eb5ffee6ae2fec3ad71c777531578f  02.m4a\n"
+	if err := os.WriteFile(manifest, []byte(orig), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	path, n, err := Update(dir, MD5, time.Now().Add(-time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if path != manifest || n != 2 {
+		t.Fatalf("Update = %s, %d", path, n)
+	}
+	got, err := os.ReadFile(manifest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "# kept comment\n" +
+		"0cc175b9c0f1b6a831c399e269772661  01.m4a\n" +
+		"22af645d1859cb5ca6da0c484f1f37ea  02.m4a\n" +
+		"b60ed88355ac3f6898fd8a7ab1734d06  03.m4a\n"
+	if string(got) != want {
+		t.Fatalf("manifest:\n%s\nwant:\n%s", got, want)
+	}
+
+	// 损坏仍能被发现
+	_, bad, err := Verify(manifest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(bad) != 1 || bad[0].File != "01.m4a" {
+		t.Fatalf("mismatches %+v", bad)
+	}
+}
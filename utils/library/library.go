@@ -0,0 +1,546 @@
+package library
+
+import (
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"main/utils/lyrics"
+	"main/utils/mp4meta"
+
+	"github.com/zhaarey/go-mp4tag"
+)
+
+var ErrScanning = errors.New("library scan already running")
+
+type Track struct {
+	ID          string `json:"id"`
+	Path        string `json:"path"`
+	Root        string `json:"root"`
+	AlbumKey    string `json:"albumKey"`
+	Size        int64  `json:"size"`
+	ModTime     int64  `json:"modTime"`
+	Title       string `json:"title"`
+	Artist      string `json:"artist"`
+	Album       string `json:"album"`
+	AlbumArtist string `json:"albumArtist"`
+	Genre       string `json:"genre"`
+	Year        int    `json:"year"`
+	TrackNumber int    `json:"trackNumber"`
+	TrackTotal  int    `json:"trackTotal"`
+	DiscNumber  int    `json:"discNumber"`
+	DiscTotal   int    `json:"discTotal"`
+	Codec       string `json:"codec"`
+	SampleRate  int    `json:"sampleRate"`
+	BitDepth    int    `json:"bitDepth"`
+	Channels    int    `json:"channels"`
+	DurationMs  int64  `json:"durationMs"`
+	SongID      string `json:"songId,omitempty"`
+	AlbumID     string `json:"albumId,omitempty"`
+	ArtistID    string `json:"artistId,omitempty"`
+	ISRC        string `json:"isrc,omitempty"`
+	UPC         string `json:"upc,omitempty"`
+	HasLyrics   bool   `json:"hasLyrics"`
+	HasCover    bool   `json:"hasCover"`
+	LrcPath     string `json:"lrcPath,omitempty"`
+	CoverPath   string `json:"coverPath,omitempty"`
+	Error       string `json:"error,omitempty"`
+}
+
+type Album struct {
+	ID         string   `json:"id"`
+	Title      string   `json:"title"`
+	Artist     string   `json:"artist"`
+	ArtistID   string   `json:"artistId"`
+	Dir        string   `json:"dir"`
+	Year       int      `json:"year"`
+	AlbumID    string   `json:"albumId,omitempty"`
+	UPC        string   `json:"upc,omitempty"`
+	Codecs     []string `json:"codecs"`
+	CoverPath  string   `json:"coverPath,omitempty"`
+	Genre      string   `json:"genre,omitempty"`
+	TrackCount int      `json:"trackCount"`
+	DurationMs int64    `json:"durationMs"`
+	ModTime    int64    `json:"modTime"`
+}
+
+type Artist struct {
+	ID         string `json:"id"`
+	Name       string `json:"name"`
+	AlbumCount int    `json:"albumCount"`
+	TrackCount int    `json:"trackCount"`
+}
+
+type ScanResult struct {
+	Scanned   int           `json:"scanned"`
+	Updated   int           `json:"updated"`
+	Removed   int           `json:"removed"`
+	Failed    int           `json:"failed"`
+	Total     int           `json:"total"`
+	Took      time.Duration `json:"took"`
+	StartedAt time.Time     `json:"startedAt"`
+}
+
+// Index 是下载目录的本地索引，持久化为一个 JSON 文件
+type Index struct {
+	mu       sync.RWMutex
+	path     string
+	tracks   map[string]*Track
+	lastScan ScanResult
+	scanning bool
+}
+
+type indexFile struct {
+	UpdatedAt time.Time `json:"updatedAt"`
+	Tracks    []*Track  `json:"tracks"`
+}
+
+// Open loads the index stored at path; a missing file yields an empty index.
+func Open(path string) (*Index, error) {
+	x := &Index{path: path, tracks: map[string]*Track{}}
+	b, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return x, nil
+	}
+	if err != nil {
+		return x, err
+	}
+	var f indexFile
+	if err := json.Unmarshal(b, &f); err != nil {
+		return x, err
+	}
+	for _, t := range f.Tracks {
+		x.tracks[t.Path] = t
+	}
+	return x, nil
+}
+
+func (x *Index) save() error {
+	if x.path == "" {
+		return nil
+	}
+	f := indexFile{UpdatedAt: time.Now()}
+	for _, t := range x.tracks {
+		f.Tracks = append(f.Tracks, t)
+	}
+	sort.Slice(f.Tracks, func(i, j int) bool { return f.Tracks[i].Path < f.Tracks[j].Path })
+	b, err := json.Marshal(f)
+	if err != nil {
+		return err
+	}
+	tmp := x.path + ".tmp"
+	if err := os.WriteFile(tmp, b, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, x.path)
+}
+
+// Scan walks roots and re-reads only files whose size or mtime changed since the last scan.
+func (x *Index) Scan(roots []string) (ScanResult, error) {
+	x.mu.Lock()
+	if x.scanning {
+		x.mu.Unlock()
+		return ScanResult{}, ErrScanning
+	}
+	x.scanning = true
+	old := make(map[string]*Track, len(x.tracks))
+	for k, v := range x.tracks {
+		old[k] = v
+	}
+	x.mu.Unlock()
+	defer func() {
+		x.mu.Lock()
+		x.scanning = false
+		x.mu.Unlock()
+	}()
+
+	res := ScanResult{StartedAt: time.Now()}
+	next := map[string]*Track{}
+	seenRoot := map[string]bool{}
+	for _, root := range roots {
+		if root == "" || seenRoot[root] {
+			continue
+		}
+		seenRoot[root] = true
+		if _, err := os.Stat(root); err != nil {
+			continue
+		}
+		filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+			if err != nil || d.IsDir() || !strings.EqualFold(filepath.Ext(p), ".m4a") {
+				return nil
+			}
+			fi, err := d.Info()
+			if err != nil {
+				return nil
+			}
+			res.Scanned++
+			if t, ok := old[p]; ok && t.Size == fi.Size() && t.ModTime == fi.ModTime().UnixNano() {
+				c := *t
+				refreshSidecars(&c)
+				next[p] = &c
+				return nil
+			}
+			t := readTrack(root, p, fi)
+			if t.Error != "" {
+				res.Failed++
+			}
+			res.Updated++
+			next[p] = t
+			return nil
+		})
+	}
+	for p := range old {
+		if _, ok := next[p]; !ok {
+			res.Removed++
+		}
+	}
+	res.Total = len(next)
+	res.Took = time.Since(res.StartedAt)
+
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	x.tracks = next
+	x.lastScan = res
+	return res, x.save()
+}
+
+// Scanning reports whether a scan is in progress and returns the result of the last finished one.
+func (x *Index) Scanning() (bool, ScanResult) {
+	x.mu.RLock()
+	defer x.mu.RUnlock()
+	return x.scanning, x.lastScan
+}
+
+func hashID(s string) string {
+	sum := sha1.Sum([]byte(s))
+	return hex.EncodeToString(sum[:8])
+}
+
+// ArtistKey returns the id used for an album artist name.
+func ArtistKey(name string) string {
+	return hashID(strings.ToLower(strings.TrimSpace(name)))
+}
+
+// atomID 把 cnID/plID/atID 等整数原子按大端读出
+func atomID(b []byte) string {
+	var v uint64
+	switch len(b) {
+	case 4:
+		v = uint64(binary.BigEndian.Uint32(b))
+	case 8:
+		v = binary.BigEndian.Uint64(b)
+	default:
+		return ""
+	}
+	if v == 0 {
+		return ""
+	}
+	return strconv.FormatUint(v, 10)
+}
+
+func readTrack(root, p string, fi fs.FileInfo) *Track {
+	dir := filepath.Dir(p)
+	t := &Track{
+		ID:       hashID(p),
+		Path:     p,
+		Root:     root,
+		AlbumKey: hashID(dir),
+		Size:     fi.Size(),
+		ModTime:  fi.ModTime().UnixNano(),
+		Title:    strings.TrimSuffix(filepath.Base(p), filepath.Ext(p)),
+	}
+	info, err := mp4meta.Probe(p)
+	if info != nil {
+		t.Codec = info.Codec
+		t.SampleRate = info.SampleRate
+		t.BitDepth = info.BitDepth
+		t.Channels = info.Channels
+		t.DurationMs = info.DurationMs
+		t.HasCover = info.HasCover
+		t.SongID = atomID(info.Atoms["cnID"])
+		t.AlbumID = atomID(info.Atoms["plID"])
+		t.ArtistID = atomID(info.Atoms["atID"])
+	}
+	if err != nil {
+		t.Error = err.Error()
+	}
+	if mp4, err := mp4tag.Open(p); err == nil {
+		tags, err := mp4.Read()
+		mp4.Close()
+		if err == nil && tags != nil {
+			if tags.Title != "" {
+				t.Title = tags.Title
+			}
+			t.Artist = tags.Artist
+			t.Album = tags.Album
+			t.AlbumArtist = tags.AlbumArtist
+			t.Genre = tags.CustomGenre
+			t.Year = int(tags.Year)
+			t.TrackNumber = int(tags.TrackNumber)
+			t.TrackTotal = int(tags.TrackTotal)
+			t.DiscNumber = int(tags.DiscNumber)
+			t.DiscTotal = int(tags.DiscTotal)
+			t.HasLyrics = tags.Lyrics != ""
+			t.ISRC = tags.Custom["ISRC"]
+			t.UPC = tags.Custom["UPC"]
+			if t.AlbumID == "" && tags.ItunesAlbumID > 0 {
+				t.AlbumID = strconv.FormatUint(uint64(tags.ItunesAlbumID), 10)
+			}
+			if t.ArtistID == "" && tags.ItunesArtistID > 0 {
+				t.ArtistID = strconv.FormatUint(uint64(tags.ItunesArtistID), 10)
+			}
+			if t.Year == 0 && len(tags.Date) >= 4 {
+				t.Year, _ = strconv.Atoi(tags.Date[:4])
+			}
+		} else if err != nil && t.Error == "" {
+			t.Error = err.Error()
+		}
+	} else if t.Error == "" {
+		t.Error = err.Error()
+	}
+	if t.AlbumArtist == "" {
+		t.AlbumArtist = t.Artist
+	}
+	refreshSidecars(t)
+	return t
+}
+
+// refreshSidecars 检查同名 .lrc/.ttml 与目录下的 cover.*，这两者不影响音频文件的 mtime
+func refreshSidecars(t *Track) {
+	t.LrcPath = ""
+	base := strings.TrimSuffix(t.Path, filepath.Ext(t.Path))
+	for _, ext := range []string{".lrc", ".ttml"} {
+		if _, err := os.Stat(base + ext); err == nil {
+			t.LrcPath = base + ext
+			break
+		}
+	}
+	t.CoverPath = ""
+	dir := filepath.Dir(t.Path)
+	for _, ext := range []string{"jpg", "png", "jpeg", "webp"} {
+		c := filepath.Join(dir, "cover."+ext)
+		if _, err := os.Stat(c); err == nil {
+			t.CoverPath = c
+			break
+		}
+	}
+}
+
+// Tracks returns every indexed track, optionally restricted to one album or artist id.
+func (x *Index) Tracks(albumID, artistID string) []Track {
+	x.mu.RLock()
+	defer x.mu.RUnlock()
+	out := []Track{}
+	for _, t := range x.tracks {
+		if albumID != "" && t.AlbumKey != albumID {
+			continue
+		}
+		if artistID != "" && ArtistKey(t.AlbumArtist) != artistID {
+			continue
+		}
+		out = append(out, *t)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		a, b := out[i], out[j]
+		if a.AlbumKey != b.AlbumKey {
+			return a.Path < b.Path
+		}
+		if a.DiscNumber != b.DiscNumber {
+			return a.DiscNumber < b.DiscNumber
+		}
+		if a.TrackNumber != b.TrackNumber {
+			return a.TrackNumber < b.TrackNumber
+		}
+		return a.Path < b.Path
+	})
+	return out
+}
+
+// Track looks a single track up by its id.
+func (x *Index) Track(id string) (Track, bool) {
+	x.mu.RLock()
+	defer x.mu.RUnlock()
+	for _, t := range x.tracks {
+		if t.ID == id {
+			return *t, true
+		}
+	}
+	return Track{}, false
+}
+
+// FindSong returns the tracks carrying the given Apple Music song id.
+func (x *Index) FindSong(songID string) []Track {
+	x.mu.RLock()
+	defer x.mu.RUnlock()
+	var out []Track
+	for _, t := range x.tracks {
+		if songID != "" && t.SongID == songID {
+			out = append(out, *t)
+		}
+	}
+	return out
+}
+
+// Album returns the album with the given id.
+func (x *Index) Album(id string) (Album, bool) {
+	for _, a := range x.Albums("") {
+		if a.ID == id {
+			return a, true
+		}
+	}
+	return Album{}, false
+}
+
+// Albums groups tracks by directory; artistID filters by album artist.
+func (x *Index) Albums(artistID string) []Album {
+	x.mu.RLock()
+	defer x.mu.RUnlock()
+	m := map[string]*Album{}
+	for _, t := range x.tracks {
+		aid := ArtistKey(t.AlbumArtist)
+		if artistID != "" && aid != artistID {
+			continue
+		}
+		a, ok := m[t.AlbumKey]
+		if !ok {
+			a = &Album{
+				ID:        t.AlbumKey,
+				Title:     t.Album,
+				Artist:    t.AlbumArtist,
+				ArtistID:  aid,
+				Dir:       filepath.Dir(t.Path),
+				Year:      t.Year,
+				AlbumID:   t.AlbumID,
+				UPC:       t.UPC,
+				CoverPath: t.CoverPath,
+				Codecs:    []string{},
+			}
+			if a.Title == "" {
+				a.Title = filepath.Base(a.Dir)
+			}
+			m[t.AlbumKey] = a
+		}
+		a.TrackCount++
+		a.DurationMs += t.DurationMs
+		if t.ModTime > a.ModTime {
+			a.ModTime = t.ModTime
+		}
+		if a.Genre == "" {
+			a.Genre = t.Genre
+		}
+		if t.Codec != "" && !contains(a.Codecs, t.Codec) {
+			a.Codecs = append(a.Codecs, t.Codec)
+		}
+		if a.CoverPath == "" {
+			a.CoverPath = t.CoverPath
+		}
+	}
+	out := make([]Album, 0, len(m))
+	for _, a := range m {
+		out = append(out, *a)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if !strings.EqualFold(out[i].Artist, out[j].Artist) {
+			return strings.ToLower(out[i].Artist) < strings.ToLower(out[j].Artist)
+		}
+		if out[i].Year != out[j].Year {
+			return out[i].Year < out[j].Year
+		}
+		return out[i].Title < out[j].Title
+	})
+	return out
+}
+
+// Artists lists album artists with their album and track counts.
+func (x *Index) Artists() []Artist {
+	x.mu.RLock()
+	defer x.mu.RUnlock()
+	m := map[string]*Artist{}
+	albums := map[string]map[string]bool{}
+	for _, t := range x.tracks {
+		id := ArtistKey(t.AlbumArtist)
+		a, ok := m[id]
+		if !ok {
+			a = &Artist{ID: id, Name: t.AlbumArtist}
+			m[id] = a
+			albums[id] = map[string]bool{}
+		}
+		a.TrackCount++
+		albums[id][t.AlbumKey] = true
+	}
+	out := make([]Artist, 0, len(m))
+	for id, a := range m {
+		a.AlbumCount = len(albums[id])
+		out = append(out, *a)
+	}
+	sort.Slice(out, func(i, j int) bool { return strings.ToLower(out[i].Name) < strings.ToLower(out[j].Name) })
+	return out
+}
+
+// EmbeddedCover returns the first picture stored in the file's covr atom.
+func EmbeddedCover(path string) ([]byte, error) {
+	mp4, err := mp4tag.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer mp4.Close()
+	tags, err := mp4.Read()
+	if err != nil {
+		return nil, err
+	}
+	if len(tags.Pictures) == 0 || len(tags.Pictures[0].Data) == 0 {
+		return nil, errors.New("no embedded cover")
+	}
+	return tags.Pictures[0].Data, nil
+}
+
+// Lyrics returns the track's lyrics as LRC, preferring the embedded tag over the sidecar file.
+// TTML lyrics are converted to LRC. The second return value names the source.
+func Lyrics(t Track) (string, string, error) {
+	text, source := "", ""
+	if t.HasLyrics {
+		if mp4, err := mp4tag.Open(t.Path); err == nil {
+			if tags, err := mp4.Read(); err == nil {
+				text, source = tags.Lyrics, "embedded"
+			}
+			mp4.Close()
+		}
+	}
+	if text == "" && t.LrcPath != "" {
+		b, err := os.ReadFile(t.LrcPath)
+		if err != nil {
+			return "", "", err
+		}
+		text, source = string(b), "sidecar"
+	}
+	if text == "" {
+		return "", "", errors.New("no lyrics")
+	}
+	if strings.HasPrefix(strings.TrimSpace(text), "<") {
+		lrc, err := lyrics.TtmlToLrc(text)
+		if err != nil {
+			return "", "", err
+		}
+		text = lrc
+	}
+	return text, source, nil
+}
+
+func contains(arr []string, s string) bool {
+	for _, v := range arr {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
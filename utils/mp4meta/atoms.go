@@ -0,0 +1,238 @@
+package mp4meta
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+)
+
+// ilst data 原子的类型标识
+const (
+	TypeImplicit uint32 = 0
+	TypeUTF8     uint32 = 1
+	TypeInt      uint32 = 21
+)
+
+// freeform 原子统一放在 iTunes 的命名空间下
+const freeformMean = "com.apple.iTunes"
+
+// Atom 是 ilst 中的一个条目：Name 为四字符原子名，Values 中每一项写成一个 data 原子（多值标签）；
+// Name 为 "----" 时 Key 是 freeform 原子的名字
+type Atom struct {
+	Name   string
+	Key    string
+	Type   uint32
+	Values [][]byte
+}
+
+// ident 是 SetAtoms 用来匹配同名原子的标识，freeform 原子写作 "----:KEY"
+func (a Atom) ident() string {
+	if a.Name == "----" {
+		return "----:" + a.Key
+	}
+	return a.Name
+}
+
+// IntAtom 以大端有符号整数编码 v；size 为首选宽度（1/2/4/8 字节），放不下时自动扩成 8 字节
+func IntAtom(name string, v uint64, size int) Atom {
+	var b []byte
+	switch {
+	case size == 1 && v <= math.MaxInt8:
+		b = []byte{byte(v)}
+	case size <= 2 && v <= math.MaxInt16:
+		b = binary.BigEndian.AppendUint16(nil, uint16(v))
+	case size <= 4 && v <= math.MaxInt32:
+		b = binary.BigEndian.AppendUint32(nil, uint32(v))
+	default:
+		b = binary.BigEndian.AppendUint64(nil, v)
+	}
+	return Atom{Name: name, Type: TypeInt, Values: [][]byte{b}}
+}
+
+// TrackNumberAtom 按 trkn 的格式编码序号与总数：2 字节保留位、序号、总数、2 字节保留位
+func TrackNumberAtom(n, total int) Atom {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint16(b[2:], uint16(n))
+	binary.BigEndian.PutUint16(b[4:], uint16(total))
+	return Atom{Name: "trkn", Type: TypeImplicit, Values: [][]byte{b}}
+}
+
+// TextAtom 以 UTF-8 文本编码 values，多个值写成多个 data 原子
+func TextAtom(name string, values ...string) Atom {
+	return Atom{Name: name, Type: TypeUTF8, Values: textValues(values)}
+}
+
+// FreeformAtom 写入 ----:com.apple.iTunes:key 文本原子，多个值写成多个 data 原子
+func FreeformAtom(key string, values ...string) Atom {
+	return Atom{Name: "----", Key: key, Type: TypeUTF8, Values: textValues(values)}
+}
+
+func textValues(values []string) [][]byte {
+	out := make([][]byte, len(values))
+	for i, v := range values {
+		out[i] = []byte(v)
+	}
+	return out
+}
+
+func appendBox(out []byte, typ string, body ...[]byte) []byte {
+	size := 8
+	for _, b := range body {
+		size += len(b)
+	}
+	out = binary.BigEndian.AppendUint32(out, uint32(size))
+	out = append(out, typ...)
+	for _, b := range body {
+		out = append(out, b...)
+	}
+	return out
+}
+
+func (a Atom) encode() []byte {
+	var body []byte
+	if a.Name == "----" {
+		body = appendBox(body, "mean", make([]byte, 4), []byte(freeformMean))
+		body = appendBox(body, "name", make([]byte, 4), []byte(a.Key))
+	}
+	for _, v := range a.Values {
+		// version 0 + 类型，随后是 4 字节 locale
+		hdr := binary.BigEndian.AppendUint32(nil, a.Type&0xffffff)
+		hdr = binary.BigEndian.AppendUint32(hdr, 0)
+		body = appendBox(body, "data", hdr, v)
+	}
+	return appendBox(nil, a.Name, body)
+}
+
+// atomIdent 返回 ilst 中已有条目的匹配标识，与 Atom.ident 对应
+func atomIdent(c rawBox) string {
+	if c.typ != "----" {
+		return c.typ
+	}
+	for _, d := range children(c.data[:c.end], c.body) {
+		if d.typ == "name" && d.end-d.body >= 4 {
+			return "----:" + string(c.data[d.body+4:d.end])
+		}
+	}
+	return c.typ
+}
+
+// SetAtoms 直接改写 ilst：先删除 remove 与 set 中同名的原子（freeform 原子写作 "----:KEY"），
+// 再追加 set 中有值的原子。用于 go-mp4tag 不支持或写法不对的原子（例如 64 位 id、多值标签）；
+// 文件会先经 Prepare 整理，moov 位于所有 mdat 之后，因此改变 moov 大小无需修正 chunk 偏移。
+// 结果先写入同目录下的临时文件，落盘后再 rename 覆盖原文件。
+func SetAtoms(path string, set []Atom, remove []string) error {
+	for _, a := range set {
+		if len(a.Name) != 4 || (a.Name == "----") != (a.Key != "") {
+			return fmt.Errorf("invalid atom name %q", a.Name)
+		}
+	}
+	if err := Prepare(path); err != nil {
+		return err
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	st, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	tops, err := readTopBoxes(f, st.Size())
+	if err != nil {
+		return err
+	}
+	var moovHdr *boxHeader
+	for i := range tops {
+		if tops[i].Type == "moov" {
+			moovHdr = &tops[i]
+		}
+	}
+	if moovHdr == nil {
+		return errors.New("moov box not present")
+	}
+	moovRaw, err := readBox(f, *moovHdr)
+	if err != nil {
+		return err
+	}
+	var parents []*rawBox
+	for _, p := range [][]string{{"moov"}, {"moov", "udta"}, {"moov", "udta", "meta"}} {
+		b := findPath(moovRaw, p...)
+		if b == nil {
+			return errors.New("ilst box not present")
+		}
+		parents = append(parents, b)
+	}
+	ilst := findPath(moovRaw, "moov", "udta", "meta", "ilst")
+	if ilst == nil {
+		return errors.New("ilst box not present")
+	}
+
+	drop := map[string]bool{}
+	for _, name := range remove {
+		drop[name] = true
+	}
+	for _, a := range set {
+		drop[a.ident()] = true
+	}
+	body := make([]byte, 0, ilst.end-ilst.body)
+	for _, c := range children(moovRaw[:ilst.end], ilst.body) {
+		if !drop[atomIdent(c)] {
+			body = append(body, moovRaw[c.start:c.end]...)
+		}
+	}
+	for _, a := range set {
+		if len(a.Values) > 0 {
+			body = append(body, a.encode()...)
+		}
+	}
+	newIlst := binary.BigEndian.AppendUint32(nil, uint32(8+len(body)))
+	newIlst = append(newIlst, "ilst"...)
+	newIlst = append(newIlst, body...)
+	delta := len(newIlst) - (ilst.end - ilst.start)
+
+	moov := make([]byte, 0, len(moovRaw)+delta)
+	moov = append(moov, moovRaw[:ilst.start]...)
+	moov = append(moov, newIlst...)
+	moov = append(moov, moovRaw[ilst.end:]...)
+	for _, p := range parents {
+		size := uint64(p.end-p.start) + uint64(int64(delta))
+		if p.body-p.start == 16 {
+			binary.BigEndian.PutUint64(moov[p.start+8:], size)
+		} else if size > math.MaxUint32 {
+			return fmt.Errorf("%s box too large", p.typ)
+		} else {
+			binary.BigEndian.PutUint32(moov[p.start:], uint32(size))
+		}
+	}
+
+	tmp := path + ".atoms"
+	out, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	// moov 之前的部分与 moov 之后的其他顶层 box 原样复制，中间换成新的 moov
+	end := moovHdr.Start + moovHdr.Size
+	_, err = io.Copy(out, io.NewSectionReader(f, 0, moovHdr.Start))
+	if err == nil {
+		_, err = out.Write(moov)
+	}
+	if err == nil {
+		_, err = io.Copy(out, io.NewSectionReader(f, end, st.Size()-end))
+	}
+	if err == nil {
+		err = out.Sync()
+	}
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	f.Close()
+	return os.Rename(tmp, path)
+}
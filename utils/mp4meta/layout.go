@@ -0,0 +1,509 @@
+package mp4meta
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+
+	"github.com/Eyevinn/mp4ff/mp4"
+)
+
+// maxStcoOffset 是 stco 能表示的最大 chunk 偏移，超过时改用 co64（测试中调小以构造该情况）
+var maxStcoOffset uint64 = math.MaxUint32
+
+// go-mp4tag 只接受这些主品牌
+var taggableBrands = map[string]bool{
+	"M4A ": true, "M4B ": true, "dash": true, "mp41": true,
+	"mp42": true, "isom": true, "iso2": true, "avc1": true,
+}
+
+// Prepare 把文件整理成可以直接写入 iTunes 元数据的布局：
+// 分片文件合并为单个 mdat 与完整的 sample table；moov 放在所有 mdat 之后
+// （这样 ilst 大小变化不会影响 chunk 偏移）；没有 udta/meta/ilst 时补一个空的。
+// 已满足条件的文件不会被改写。
+func Prepare(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	st, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	tops, err := readTopBoxes(f, st.Size())
+	if err != nil {
+		return err
+	}
+	var moovHdr, ftypHdr *boxHeader
+	lastMdat := int64(-1)
+	for i := range tops {
+		switch tops[i].Type {
+		case "moov":
+			moovHdr = &tops[i]
+		case "ftyp":
+			ftypHdr = &tops[i]
+		case "mdat":
+			lastMdat = tops[i].Start
+		}
+	}
+	if moovHdr == nil {
+		return errors.New("moov box not present")
+	}
+	moovRaw, err := readBox(f, *moovHdr)
+	if err != nil {
+		return err
+	}
+	box, err := mp4.DecodeBox(0, bytes.NewReader(moovRaw))
+	if err != nil {
+		return fmt.Errorf("decode moov: %w", err)
+	}
+	moov := box.(*mp4.MoovBox)
+	for _, trak := range moov.Traks {
+		if err := checkTrak(trak); err != nil {
+			return err
+		}
+	}
+	hasIlst := findPath(moovRaw, "moov", "udta", "meta", "ilst") != nil
+	fragmented := moov.Mvex != nil
+
+	var ftyp []byte
+	if ftypHdr != nil {
+		if ftyp, err = readBox(f, *ftypHdr); err != nil {
+			return err
+		}
+	}
+	brandOK := len(ftyp) >= 12 && taggableBrands[string(ftyp[8:12])]
+	if !fragmented && hasIlst && brandOK && moovHdr.Start > lastMdat {
+		return nil
+	}
+	if fragmented {
+		ftyp = newFtyp("M4A ", "M4A ", "mp42", "isom")
+	} else if !brandOK {
+		ftyp = newFtyp("mp42", "mp42", "isom")
+	}
+
+	tmp := path + ".layout"
+	out, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if fragmented {
+		err = writeFlattened(f, out, tops, moov, ftyp, hasIlst)
+	} else {
+		err = writeMoovLast(f, out, tops, moov, ftyp, hasIlst)
+	}
+	if err == nil {
+		err = out.Sync()
+	}
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	f.Close()
+	return os.Rename(tmp, path)
+}
+
+func newFtyp(major string, compatible ...string) []byte {
+	b := make([]byte, 16, 16+4*len(compatible))
+	binary.BigEndian.PutUint32(b[0:4], uint32(16+4*len(compatible)))
+	copy(b[4:8], "ftyp")
+	copy(b[8:12], major)
+	for _, c := range compatible {
+		b = append(b, c...)
+	}
+	return b
+}
+
+// emptyUdta 构造 udta/meta(hdlr mdir)/ilst，meta 采用 ISO full box 形式
+func emptyUdta() []byte {
+	hdlr := []byte{
+		0, 0, 0, 33, 'h', 'd', 'l', 'r',
+		0, 0, 0, 0, // version/flags
+		0, 0, 0, 0, // pre_defined
+		'm', 'd', 'i', 'r',
+		'a', 'p', 'p', 'l', 0, 0, 0, 0, 0, 0, 0, 0,
+		0, // name
+	}
+	ilst := []byte{0, 0, 0, 8, 'i', 'l', 's', 't'}
+	meta := make([]byte, 12, 12+len(hdlr)+len(ilst))
+	copy(meta[4:8], "meta")
+	meta = append(append(meta, hdlr...), ilst...)
+	binary.BigEndian.PutUint32(meta[0:4], uint32(len(meta)))
+	udta := make([]byte, 8, 8+len(meta))
+	copy(udta[4:8], "udta")
+	udta = append(udta, meta...)
+	binary.BigEndian.PutUint32(udta[0:4], uint32(len(udta)))
+	return udta
+}
+
+// encodeMoov 编码 moov；没有 ilst 时去掉原有 udta 并附加一个空的 udta/meta/ilst
+func encodeMoov(moov *mp4.MoovBox, hasIlst bool) ([]byte, error) {
+	var extra []byte
+	if !hasIlst {
+		kept := moov.Children[:0]
+		for _, c := range moov.Children {
+			if c.Type() != "udta" {
+				kept = append(kept, c)
+			}
+		}
+		moov.Children = kept
+		extra = emptyUdta()
+	}
+	var buf bytes.Buffer
+	if err := moov.Encode(&buf); err != nil {
+		return nil, fmt.Errorf("encode moov: %w", err)
+	}
+	raw := append(buf.Bytes(), extra...)
+	if len(raw) > math.MaxUint32 {
+		return nil, errors.New("moov box too large")
+	}
+	binary.BigEndian.PutUint32(raw[0:4], uint32(len(raw)))
+	return raw, nil
+}
+
+// copyBox 原样复制一个顶层 box；size 字段为 0（延伸到文件尾）时改写为实际大小
+func copyBox(f *os.File, out io.Writer, b boxHeader) error {
+	hdr := make([]byte, b.Header)
+	if _, err := f.ReadAt(hdr, b.Start); err != nil {
+		return err
+	}
+	if binary.BigEndian.Uint32(hdr[0:4]) == 0 {
+		if b.Size > math.MaxUint32 {
+			return fmt.Errorf("%s box too large", b.Type)
+		}
+		binary.BigEndian.PutUint32(hdr[0:4], uint32(b.Size))
+	}
+	if _, err := out.Write(hdr); err != nil {
+		return err
+	}
+	_, err := io.Copy(out, io.NewSectionReader(f, b.Start+b.Header, b.Size-b.Header))
+	return err
+}
+
+// writeMoovLast 保留所有媒体数据，把 moov 移到文件末尾并按新位置修正 stco/co64；
+// 新偏移超出 stco 的范围时把 stco 换成 co64
+func writeMoovLast(f *os.File, out io.Writer, tops []boxHeader, moov *mp4.MoovBox, ftyp []byte, hasIlst bool) error {
+	type placed struct {
+		box      boxHeader
+		newStart int64
+	}
+	pos := int64(len(ftyp))
+	var kept []placed
+	for _, b := range tops {
+		switch b.Type {
+		case "ftyp", "moov", "free", "skip", "wide":
+			continue
+		}
+		kept = append(kept, placed{b, pos})
+		pos += b.Size
+	}
+	relocate := func(off uint64) (uint64, error) {
+		for _, p := range kept {
+			if int64(off) >= p.box.Start && int64(off) < p.box.Start+p.box.Size {
+				return uint64(int64(off) - p.box.Start + p.newStart), nil
+			}
+		}
+		return 0, fmt.Errorf("chunk offset %d is outside any media box", off)
+	}
+	for _, trak := range moov.Traks {
+		stbl := trak.Mdia.Minf.Stbl
+		if stbl.Co64 != nil {
+			for i, off := range stbl.Co64.ChunkOffset {
+				n, err := relocate(off)
+				if err != nil {
+					return err
+				}
+				stbl.Co64.ChunkOffset[i] = n
+			}
+		}
+		if stbl.Stco != nil {
+			offsets := make([]uint64, len(stbl.Stco.ChunkOffset))
+			large := false
+			for i, off := range stbl.Stco.ChunkOffset {
+				n, err := relocate(uint64(off))
+				if err != nil {
+					return err
+				}
+				offsets[i] = n
+				large = large || n > maxStcoOffset
+			}
+			if large {
+				co64 := &mp4.Co64Box{ChunkOffset: offsets}
+				for i, c := range stbl.Children {
+					if c == mp4.Box(stbl.Stco) {
+						stbl.Children[i] = co64
+					}
+				}
+				stbl.Stco, stbl.Co64 = nil, co64
+			} else {
+				for i, n := range offsets {
+					stbl.Stco.ChunkOffset[i] = uint32(n)
+				}
+			}
+		}
+	}
+	moovRaw, err := encodeMoov(moov, hasIlst)
+	if err != nil {
+		return err
+	}
+	if _, err := out.Write(ftyp); err != nil {
+		return err
+	}
+	for _, p := range kept {
+		if err := copyBox(f, out, p.box); err != nil {
+			return err
+		}
+	}
+	_, err = out.Write(moovRaw)
+	return err
+}
+
+// trackTable 收集一个轨道在所有分片中的样本信息
+type trackTable struct {
+	sizes   []uint32
+	durs    []uint32
+	ctos    []int32
+	nonSync []bool
+	chunkN  []uint32
+	offsets []uint64
+}
+
+type fragChunk struct {
+	src   int64
+	size  int64
+	table *trackTable
+}
+
+// writeFlattened 把 moof/mdat 分片合并为一个 mdat，并按样本重建每个轨道的 sample table
+func writeFlattened(f *os.File, out io.Writer, tops []boxHeader, moov *mp4.MoovBox, ftyp []byte, hasIlst bool) error {
+	tables := map[uint32]*trackTable{}
+	trexs := map[uint32]*mp4.TrexBox{}
+	for _, t := range moov.Traks {
+		tables[t.Tkhd.TrackID] = &trackTable{}
+	}
+	for _, t := range moov.Mvex.Trexs {
+		trexs[t.TrackID] = t
+	}
+
+	var chunks []fragChunk
+	var total int64
+	for _, b := range tops {
+		if b.Type != "moof" {
+			continue
+		}
+		raw, err := readBox(f, b)
+		if err != nil {
+			return err
+		}
+		box, err := mp4.DecodeBox(uint64(b.Start), bytes.NewReader(raw))
+		if err != nil {
+			return fmt.Errorf("decode moof: %w", err)
+		}
+		for _, traf := range box.(*mp4.MoofBox).Trafs {
+			tfhd := traf.Tfhd
+			table := tables[tfhd.TrackID]
+			if table == nil {
+				continue
+			}
+			base := b.Start
+			if tfhd.HasBaseDataOffset() {
+				base = int64(tfhd.BaseDataOffset)
+			}
+			next := base
+			for _, trun := range traf.Truns {
+				trun.AddSampleDefaultValues(tfhd, trexs[tfhd.TrackID])
+				start := next
+				if trun.HasDataOffset() {
+					start = base + int64(trun.DataOffset)
+				}
+				size := int64(trun.SizeOfData())
+				if trun.SampleCount() == 0 {
+					continue
+				}
+				for _, s := range trun.Samples {
+					table.sizes = append(table.sizes, s.Size)
+					table.durs = append(table.durs, s.Dur)
+					table.ctos = append(table.ctos, s.CompositionTimeOffset)
+					// sample_is_non_sync_sample
+					table.nonSync = append(table.nonSync, s.Flags&0x00010000 != 0)
+				}
+				table.chunkN = append(table.chunkN, trun.SampleCount())
+				chunks = append(chunks, fragChunk{src: start, size: size, table: table})
+				total += size
+				next = start + size
+			}
+		}
+	}
+	if len(chunks) == 0 {
+		return errors.New("fragmented file has no samples")
+	}
+
+	hdrLen := int64(8)
+	if total+8 > math.MaxUint32 {
+		hdrLen = 16
+	}
+	pos := int64(len(ftyp)) + hdrLen
+	for _, c := range chunks {
+		c.table.offsets = append(c.table.offsets, uint64(pos))
+		pos += c.size
+	}
+
+	mvhdScale := uint64(1)
+	if moov.Mvhd != nil && moov.Mvhd.Timescale > 0 {
+		mvhdScale = uint64(moov.Mvhd.Timescale)
+	}
+	var movieDur uint64
+	for _, trak := range moov.Traks {
+		table := tables[trak.Tkhd.TrackID]
+		stbl, mediaDur := buildStbl(trak.Mdia.Minf.Stbl.Stsd, table)
+		minf := trak.Mdia.Minf
+		for i, c := range minf.Children {
+			if c.Type() == "stbl" {
+				minf.Children[i] = stbl
+			}
+		}
+		minf.Stbl = stbl
+		trak.Mdia.Mdhd.Duration = mediaDur
+		dur := mediaDur
+		if ts := uint64(trak.Mdia.Mdhd.Timescale); ts > 0 {
+			dur = mediaDur * mvhdScale / ts
+		}
+		trak.Tkhd.Duration = dur
+		if trak.Edts != nil {
+			for _, elst := range trak.Edts.Elst {
+				for i := range elst.Entries {
+					if elst.Entries[i].SegmentDuration == 0 && elst.Entries[i].MediaTime >= 0 {
+						elst.Entries[i].SegmentDuration = dur
+					}
+				}
+			}
+		}
+		if dur > movieDur {
+			movieDur = dur
+		}
+	}
+	if moov.Mvhd != nil {
+		moov.Mvhd.Duration = movieDur
+	}
+	kept := moov.Children[:0]
+	for _, c := range moov.Children {
+		if c.Type() != "mvex" {
+			kept = append(kept, c)
+		}
+	}
+	moov.Children = kept
+	moov.Mvex = nil
+	moovRaw, err := encodeMoov(moov, hasIlst)
+	if err != nil {
+		return err
+	}
+
+	if _, err := out.Write(ftyp); err != nil {
+		return err
+	}
+	hdr := make([]byte, hdrLen)
+	if hdrLen == 16 {
+		binary.BigEndian.PutUint32(hdr[0:4], 1)
+		binary.BigEndian.PutUint64(hdr[8:16], uint64(total+16))
+	} else {
+		binary.BigEndian.PutUint32(hdr[0:4], uint32(total+8))
+	}
+	copy(hdr[4:8], "mdat")
+	if _, err := out.Write(hdr); err != nil {
+		return err
+	}
+	for _, c := range chunks {
+		if _, err := io.Copy(out, io.NewSectionReader(f, c.src, c.size)); err != nil {
+			return err
+		}
+	}
+	_, err = out.Write(moovRaw)
+	return err
+}
+
+// buildStbl 由样本表生成 stts/ctts/stsc/stsz/stss/stco（或 co64），返回媒体总时长
+func buildStbl(stsd *mp4.StsdBox, t *trackTable) (*mp4.StblBox, uint64) {
+	stbl := mp4.NewStblBox()
+	stbl.AddChild(stsd)
+
+	stts := &mp4.SttsBox{}
+	var dur uint64
+	for i, d := range t.durs {
+		dur += uint64(d)
+		if i > 0 && d == stts.SampleTimeDelta[len(stts.SampleTimeDelta)-1] {
+			stts.SampleCount[len(stts.SampleCount)-1]++
+			continue
+		}
+		stts.SampleCount = append(stts.SampleCount, 1)
+		stts.SampleTimeDelta = append(stts.SampleTimeDelta, d)
+	}
+	stbl.AddChild(stts)
+
+	hasCto, negCto := false, false
+	for _, c := range t.ctos {
+		hasCto = hasCto || c != 0
+		negCto = negCto || c < 0
+	}
+	if hasCto {
+		var counts []uint32
+		var offs []int32
+		for i, c := range t.ctos {
+			if i > 0 && c == offs[len(offs)-1] {
+				counts[len(counts)-1]++
+				continue
+			}
+			counts = append(counts, 1)
+			offs = append(offs, c)
+		}
+		ctts := &mp4.CttsBox{}
+		if negCto {
+			ctts.Version = 1
+		}
+		_ = ctts.AddSampleCountsAndOffset(counts, offs)
+		stbl.AddChild(ctts)
+	}
+
+	stsc := &mp4.StscBox{}
+	for i, n := range t.chunkN {
+		if i > 0 && n == t.chunkN[i-1] {
+			continue
+		}
+		_ = stsc.AddEntry(uint32(i+1), n, 1)
+	}
+	stbl.AddChild(stsc)
+
+	stbl.AddChild(&mp4.StszBox{SampleNumber: uint32(len(t.sizes)), SampleSize: t.sizes})
+
+	var sync []uint32
+	anyNonSync := false
+	for i, ns := range t.nonSync {
+		if ns {
+			anyNonSync = true
+		} else {
+			sync = append(sync, uint32(i+1))
+		}
+	}
+	if anyNonSync {
+		stbl.AddChild(&mp4.StssBox{SampleNumber: sync})
+	}
+
+	large := len(t.offsets) > 0 && t.offsets[len(t.offsets)-1] > maxStcoOffset
+	if large {
+		stbl.AddChild(&mp4.Co64Box{ChunkOffset: t.offsets})
+	} else {
+		stco := &mp4.StcoBox{ChunkOffset: make([]uint32, len(t.offsets))}
+		for i, o := range t.offsets {
+			stco.ChunkOffset[i] = uint32(o)
+		}
+		stbl.AddChild(stco)
+	}
+	return stbl, dur
+}
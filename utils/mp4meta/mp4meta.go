@@ -0,0 +1,363 @@
+package mp4meta
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/Eyevinn/mp4ff/mp4"
+)
+
+// Info 描述一个 m4a 文件的音频参数与元数据原子概况
+type Info struct {
+	Codec      string `json:"codec"` // alac / mp4a / ec-3 / ac-3
+	SampleRate int    `json:"sampleRate"`
+	BitDepth   int    `json:"bitDepth"`
+	Channels   int    `json:"channels"`
+	DurationMs int64  `json:"durationMs"`
+	Fragmented bool   `json:"fragmented"`
+	HasMoov    bool   `json:"hasMoov"`
+	HasIlst    bool   `json:"hasIlst"`
+	HasCover   bool   `json:"hasCover"`
+	// Atoms 为 ilst 下各原子的原始 data 负载，键为 4 字节原子名，freeform 原子为 "----:KEY"；
+	// 多值原子的各个值以 0 字节分隔
+	Atoms map[string][]byte `json:"-"`
+}
+
+type boxHeader struct {
+	Type   string
+	Start  int64
+	Header int64
+	Size   int64
+}
+
+// readTopBoxes 只读取顶层 box 的头部，不把 mdat 读入内存
+func readTopBoxes(f *os.File, fileSize int64) ([]boxHeader, error) {
+	var boxes []boxHeader
+	var pos int64
+	buf := make([]byte, 16)
+	for pos+8 <= fileSize {
+		if _, err := f.ReadAt(buf[:8], pos); err != nil {
+			return nil, err
+		}
+		size := int64(binary.BigEndian.Uint32(buf[:4]))
+		typ := string(buf[4:8])
+		hdr := int64(8)
+		switch size {
+		case 1:
+			if _, err := f.ReadAt(buf[8:16], pos+8); err != nil {
+				return nil, err
+			}
+			size = int64(binary.BigEndian.Uint64(buf[8:16]))
+			hdr = 16
+		case 0:
+			size = fileSize - pos
+		}
+		if size < hdr || pos+size > fileSize {
+			return boxes, fmt.Errorf("truncated %s box at offset %d", typ, pos)
+		}
+		boxes = append(boxes, boxHeader{Type: typ, Start: pos, Header: hdr, Size: size})
+		pos += size
+	}
+	return boxes, nil
+}
+
+func readBox(f *os.File, b boxHeader) ([]byte, error) {
+	data := make([]byte, b.Size)
+	if _, err := f.ReadAt(data, b.Start); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// Probe 解析文件的 box 结构，返回编码、采样率、位深、时长以及 ilst 中的原子
+func Probe(path string) (*Info, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	st, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	tops, err := readTopBoxes(f, st.Size())
+	if err != nil {
+		return nil, err
+	}
+	info := &Info{Atoms: map[string][]byte{}}
+	var moov *mp4.MoovBox
+	var moovRaw []byte
+	for _, b := range tops {
+		if b.Type != "moov" {
+			continue
+		}
+		moovRaw, err = readBox(f, b)
+		if err != nil {
+			return nil, err
+		}
+		box, err := mp4.DecodeBox(0, bytes.NewReader(moovRaw))
+		if err != nil {
+			return nil, fmt.Errorf("decode moov: %w", err)
+		}
+		moov = box.(*mp4.MoovBox)
+		info.HasMoov = true
+		break
+	}
+	if moov == nil {
+		return info, errors.New("moov box not present")
+	}
+
+	trak := audioTrak(moov)
+	if trak == nil {
+		return info, errors.New("no audio track found")
+	}
+	if err := checkTrak(trak); err != nil {
+		return info, err
+	}
+	if stsd := trak.Mdia.Minf.Stbl.Stsd; stsd != nil && len(stsd.Children) > 0 {
+		parseSampleEntry(stsd.Children[0], info)
+	}
+
+	timescale := uint64(trak.Mdia.Mdhd.Timescale)
+	duration := trak.Mdia.Mdhd.Duration
+	info.Fragmented = moov.Mvex != nil
+	if info.Fragmented && duration == 0 {
+		duration, err = fragmentedDuration(f, tops, moov, trak)
+		if err != nil {
+			return info, err
+		}
+	}
+	if timescale > 0 {
+		info.DurationMs = int64(duration * 1000 / timescale)
+	}
+
+	if ilst := findPath(moovRaw, "moov", "udta", "meta", "ilst"); ilst != nil {
+		info.HasIlst = true
+		for _, c := range children(ilst.data[:ilst.end], ilst.body) {
+			// freeform 原子以 "----:KEY" 为键
+			name := atomIdent(c)
+			var values [][]byte
+			for _, d := range children(c.data[:c.end], c.body) {
+				if d.typ == "data" && d.end-d.body >= 8 {
+					values = append(values, c.data[d.body+8:d.end])
+				}
+			}
+			if values != nil {
+				info.Atoms[name] = bytes.Join(values, []byte{0})
+			}
+		}
+		_, info.HasCover = info.Atoms["covr"]
+	}
+	return info, nil
+}
+
+func audioTrak(moov *mp4.MoovBox) *mp4.TrakBox {
+	for _, t := range moov.Traks {
+		if t.Mdia != nil && t.Mdia.Hdlr != nil && t.Mdia.Hdlr.HandlerType == "soun" {
+			return t
+		}
+	}
+	return nil
+}
+
+// checkTrak 确认轨道带有解析和重排所需的 tkhd/mdhd/stbl，缺失时返回错误而不是在解引用时 panic
+func checkTrak(t *mp4.TrakBox) error {
+	switch {
+	case t.Tkhd == nil:
+		return errors.New("tkhd box not present")
+	case t.Mdia == nil || t.Mdia.Mdhd == nil:
+		return errors.New("mdhd box not present")
+	case t.Mdia.Minf == nil || t.Mdia.Minf.Stbl == nil:
+		return errors.New("stbl box not present")
+	}
+	return nil
+}
+
+// parseSampleEntry 读取 stsd 的首个条目；alac 不在 mp4ff 的解码表中，需要手动解析 magic cookie
+func parseSampleEntry(entry mp4.Box, info *Info) {
+	info.Codec = entry.Type()
+	if ase, ok := entry.(*mp4.AudioSampleEntryBox); ok {
+		info.Channels = int(ase.ChannelCount)
+		info.SampleRate = int(ase.SampleRate)
+		info.BitDepth = int(ase.SampleSize)
+		return
+	}
+	var buf bytes.Buffer
+	if err := entry.Encode(&buf); err != nil {
+		return
+	}
+	raw := buf.Bytes()
+	// 8 字节头 + 28 字节 AudioSampleEntry 固定字段
+	if len(raw) < 36 {
+		return
+	}
+	info.Channels = int(binary.BigEndian.Uint16(raw[24:26]))
+	info.BitDepth = int(binary.BigEndian.Uint16(raw[26:28]))
+	info.SampleRate = int(binary.BigEndian.Uint16(raw[32:34]))
+	if info.Codec != "alac" {
+		return
+	}
+	for _, c := range children(raw, 36) {
+		// alac 为 full box：4 字节 version/flags 之后是 24 字节的 ALACSpecificConfig
+		if c.typ == "alac" && c.end-c.body >= 28 {
+			cfg := raw[c.body+4 : c.end]
+			info.BitDepth = int(cfg[5])
+			info.Channels = int(cfg[9])
+			info.SampleRate = int(binary.BigEndian.Uint32(cfg[20:24]))
+		}
+	}
+}
+
+// fragmentedDuration 累加所有 moof 中该轨道的样本时长
+func fragmentedDuration(f *os.File, tops []boxHeader, moov *mp4.MoovBox, trak *mp4.TrakBox) (uint64, error) {
+	trackID := trak.Tkhd.TrackID
+	var trex *mp4.TrexBox
+	for _, t := range moov.Mvex.Trexs {
+		if t.TrackID == trackID {
+			trex = t
+		}
+	}
+	if moov.Mvex.Mehd != nil && moov.Mvex.Mehd.FragmentDuration > 0 && moov.Mvhd != nil && moov.Mvhd.Timescale > 0 {
+		return uint64(moov.Mvex.Mehd.FragmentDuration) * uint64(trak.Mdia.Mdhd.Timescale) / uint64(moov.Mvhd.Timescale), nil
+	}
+	var total uint64
+	for _, b := range tops {
+		if b.Type != "moof" {
+			continue
+		}
+		raw, err := readBox(f, b)
+		if err != nil {
+			return 0, err
+		}
+		box, err := mp4.DecodeBox(uint64(b.Start), bytes.NewReader(raw))
+		if err != nil {
+			return 0, fmt.Errorf("decode moof: %w", err)
+		}
+		for _, traf := range box.(*mp4.MoofBox).Trafs {
+			if traf.Tfhd == nil || traf.Tfhd.TrackID != trackID {
+				continue
+			}
+			for _, trun := range traf.Truns {
+				total += trun.AddSampleDefaultValues(traf.Tfhd, trex)
+			}
+		}
+	}
+	return total, nil
+}
+
+// rawBox 是在字节切片中定位到的一个 box；body 为负载起始偏移
+type rawBox struct {
+	typ   string
+	data  []byte
+	start int
+	body  int
+	end   int
+}
+
+// children 列出 data[off:] 范围内的子 box（不越过父 box 末尾）
+func children(data []byte, off int) []rawBox {
+	var out []rawBox
+	for off+8 <= len(data) {
+		size := int(binary.BigEndian.Uint32(data[off : off+4]))
+		typ := string(data[off+4 : off+8])
+		hdr := 8
+		if size == 1 {
+			if off+16 > len(data) {
+				break
+			}
+			size = int(binary.BigEndian.Uint64(data[off+8 : off+16]))
+			hdr = 16
+		} else if size == 0 {
+			size = len(data) - off
+		}
+		if size < hdr || off+size > len(data) {
+			break
+		}
+		out = append(out, rawBox{typ: typ, data: data, start: off, body: off + hdr, end: off + size})
+		off += size
+	}
+	return out
+}
+
+// childOffset 返回容器 box 中第一个子 box 的偏移；meta 在 ISO 格式下是 full box
+func childOffset(b rawBox) int {
+	if b.typ == "meta" && b.end-b.body >= 8 && string(b.data[b.body+4:b.body+8]) != "hdlr" {
+		return b.body + 4
+	}
+	return b.body
+}
+
+// findPath 在 data（以 path[0] 为根 box）中按路径查找 box
+func findPath(data []byte, path ...string) *rawBox {
+	cur := children(data, 0)
+	var found *rawBox
+	for _, name := range path {
+		found = nil
+		for i := range cur {
+			if cur[i].typ == name {
+				found = &cur[i]
+				break
+			}
+		}
+		if found == nil {
+			return nil
+		}
+		cur = children(data[:found.end], childOffset(*found))
+	}
+	return found
+}
+
+// Expect 描述下载结果应满足的条件；零值字段不参与校验
+type Expect struct {
+	Codecs      []string // 允许的编码，例如 alac / mp4a / ec-3
+	SampleRate  int
+	BitDepth    int
+	DurationMs  int64 // 目录中的时长（DurationInMillis）
+	ToleranceMs int64
+	Cover       bool
+}
+
+// Verify 解析文件并与 exp 比对，返回第一个不满足的条件
+func Verify(path string, exp Expect) (*Info, error) {
+	info, err := Probe(path)
+	if err != nil {
+		return info, fmt.Errorf("parse mp4: %w", err)
+	}
+	if info.DurationMs <= 0 {
+		return info, errors.New("audio track has zero duration")
+	}
+	if len(exp.Codecs) > 0 {
+		ok := false
+		for _, c := range exp.Codecs {
+			if c == info.Codec {
+				ok = true
+				break
+			}
+		}
+		if !ok {
+			return info, fmt.Errorf("codec %q does not match expected %v", info.Codec, exp.Codecs)
+		}
+	}
+	if exp.SampleRate > 0 && info.SampleRate != exp.SampleRate {
+		return info, fmt.Errorf("sample rate %d Hz does not match expected %d Hz", info.SampleRate, exp.SampleRate)
+	}
+	if exp.BitDepth > 0 && info.BitDepth != exp.BitDepth {
+		return info, fmt.Errorf("bit depth %d does not match expected %d", info.BitDepth, exp.BitDepth)
+	}
+	if exp.DurationMs > 0 {
+		diff := info.DurationMs - exp.DurationMs
+		if diff < 0 {
+			diff = -diff
+		}
+		if diff > exp.ToleranceMs {
+			return info, fmt.Errorf("duration %dms differs from expected %dms by more than %dms", info.DurationMs, exp.DurationMs, exp.ToleranceMs)
+		}
+	}
+	if exp.Cover && !info.HasCover {
+		return info, errors.New("cover art (covr) atom missing")
+	}
+	return info, nil
+}
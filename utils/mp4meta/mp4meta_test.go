@@ -0,0 +1,466 @@
+package mp4meta
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/Eyevinn/mp4ff/aac"
+	"github.com/Eyevinn/mp4ff/mp4"
+)
+
+const (
+	testTimescale = 44100
+	testSampleDur = 1024
+)
+
+// testPayloads 生成 n 个大小、内容各不相同的样本
+func testPayloads(n int) [][]byte {
+	out := make([][]byte, n)
+	for i := range out {
+		out[i] = bytes.Repeat([]byte{byte(i + 1)}, 20+i*3)
+	}
+	return out
+}
+
+// audioInit 构造只有一条 AAC 轨道的 init segment
+func audioInit(t *testing.T) *mp4.InitSegment {
+	t.Helper()
+	init := mp4.CreateEmptyInit()
+	init.AddEmptyTrack(testTimescale, "audio", "und")
+	if err := init.Moov.Trak.SetAACDescriptor(aac.AAClc, testTimescale); err != nil {
+		t.Fatal(err)
+	}
+	return init
+}
+
+// writeFragmented 写出 ftyp/moov 之后跟随若干 moof/mdat 的分片文件，每个分片 perFrag 个样本
+func writeFragmented(t *testing.T, path string, payloads [][]byte, perFrag int) {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := audioInit(t).Encode(&buf); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < len(payloads); i += perFrag {
+		frag, err := mp4.CreateFragment(uint32(i/perFrag+1), 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for j := i; j < i+perFrag && j < len(payloads); j++ {
+			frag.AddFullSample(mp4.FullSample{
+				Sample:     mp4.Sample{Flags: mp4.SyncSampleFlags, Dur: testSampleDur, Size: uint32(len(payloads[j]))},
+				DecodeTime: uint64(j * testSampleDur),
+				Data:       payloads[j],
+			})
+		}
+		if err := frag.Encode(&buf); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.WriteFile(path, buf.Bytes(), 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// writeMoovFirst 写出 ftyp/moov/free/mdat 布局的普通文件，每个 chunk perChunk 个样本，偏移用 stco
+func writeMoovFirst(t *testing.T, path string, payloads [][]byte, perChunk int) {
+	t.Helper()
+	init := audioInit(t)
+	moov := init.Moov
+	kept := moov.Children[:0]
+	for _, c := range moov.Children {
+		if c.Type() != "mvex" {
+			kept = append(kept, c)
+		}
+	}
+	moov.Children, moov.Mvex = kept, nil
+
+	trak := moov.Trak
+	stbl := trak.Mdia.Minf.Stbl
+	var sizes []uint32
+	var mdat []byte
+	for _, p := range payloads {
+		sizes = append(sizes, uint32(len(p)))
+		mdat = append(mdat, p...)
+	}
+	stbl.Stts.SampleCount = []uint32{uint32(len(payloads))}
+	stbl.Stts.SampleTimeDelta = []uint32{testSampleDur}
+	if err := stbl.Stsc.AddEntry(1, uint32(perChunk), 1); err != nil {
+		t.Fatal(err)
+	}
+	stbl.Stsz.SampleNumber, stbl.Stsz.SampleSize = uint32(len(sizes)), sizes
+	nChunks := (len(payloads) + perChunk - 1) / perChunk
+	stbl.Stco.ChunkOffset = make([]uint32, nChunks)
+	dur := uint64(len(payloads) * testSampleDur)
+	trak.Mdia.Mdhd.Duration = dur
+	trak.Tkhd.Duration = dur * uint64(moov.Mvhd.Timescale) / testTimescale
+	moov.Mvhd.Duration = trak.Tkhd.Duration
+
+	free := []byte{0, 0, 0, 16, 'f', 'r', 'e', 'e', 0, 0, 0, 0, 0, 0, 0, 0}
+	// chunk 偏移依赖 moov 的大小，而 stco 条目数已定，先算出 mdat 的位置再填入
+	dataStart := init.Ftyp.Size() + moov.Size() + uint64(len(free)) + 8
+	off := dataStart
+	for i := range stbl.Stco.ChunkOffset {
+		stbl.Stco.ChunkOffset[i] = uint32(off)
+		for j := i * perChunk; j < (i+1)*perChunk && j < len(sizes); j++ {
+			off += uint64(sizes[j])
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := init.Encode(&buf); err != nil {
+		t.Fatal(err)
+	}
+	buf.Write(free)
+	buf.Write(binary.BigEndian.AppendUint32(nil, uint32(8+len(mdat))))
+	buf.WriteString("mdat")
+	buf.Write(mdat)
+	if uint64(buf.Len()) != dataStart+uint64(len(mdat)) {
+		t.Fatalf("fixture layout: size %d, want %d", buf.Len(), dataStart+uint64(len(mdat)))
+	}
+	if err := os.WriteFile(path, buf.Bytes(), 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// readSamples 按 sample table 读出每个样本的偏移与内容
+func readSamples(t *testing.T, path string) ([]uint64, [][]byte, *mp4.StblBox) {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := mp4.DecodeFile(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.Moov == nil || f.Moov.Mvex != nil {
+		t.Fatalf("%s is not a progressive file", filepath.Base(path))
+	}
+	trak := f.Moov.Trak
+	var offsets []uint64
+	var samples [][]byte
+	for nr := uint32(1); nr <= trak.GetNrSamples(); nr++ {
+		r, err := trak.GetRangesForSampleInterval(nr, nr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if end := r[0].Offset + r[0].Size; end > uint64(len(data)) {
+			t.Fatalf("sample %d ends at %d, past end of file %d", nr, end, len(data))
+		}
+		offsets = append(offsets, r[0].Offset)
+		samples = append(samples, data[r[0].Offset:r[0].Offset+r[0].Size])
+	}
+	return offsets, samples, trak.Mdia.Minf.Stbl
+}
+
+func equalSamples(t *testing.T, got, want [][]byte) {
+	t.Helper()
+	if len(got) != len(want) {
+		t.Fatalf("%d samples, want %d", len(got), len(want))
+	}
+	for i := range want {
+		if !bytes.Equal(got[i], want[i]) {
+			t.Fatalf("sample %d differs", i+1)
+		}
+	}
+}
+
+func equalOffsets(t *testing.T, got, want []uint64) {
+	t.Helper()
+	if len(got) != len(want) {
+		t.Fatalf("%d sample offsets, want %d", len(got), len(want))
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("sample %d offset %d, want %d", i+1, got[i], want[i])
+		}
+	}
+}
+
+func probe(t *testing.T, path string) *Info {
+	t.Helper()
+	info, err := Probe(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return info
+}
+
+// topTypes 列出顶层 box 的类型
+func topTypes(t *testing.T, path string) []string {
+	t.Helper()
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	st, err := f.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tops, err := readTopBoxes(f, st.Size())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out []string
+	for _, b := range tops {
+		out = append(out, b.Type)
+	}
+	return out
+}
+
+// setAtoms 调用 SetAtoms，并检查时长与样本偏移都没有变化
+func setAtoms(t *testing.T, path string, set []Atom, remove []string) *Info {
+	t.Helper()
+	before := probe(t, path)
+	offsets, samples, _ := readSamples(t, path)
+	if err := SetAtoms(path, set, remove); err != nil {
+		t.Fatal(err)
+	}
+	after := probe(t, path)
+	if after.DurationMs != before.DurationMs {
+		t.Fatalf("duration %dms after SetAtoms, want %dms", after.DurationMs, before.DurationMs)
+	}
+	gotOffsets, gotSamples, _ := readSamples(t, path)
+	equalOffsets(t, gotOffsets, offsets)
+	equalSamples(t, gotSamples, samples)
+	return after
+}
+
+func TestPrepareFragmented(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "frag.m4a")
+	payloads := testPayloads(10)
+	writeFragmented(t, path, payloads, 4)
+	before := probe(t, path)
+	if !before.Fragmented || before.DurationMs == 0 {
+		t.Fatalf("fixture: fragmented %v, duration %dms", before.Fragmented, before.DurationMs)
+	}
+
+	if err := Prepare(path); err != nil {
+		t.Fatal(err)
+	}
+	after := probe(t, path)
+	if after.Fragmented || !after.HasIlst {
+		t.Fatalf("after Prepare: fragmented %v, ilst %v", after.Fragmented, after.HasIlst)
+	}
+	if after.DurationMs != before.DurationMs {
+		t.Fatalf("duration %dms after Prepare, want %dms", after.DurationMs, before.DurationMs)
+	}
+	if got := topTypes(t, path); len(got) != 3 || got[0] != "ftyp" || got[1] != "mdat" || got[2] != "moov" {
+		t.Fatalf("top-level boxes %v", got)
+	}
+	_, samples, stbl := readSamples(t, path)
+	equalSamples(t, samples, payloads)
+	// 每个 trun 一个 chunk：4+4+2
+	if stbl.Stco == nil || len(stbl.Stco.ChunkOffset) != 3 {
+		t.Fatalf("stco %+v", stbl.Stco)
+	}
+
+	setAtoms(t, path, []Atom{TextAtom("\xa9nam", "Song")}, nil)
+}
+
+func TestPrepareMovesMoovLast(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "moovfirst.m4a")
+	payloads := testPayloads(9)
+	writeMoovFirst(t, path, payloads, 4)
+	offsets, samples, _ := readSamples(t, path)
+	equalSamples(t, samples, payloads)
+	before := probe(t, path)
+
+	if err := Prepare(path); err != nil {
+		t.Fatal(err)
+	}
+	if got := topTypes(t, path); len(got) != 3 || got[1] != "mdat" || got[2] != "moov" {
+		t.Fatalf("top-level boxes %v", got)
+	}
+	after := probe(t, path)
+	if after.DurationMs != before.DurationMs || !after.HasIlst {
+		t.Fatalf("after Prepare: duration %dms (want %dms), ilst %v", after.DurationMs, before.DurationMs, after.HasIlst)
+	}
+	gotOffsets, gotSamples, stbl := readSamples(t, path)
+	equalSamples(t, gotSamples, payloads)
+	if stbl.Stco == nil || stbl.Co64 != nil {
+		t.Fatal("small offsets should stay in stco")
+	}
+	if gotOffsets[0] >= offsets[0] {
+		t.Fatalf("first sample at %d, want it to move before %d", gotOffsets[0], offsets[0])
+	}
+
+	// 已整理好的文件不再改写
+	prepared, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := Prepare(path); err != nil {
+		t.Fatal(err)
+	}
+	if again, _ := os.ReadFile(path); !bytes.Equal(again, prepared) {
+		t.Fatal("Prepare rewrote an already prepared file")
+	}
+}
+
+func TestPrepareUpgradesStcoToCo64(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "co64.m4a")
+	payloads := testPayloads(9)
+	writeMoovFirst(t, path, payloads, 4)
+	before := probe(t, path)
+
+	defer func(v uint64) { maxStcoOffset = v }(maxStcoOffset)
+	maxStcoOffset = 40
+	if err := Prepare(path); err != nil {
+		t.Fatal(err)
+	}
+	offsets, samples, stbl := readSamples(t, path)
+	if stbl.Stco != nil || stbl.Co64 == nil {
+		t.Fatalf("stco %v, co64 %v; want co64 only", stbl.Stco != nil, stbl.Co64 != nil)
+	}
+	if offsets[len(offsets)-1] <= maxStcoOffset {
+		t.Fatalf("fixture: last offset %d does not exceed %d", offsets[len(offsets)-1], maxStcoOffset)
+	}
+	equalSamples(t, samples, payloads)
+	if after := probe(t, path); after.DurationMs != before.DurationMs {
+		t.Fatalf("duration %dms after Prepare, want %dms", after.DurationMs, before.DurationMs)
+	}
+
+	setAtoms(t, path, []Atom{TextAtom("\xa9ART", "Artist")}, nil)
+}
+
+func TestSetAtoms64BitInt(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "int.m4a")
+	writeMoovFirst(t, path, testPayloads(6), 3)
+	if err := Prepare(path); err != nil {
+		t.Fatal(err)
+	}
+
+	const id = 1<<40 + 7
+	info := setAtoms(t, path, []Atom{IntAtom("plID", id, 4), IntAtom("cnID", 1234, 4)}, nil)
+	if got := info.Atoms["plID"]; len(got) != 8 || binary.BigEndian.Uint64(got) != id {
+		t.Fatalf("plID = %x, want 8-byte %d", got, uint64(id))
+	}
+	if got := info.Atoms["cnID"]; len(got) != 4 || binary.BigEndian.Uint32(got) != 1234 {
+		t.Fatalf("cnID = %x, want 4-byte 1234", got)
+	}
+
+	// 再次写入同名原子会替换而不是追加
+	info = setAtoms(t, path, []Atom{IntAtom("plID", 5, 8)}, nil)
+	if got := info.Atoms["plID"]; len(got) != 8 || binary.BigEndian.Uint64(got) != 5 {
+		t.Fatalf("plID = %x, want 8-byte 5", got)
+	}
+	if _, ok := info.Atoms["cnID"]; !ok {
+		t.Fatal("cnID dropped by an unrelated SetAtoms")
+	}
+}
+
+// ilstValues 直接读取 ilst，按 SetAtoms 的匹配标识返回各原子的值（多值以 0 字节分隔）
+func ilstValues(t *testing.T, path string) map[string]string {
+	t.Helper()
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	st, err := f.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tops, err := readTopBoxes(f, st.Size())
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := map[string]string{}
+	for _, b := range tops {
+		if b.Type != "moov" {
+			continue
+		}
+		raw, err := readBox(f, b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ilst := findPath(raw, "moov", "udta", "meta", "ilst")
+		if ilst == nil {
+			t.Fatal("ilst box not present")
+		}
+		for _, c := range children(raw[:ilst.end], ilst.body) {
+			var values []string
+			for _, d := range children(raw[:c.end], c.body) {
+				if d.typ == "data" && d.end-d.body >= 8 {
+					values = append(values, string(raw[d.body+8:d.end]))
+				}
+			}
+			out[atomIdent(c)] = strings.Join(values, "\x00")
+		}
+	}
+	return out
+}
+
+func TestSetAtomsRemoveFreeform(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "freeform.m4a")
+	writeFragmented(t, path, testPayloads(8), 3)
+	if err := Prepare(path); err != nil {
+		t.Fatal(err)
+	}
+
+	setAtoms(t, path, []Atom{
+		FreeformAtom("ISRC", "USAB12345678", "USAB87654321"),
+		FreeformAtom("LABEL", "Label"),
+		TextAtom("\xa9nam", "Song"),
+	}, nil)
+	if got := ilstValues(t, path)["----:ISRC"]; got != "USAB12345678\x00USAB87654321" {
+		t.Fatalf("ISRC = %q", got)
+	}
+
+	setAtoms(t, path, nil, []string{"----:ISRC"})
+	atoms := ilstValues(t, path)
+	if _, ok := atoms["----:ISRC"]; ok {
+		t.Fatal("----:ISRC still present")
+	}
+	if got := atoms["----:LABEL"]; got != "Label" {
+		t.Fatalf("LABEL = %q", got)
+	}
+	if got := atoms["\xa9nam"]; got != "Song" {
+		t.Fatalf("\xa9nam = %q", got)
+	}
+}
+
+func TestSetAtomsTrackNumber(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "trkn.m4a")
+	writeFragmented(t, path, testPayloads(8), 3)
+	if err := Prepare(path); err != nil {
+		t.Fatal(err)
+	}
+	setAtoms(t, path, []Atom{TrackNumberAtom(3, 12)}, nil)
+	setAtoms(t, path, []Atom{TrackNumberAtom(7, 12)}, nil)
+	if got, want := ilstValues(t, path)["trkn"], "\x00\x00\x00\x07\x00\x0c\x00\x00"; got != want {
+		t.Fatalf("trkn = %q, want %q", got, want)
+	}
+}
+
+func TestMissingMdhd(t *testing.T) {
+	init := audioInit(t)
+	mdia := init.Moov.Trak.Mdia
+	kept := mdia.Children[:0]
+	for _, c := range mdia.Children {
+		if c.Type() != "mdhd" {
+			kept = append(kept, c)
+		}
+	}
+	mdia.Children, mdia.Mdhd = kept, nil
+	var buf bytes.Buffer
+	if err := init.Encode(&buf); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "nomdhd.m4a")
+	if err := os.WriteFile(path, buf.Bytes(), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Probe(path); err == nil || !strings.Contains(err.Error(), "mdhd") {
+		t.Fatalf("Probe error %v, want missing mdhd", err)
+	}
+	if err := Prepare(path); err == nil || !strings.Contains(err.Error(), "mdhd") {
+		t.Fatalf("Prepare error %v, want missing mdhd", err)
+	}
+}
@@ -0,0 +1,119 @@
+package nfo
+
+import (
+	"encoding/xml"
+	"html"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+const (
+	AlbumName  = "album.nfo"
+	ArtistName = "artist.nfo"
+)
+
+// Thumb 对应 Kodi 的 <thumb aspect="...">url</thumb>
+type Thumb struct {
+	Aspect string `xml:"aspect,attr,omitempty"`
+	URL    string `xml:",chardata"`
+}
+
+// AlbumArtist 对应 <albumArtistCredits>
+type AlbumArtist struct {
+	Artist string `xml:"artist"`
+	// 没有 MusicBrainz id，这里写 Apple Music 的艺人 id
+	AppleMusicID string `xml:"applemusicartistid,omitempty"`
+}
+
+// Track 是 album.nfo 中的一首曲目；duration 为 mm:ss
+type Track struct {
+	Disc     int    `xml:"disc,omitempty"`
+	Position int    `xml:"position"`
+	Title    string `xml:"title"`
+	Duration string `xml:"duration,omitempty"`
+	ISRC     string `xml:"isrc,omitempty"`
+}
+
+// Album 按 Kodi 的 album.nfo 格式输出；Apple Music id 与 UPC 以额外元素保存
+type Album struct {
+	XMLName      xml.Name      `xml:"album"`
+	Title        string        `xml:"title"`
+	ArtistDesc   string        `xml:"artistdesc,omitempty"`
+	Genres       []string      `xml:"genre"`
+	Compilation  bool          `xml:"compilation"`
+	ReleaseType  string        `xml:"releasetype,omitempty"`
+	Review       string        `xml:"review,omitempty"`
+	ReleaseDate  string        `xml:"releasedate,omitempty"`
+	Year         string        `xml:"year,omitempty"`
+	Label        string        `xml:"label,omitempty"`
+	Copyright    string        `xml:"copyright,omitempty"`
+	UPC          string        `xml:"upc,omitempty"`
+	AppleMusicID string        `xml:"applemusicalbumid,omitempty"`
+	URL          string        `xml:"url,omitempty"`
+	Thumbs       []Thumb       `xml:"thumb"`
+	Artists      []AlbumArtist `xml:"albumArtistCredits"`
+	Tracks       []Track       `xml:"track"`
+}
+
+// Artist 按 Kodi 的 artist.nfo 格式输出
+type Artist struct {
+	XMLName      xml.Name `xml:"artist"`
+	Name         string   `xml:"name"`
+	Type         string   `xml:"type,omitempty"` // Person / Group
+	Genres       []string `xml:"genre"`
+	Biography    string   `xml:"biography,omitempty"`
+	Born         string   `xml:"born,omitempty"`
+	Formed       string   `xml:"formed,omitempty"`
+	Origin       string   `xml:"origin,omitempty"`
+	AppleMusicID string   `xml:"applemusicartistid,omitempty"`
+	URL          string   `xml:"url,omitempty"`
+	Thumbs       []Thumb  `xml:"thumb"`
+}
+
+var (
+	breakTag  = regexp.MustCompile(`(?i)<br\s*/?>|</p>`)
+	anyTag    = regexp.MustCompile(`<[^>]+>`)
+	boldTag   = regexp.MustCompile(`(?i)</?(b|strong)>`)
+	italicTag = regexp.MustCompile(`(?i)</?(i|em)>`)
+	blankRun  = regexp.MustCompile(`\n{3,}`)
+)
+
+// PlainText 去掉编辑推荐/简介中的 HTML 标记，<br> 与段落转换为换行
+func PlainText(s string) string {
+	s = breakTag.ReplaceAllString(s, "\n")
+	s = anyTag.ReplaceAllString(s, "")
+	return strings.TrimSpace(html.UnescapeString(s))
+}
+
+// Markdown 把编辑推荐/简介转换为 Markdown：保留粗体与斜体，<br> 与段落转换为空行分隔的段落
+func Markdown(s string) string {
+	s = boldTag.ReplaceAllString(s, "**")
+	s = italicTag.ReplaceAllString(s, "*")
+	s = breakTag.ReplaceAllString(s, "\n\n")
+	s = anyTag.ReplaceAllString(s, "")
+	s = blankRun.ReplaceAllString(html.UnescapeString(s), "\n\n")
+	return strings.TrimSpace(s)
+}
+
+// Write 把 v 编码为带 XML 声明的 nfo 文件，先写 .part 再替换
+func Write(path string, v any) error {
+	data, err := xml.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+		return err
+	}
+	tmp := path + ".part"
+	out := append([]byte(xml.Header), data...)
+	if err := os.WriteFile(tmp, append(out, '\n'), 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,116 @@
+package playlistfile
+
+import (
+	"encoding/xml"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Entry 是播放列表中的一首曲目；Path 为文件的绝对路径，写入时转换为相对于播放列表文件的路径
+type Entry struct {
+	Path       string
+	Title      string
+	Artist     string
+	Album      string
+	DurationMs int
+}
+
+// Write 按 format（m3u8 / xspf）在 path 写入播放列表，先写 .part 再替换
+func Write(path, format, title string, entries []Entry) error {
+	var data []byte
+	var err error
+	switch format {
+	case "m3u8":
+		data = m3u8(path, title, entries)
+	case "xspf":
+		data, err = xspf(path, title, entries)
+	default:
+		err = fmt.Errorf("unknown playlist format %q", format)
+	}
+	if err != nil {
+		return err
+	}
+	tmp := path + ".part"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+// relPath 返回 p 相对于播放列表所在目录的路径，统一使用 /；不在同一卷上时保留绝对路径
+func relPath(listPath, p string) string {
+	rel, err := filepath.Rel(filepath.Dir(listPath), p)
+	if err != nil {
+		rel = p
+	}
+	return filepath.ToSlash(rel)
+}
+
+func m3u8(path, title string, entries []Entry) []byte {
+	var b strings.Builder
+	b.WriteString("#EXTM3U\n")
+	if title != "" {
+		b.WriteString("#PLAYLIST:" + title + "\n")
+	}
+	for _, e := range entries {
+		secs := -1
+		if e.DurationMs > 0 {
+			secs = (e.DurationMs + 500) / 1000
+		}
+		name := e.Title
+		if e.Artist != "" {
+			name = e.Artist + " - " + e.Title
+		}
+		// #EXTINF 的标题到行尾为止，去掉换行
+		name = strings.NewReplacer("\r", " ", "\n", " ").Replace(name)
+		fmt.Fprintf(&b, "#EXTINF:%d,%s\n%s\n", secs, name, relPath(path, e.Path))
+	}
+	return []byte(b.String())
+}
+
+type xspfTrack struct {
+	Location string `xml:"location"`
+	Title    string `xml:"title,omitempty"`
+	Creator  string `xml:"creator,omitempty"`
+	Album    string `xml:"album,omitempty"`
+	Duration int    `xml:"duration,omitempty"`
+}
+
+type xspfPlaylist struct {
+	XMLName xml.Name    `xml:"playlist"`
+	Version string      `xml:"version,attr"`
+	Xmlns   string      `xml:"xmlns,attr"`
+	Title   string      `xml:"title,omitempty"`
+	Tracks  []xspfTrack `xml:"trackList>track"`
+}
+
+func xspf(path, title string, entries []Entry) ([]byte, error) {
+	pl := xspfPlaylist{Version: "1", Xmlns: "http://xspf.org/ns/0/", Title: title}
+	for _, e := range entries {
+		// location 是相对 URI，按路径段转义
+		loc := (&url.URL{Path: relPath(path, e.Path)}).EscapedPath()
+		if first, _, _ := strings.Cut(loc, "/"); strings.Contains(first, ":") {
+			// 避免第一段中的冒号被当作 scheme
+			loc = "./" + loc
+		}
+		pl.Tracks = append(pl.Tracks, xspfTrack{
+			Location: loc,
+			Title:    e.Title,
+			Creator:  e.Artist,
+			Album:    e.Album,
+			Duration: e.DurationMs,
+		})
+	}
+	data, err := xml.MarshalIndent(pl, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append(append([]byte(xml.Header), data...), '\n'), nil
+}
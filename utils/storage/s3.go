@@ -0,0 +1,148 @@
+package storage
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"main/utils/structs"
+)
+
+// S3 uploads objects to an S3-compatible service (AWS, MinIO, R2 ...) using
+// Signature V4 with an unsigned payload. Path-style addressing is the default
+// so a local MinIO or an httptest server can be used as the endpoint.
+type S3 struct {
+	Endpoint    *url.URL
+	Region      string
+	Bucket      string
+	AccessKey   string
+	SecretKey   string
+	VirtualHost bool
+	Client      *http.Client
+	now         func() time.Time
+}
+
+func NewS3(cfg structs.S3Config) (*S3, error) {
+	if cfg.Endpoint == "" || cfg.Bucket == "" {
+		return nil, errors.New("s3: endpoint and bucket are required")
+	}
+	u, err := url.Parse(strings.TrimRight(cfg.Endpoint, "/"))
+	if err != nil {
+		return nil, fmt.Errorf("s3: bad endpoint: %w", err)
+	}
+	region := cfg.Region
+	if region == "" {
+		region = "us-east-1"
+	}
+	return &S3{
+		Endpoint:    u,
+		Region:      region,
+		Bucket:      cfg.Bucket,
+		AccessKey:   cfg.AccessKey,
+		SecretKey:   cfg.SecretKey,
+		VirtualHost: cfg.VirtualHost,
+		Client:      http.DefaultClient,
+		now:         time.Now,
+	}, nil
+}
+
+func (s *S3) Name() string { return "s3://" + s.Bucket }
+
+// objectURL 返回对象地址；path 部分按 S3 规则逐段编码
+func (s *S3) objectURL(key string) *url.URL {
+	u := *s.Endpoint
+	segs := strings.Split(key, "/")
+	for i, seg := range segs {
+		segs[i] = s3Escape(seg)
+	}
+	escaped := strings.Join(segs, "/")
+	if s.VirtualHost {
+		u.Host = s.Bucket + "." + u.Host
+		u.RawPath = strings.TrimRight(u.Path, "/") + "/" + escaped
+	} else {
+		u.RawPath = strings.TrimRight(u.Path, "/") + "/" + s3Escape(s.Bucket) + "/" + escaped
+	}
+	u.Path, _ = url.PathUnescape(u.RawPath)
+	return &u
+}
+
+func s3Escape(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' || c == '-' || c == '_' || c == '.' || c == '~' {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+func (s *S3) Put(ctx context.Context, key string, r io.Reader, size int64) error {
+	u := s.objectURL(key)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, u.String(), io.NopCloser(r))
+	if err != nil {
+		return err
+	}
+	req.ContentLength = size
+	s.sign(req)
+	resp, err := s.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		return fmt.Errorf("s3 put %s: %s: %s", key, resp.Status, strings.TrimSpace(string(body)))
+	}
+	return nil
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	m := hmac.New(sha256.New, key)
+	m.Write([]byte(data))
+	return m.Sum(nil)
+}
+
+// sign 按 AWS Signature V4 为请求添加 Authorization 头
+func (s *S3) sign(req *http.Request) {
+	t := s.now().UTC()
+	amzDate := t.Format("20060102T150405Z")
+	date := t.Format("20060102")
+	const payload = "UNSIGNED-PAYLOAD"
+	req.Header.Set("x-amz-date", amzDate)
+	req.Header.Set("x-amz-content-sha256", payload)
+
+	signedHeaders := "host;x-amz-content-sha256;x-amz-date"
+	canonicalHeaders := "host:" + req.URL.Host + "\n" +
+		"x-amz-content-sha256:" + payload + "\n" +
+		"x-amz-date:" + amzDate + "\n"
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		canonicalHeaders,
+		signedHeaders,
+		payload,
+	}, "\n")
+	scope := date + "/" + s.Region + "/s3/aws4_request"
+	sum := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(sum[:])
+
+	k := hmacSHA256([]byte("AWS4"+s.SecretKey), date)
+	k = hmacSHA256(k, s.Region)
+	k = hmacSHA256(k, "s3")
+	k = hmacSHA256(k, "aws4_request")
+	sig := hex.EncodeToString(hmacSHA256(k, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s", s.AccessKey, scope, signedHeaders, sig))
+}
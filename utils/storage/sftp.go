@@ -0,0 +1,100 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path"
+	"strconv"
+	"strings"
+
+	"main/utils/structs"
+)
+
+// SFTP uploads through the system sftp client in batch mode, the same way
+// MP4Box and ffmpeg are used elsewhere. Authentication must be key based.
+type SFTP struct {
+	Host         string
+	Port         int
+	User         string
+	IdentityFile string
+	Root         string
+}
+
+func NewSFTP(cfg structs.SFTPConfig) (*SFTP, error) {
+	if cfg.Host == "" {
+		return nil, errors.New("sftp: host is required")
+	}
+	if _, err := exec.LookPath("sftp"); err != nil {
+		return nil, errors.New("sftp: sftp client is not found in PATH")
+	}
+	port := cfg.Port
+	if port == 0 {
+		port = 22
+	}
+	return &SFTP{Host: cfg.Host, Port: port, User: cfg.User, IdentityFile: cfg.IdentityFile, Root: cfg.Path}, nil
+}
+
+func (s *SFTP) Name() string {
+	return fmt.Sprintf("sftp://%s@%s:%d%s", s.User, s.Host, s.Port, s.Root)
+}
+
+// quote 按 sftp 批处理语法给路径加引号
+func quote(p string) string {
+	return `"` + strings.ReplaceAll(strings.ReplaceAll(p, `\`, `\\`), `"`, `\"`) + `"`
+}
+
+// Put 需要一个本地文件路径；非文件的 reader 先落到临时文件
+func (s *SFTP) Put(ctx context.Context, key string, r io.Reader, size int64) error {
+	local := ""
+	if f, ok := r.(*os.File); ok {
+		local = f.Name()
+	} else {
+		tmp, err := os.CreateTemp("", "sftp-upload-*")
+		if err != nil {
+			return err
+		}
+		defer os.Remove(tmp.Name())
+		if _, err := io.Copy(tmp, r); err != nil {
+			tmp.Close()
+			return err
+		}
+		tmp.Close()
+		local = tmp.Name()
+	}
+	remote := path.Join(s.Root, key)
+
+	var batch bytes.Buffer
+	// 前缀 "-" 让 sftp 忽略目录已存在的错误
+	dir := ""
+	for _, seg := range strings.Split(path.Dir(remote), "/") {
+		if seg == "" {
+			dir = "/"
+			continue
+		}
+		dir = path.Join(dir, seg)
+		fmt.Fprintf(&batch, "-mkdir %s\n", quote(dir))
+	}
+	fmt.Fprintf(&batch, "put %s %s\n", quote(local), quote(remote))
+
+	args := []string{"-b", "-", "-P", strconv.Itoa(s.Port), "-o", "BatchMode=yes"}
+	if s.IdentityFile != "" {
+		args = append(args, "-i", s.IdentityFile)
+	}
+	target := s.Host
+	if s.User != "" {
+		target = s.User + "@" + s.Host
+	}
+	args = append(args, target)
+	cmd := exec.CommandContext(ctx, "sftp", args...)
+	cmd.Stdin = &batch
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("sftp put %s: %v: %s", key, err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
@@ -0,0 +1,89 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+
+	"main/utils/structs"
+)
+
+// Storage is a destination finished files are copied to after a task completes.
+// key is a slash separated path relative to the backend's configured root.
+type Storage interface {
+	Name() string
+	Put(ctx context.Context, key string, r io.Reader, size int64) error
+}
+
+// New builds the backend selected by cfg.Type. An empty type returns nil, nil.
+func New(cfg structs.StorageConfig) (Storage, error) {
+	switch strings.ToLower(cfg.Type) {
+	case "":
+		return nil, nil
+	case "s3":
+		return NewS3(cfg.S3)
+	case "webdav":
+		return NewWebDAV(cfg.WebDAV)
+	case "sftp":
+		return NewSFTP(cfg.SFTP)
+	default:
+		return nil, fmt.Errorf("unknown storage type %q", cfg.Type)
+	}
+}
+
+// PutFile uploads the local file at p under key.
+func PutFile(ctx context.Context, s Storage, key, p string) error {
+	f, err := os.Open(p)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	return s.Put(ctx, key, f, info.Size())
+}
+
+// File is a local file and the name it is uploaded under, relative to the prefix.
+type File struct {
+	Name string
+	Path string
+}
+
+// Upload copies files to s under prefix and keeps going after a failed upload.
+// With deleteLocal it removes the local copy of every file that was uploaded,
+// and only those. It returns the removed paths and the joined errors; canceled
+// is checked before each file and may be nil.
+func Upload(ctx context.Context, s Storage, prefix string, files []File, deleteLocal bool, canceled func() bool) ([]string, error) {
+	var removed []string
+	var errs []error
+	for _, f := range files {
+		if canceled != nil && canceled() {
+			errs = append(errs, errors.New("canceled"))
+			break
+		}
+		if err := PutFile(ctx, s, Key(prefix, f.Name), f.Path); err != nil {
+			errs = append(errs, fmt.Errorf("upload %s: %w", f.Name, err))
+			continue
+		}
+		if !deleteLocal {
+			continue
+		}
+		if err := os.Remove(f.Path); err != nil {
+			errs = append(errs, fmt.Errorf("delete local %s: %w", f.Name, err))
+			continue
+		}
+		removed = append(removed, f.Path)
+	}
+	return removed, errors.Join(errs...)
+}
+
+// Key joins prefix and name into a clean object key without a leading slash.
+func Key(prefix, name string) string {
+	return strings.TrimPrefix(path.Join("/", prefix, name), "/")
+}
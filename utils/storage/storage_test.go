@@ -0,0 +1,250 @@
+package storage
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"main/utils/structs"
+)
+
+// verifySigV4 recomputes the signature the way an S3 server does, from the
+// headers named in SignedHeaders, and compares it with the Authorization header.
+func verifySigV4(t *testing.T, r *http.Request, accessKey, secretKey, region string) {
+	t.Helper()
+	auth := r.Header.Get("Authorization")
+	const algo = "AWS4-HMAC-SHA256 "
+	if !strings.HasPrefix(auth, algo) {
+		t.Fatalf("Authorization = %q, want %s...", auth, algo)
+	}
+	fields := map[string]string{}
+	for _, part := range strings.Split(strings.TrimPrefix(auth, algo), ", ") {
+		k, v, _ := strings.Cut(part, "=")
+		fields[k] = v
+	}
+	amzDate := r.Header.Get("x-amz-date")
+	scope := amzDate[:8] + "/" + region + "/s3/aws4_request"
+	if want := accessKey + "/" + scope; fields["Credential"] != want {
+		t.Fatalf("Credential = %q, want %q", fields["Credential"], want)
+	}
+	var canonicalHeaders strings.Builder
+	for _, h := range strings.Split(fields["SignedHeaders"], ";") {
+		v := r.Header.Get(h)
+		if h == "host" {
+			v = r.Host
+		}
+		canonicalHeaders.WriteString(h + ":" + strings.TrimSpace(v) + "\n")
+	}
+	canonicalRequest := strings.Join([]string{
+		r.Method,
+		r.URL.EscapedPath(),
+		r.URL.RawQuery,
+		canonicalHeaders.String(),
+		fields["SignedHeaders"],
+		r.Header.Get("x-amz-content-sha256"),
+	}, "\n")
+	sum := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(sum[:])
+	k := hmacSHA256([]byte("AWS4"+secretKey), amzDate[:8])
+	k = hmacSHA256(k, region)
+	k = hmacSHA256(k, "s3")
+	k = hmacSHA256(k, "aws4_request")
+	if want := hex.EncodeToString(hmacSHA256(k, stringToSign)); fields["Signature"] != want {
+		t.Fatalf("Signature = %s, want %s", fields["Signature"], want)
+	}
+}
+
+func TestS3Put(t *testing.T) {
+	var got struct {
+		method, path, body string
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		verifySigV4(t, r, "AKID", "SECRET", "eu-west-1")
+		if h := r.Header.Get("x-amz-content-sha256"); h != "UNSIGNED-PAYLOAD" {
+			t.Errorf("x-amz-content-sha256 = %q", h)
+		}
+		if h := r.Header.Get("x-amz-date"); h != "20240102T030405Z" {
+			t.Errorf("x-amz-date = %q", h)
+		}
+		b, _ := io.ReadAll(r.Body)
+		got.method, got.path, got.body = r.Method, r.URL.EscapedPath(), string(b)
+	}))
+	defer srv.Close()
+
+	s, err := NewS3(structs.S3Config{Endpoint: srv.URL + "/", Region: "eu-west-1", Bucket: "music", AccessKey: "AKID", SecretKey: "SECRET"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.now = func() time.Time { return time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC) }
+
+	key := Key("/library/", "Artist/Album (Deluxe)/01 Song+1.m4a")
+	if err := s.Put(context.Background(), key, strings.NewReader("data"), 4); err != nil {
+		t.Fatal(err)
+	}
+	if got.method != http.MethodPut {
+		t.Errorf("method = %s", got.method)
+	}
+	if want := "/music/library/Artist/Album%20%28Deluxe%29/01%20Song%2B1.m4a"; got.path != want {
+		t.Errorf("path = %s, want %s", got.path, want)
+	}
+	if got.body != "data" {
+		t.Errorf("body = %q", got.body)
+	}
+}
+
+func TestS3PutError(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "<Error><Code>AccessDenied</Code></Error>", http.StatusForbidden)
+	}))
+	defer srv.Close()
+	s, err := NewS3(structs.S3Config{Endpoint: srv.URL, Bucket: "music"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.Put(context.Background(), "a.m4a", strings.NewReader("x"), 1)
+	if err == nil || !strings.Contains(err.Error(), "AccessDenied") {
+		t.Fatalf("err = %v, want AccessDenied", err)
+	}
+}
+
+func TestWebDAVPut(t *testing.T) {
+	var mu sync.Mutex
+	var calls []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if u, p, _ := r.BasicAuth(); u != "user" || p != "pass" {
+			t.Errorf("basic auth = %q/%q", u, p)
+		}
+		mu.Lock()
+		calls = append(calls, r.Method+" "+r.URL.Path)
+		mu.Unlock()
+		switch {
+		case r.Method == "MKCOL" && r.URL.Path == "/dav/music/":
+			// 已存在的目录
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		case r.Method == "MKCOL":
+			w.WriteHeader(http.StatusCreated)
+		case r.Method == http.MethodPut:
+			io.Copy(io.Discard, r.Body)
+			w.WriteHeader(http.StatusCreated)
+		default:
+			w.WriteHeader(http.StatusBadRequest)
+		}
+	}))
+	defer srv.Close()
+
+	w, err := NewWebDAV(structs.WebDAVConfig{URL: srv.URL + "/dav/", Username: "user", Password: "pass"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	for _, key := range []string{"music/Artist/Album/01.m4a", "music/Artist/Album/02.m4a"} {
+		if err := w.Put(ctx, key, strings.NewReader("x"), 1); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want := []string{
+		"MKCOL /dav/music/",
+		"MKCOL /dav/music/Artist/",
+		"MKCOL /dav/music/Artist/Album/",
+		"PUT /dav/music/Artist/Album/01.m4a",
+		"PUT /dav/music/Artist/Album/02.m4a",
+	}
+	if strings.Join(calls, "\n") != strings.Join(want, "\n") {
+		t.Fatalf("calls:\n%s\nwant:\n%s", strings.Join(calls, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+func TestWebDAVMkcolError(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPut {
+			t.Errorf("PUT sent after MKCOL failed")
+		}
+		w.WriteHeader(http.StatusForbidden)
+	}))
+	defer srv.Close()
+	w, err := NewWebDAV(structs.WebDAVConfig{URL: srv.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Put(context.Background(), "a/b.m4a", strings.NewReader("x"), 1); err == nil {
+		t.Fatal("expected an error")
+	}
+}
+
+// fakeStorage records uploaded keys and fails the ones listed in fail.
+type fakeStorage struct {
+	fail map[string]bool
+	put  []string
+}
+
+func (f *fakeStorage) Name() string { return "fake" }
+
+func (f *fakeStorage) Put(ctx context.Context, key string, r io.Reader, size int64) error {
+	if f.fail[key] {
+		return errors.New("boom")
+	}
+	f.put = append(f.put, key)
+	return nil
+}
+
+func TestUploadDeleteLocal(t *testing.T) {
+	dir := t.TempDir()
+	var files []File
+	for _, name := range []string{"01.m4a", "02.m4a", "03.m4a"} {
+		p := filepath.Join(dir, name)
+		if err := os.WriteFile(p, []byte(name), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		files = append(files, File{Name: "Album/" + name, Path: p})
+	}
+	s := &fakeStorage{fail: map[string]bool{"lib/Album/02.m4a": true}}
+
+	removed, err := Upload(context.Background(), s, "lib", files, true, nil)
+	if err == nil || !strings.Contains(err.Error(), "Album/02.m4a") {
+		t.Fatalf("err = %v, want the failed upload", err)
+	}
+	if strings.Join(s.put, ",") != "lib/Album/01.m4a,lib/Album/03.m4a" {
+		t.Fatalf("uploaded %v", s.put)
+	}
+	if len(removed) != 2 || removed[0] != files[0].Path || removed[1] != files[2].Path {
+		t.Fatalf("removed %v", removed)
+	}
+	for i, f := range files {
+		_, statErr := os.Stat(f.Path)
+		if exists := statErr == nil; exists != (i == 1) {
+			t.Errorf("%s exists = %v", f.Name, exists)
+		}
+	}
+}
+
+func TestUploadKeepLocal(t *testing.T) {
+	p := filepath.Join(t.TempDir(), "01.m4a")
+	if err := os.WriteFile(p, []byte("x"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	removed, err := Upload(context.Background(), &fakeStorage{}, "", []File{{Name: "01.m4a", Path: p}}, false, nil)
+	if err != nil || len(removed) != 0 {
+		t.Fatalf("removed %v, err %v", removed, err)
+	}
+	if _, err := os.Stat(p); err != nil {
+		t.Fatal("local file removed without delete-local")
+	}
+}
+
+func TestUploadCanceled(t *testing.T) {
+	s := &fakeStorage{}
+	_, err := Upload(context.Background(), s, "", []File{{Name: "a", Path: "a"}}, false, func() bool { return true })
+	if err == nil || len(s.put) != 0 {
+		t.Fatalf("err = %v, put %v", err, s.put)
+	}
+}
@@ -0,0 +1,102 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"sync"
+
+	"main/utils/structs"
+)
+
+// WebDAV uploads files with PUT, creating parent collections with MKCOL.
+type WebDAV struct {
+	Base     *url.URL
+	Username string
+	Password string
+	Client   *http.Client
+
+	mu      sync.Mutex
+	created map[string]bool
+}
+
+func NewWebDAV(cfg structs.WebDAVConfig) (*WebDAV, error) {
+	if cfg.URL == "" {
+		return nil, errors.New("webdav: url is required")
+	}
+	u, err := url.Parse(strings.TrimRight(cfg.URL, "/"))
+	if err != nil {
+		return nil, fmt.Errorf("webdav: bad url: %w", err)
+	}
+	return &WebDAV{Base: u, Username: cfg.Username, Password: cfg.Password, Client: http.DefaultClient, created: map[string]bool{}}, nil
+}
+
+func (w *WebDAV) Name() string { return w.Base.Redacted() }
+
+func (w *WebDAV) url(p string) string {
+	u := *w.Base
+	u.Path = strings.TrimRight(u.Path, "/") + "/" + strings.TrimPrefix(p, "/")
+	return u.String()
+}
+
+func (w *WebDAV) do(ctx context.Context, method, p string, body io.Reader, size int64) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, w.url(p), body)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.ContentLength = size
+	}
+	if w.Username != "" {
+		req.SetBasicAuth(w.Username, w.Password)
+	}
+	return w.Client.Do(req)
+}
+
+// mkdirAll 逐级 MKCOL；405 表示目录已存在
+func (w *WebDAV) mkdirAll(ctx context.Context, dir string) error {
+	if dir == "." || dir == "/" || dir == "" {
+		return nil
+	}
+	w.mu.Lock()
+	done := w.created[dir]
+	w.mu.Unlock()
+	if done {
+		return nil
+	}
+	if err := w.mkdirAll(ctx, path.Dir(dir)); err != nil {
+		return err
+	}
+	resp, err := w.do(ctx, "MKCOL", dir+"/", nil, 0)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 && resp.StatusCode != http.StatusMethodNotAllowed {
+		return fmt.Errorf("webdav mkcol %s: %s", dir, resp.Status)
+	}
+	w.mu.Lock()
+	w.created[dir] = true
+	w.mu.Unlock()
+	return nil
+}
+
+func (w *WebDAV) Put(ctx context.Context, key string, r io.Reader, size int64) error {
+	if err := w.mkdirAll(ctx, path.Dir(key)); err != nil {
+		return err
+	}
+	resp, err := w.do(ctx, http.MethodPut, key, io.NopCloser(r), size)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("webdav put %s: %s", key, resp.Status)
+	}
+	return nil
+}
@@ -1,43 +1,123 @@
 package structs
 
 type ConfigSet struct {
-	Storefront              string `yaml:"storefront"` 
-	MediaUserToken          string `yaml:"media-user-token"`
-	AuthorizationToken      string `yaml:"authorization-token"`
-	Language                string `yaml:"language"`
-	SaveLrcFile             bool   `yaml:"save-lrc-file"`
-	LrcType                 string `yaml:"lrc-type"`
-	LrcFormat               string `yaml:"lrc-format"`
-	SaveAnimatedArtwork     bool   `yaml:"save-animated-artwork"`
-	EmbyAnimatedArtwork     bool   `yaml:"emby-animated-artwork"`
-	EmbedLrc                bool   `yaml:"embed-lrc"`
-	EmbedCover              bool   `yaml:"embed-cover"`
-	SaveArtistCover         bool   `yaml:"save-artist-cover"`
-	CoverSize               string `yaml:"cover-size"`
-	CoverFormat             string `yaml:"cover-format"`
-	AlacSaveFolder          string `yaml:"alac-save-folder"`
-	AtmosSaveFolder         string `yaml:"atmos-save-folder"`
-	AacSaveFolder           string `yaml:"aac-save-folder"`
-	AlbumFolderFormat       string `yaml:"album-folder-format"`
-	PlaylistFolderFormat    string `yaml:"playlist-folder-format"`
-	ArtistFolderFormat      string `yaml:"artist-folder-format"`
-	SongFileFormat          string `yaml:"song-file-format"`
-	ExplicitChoice          string `yaml:"explicit-choice"`
-	CleanChoice             string `yaml:"clean-choice"`
-	AppleMasterChoice       string `yaml:"apple-master-choice"`
-	MaxMemoryLimit          int    `yaml:"max-memory-limit"`
-	DecryptM3u8Port         string `yaml:"decrypt-m3u8-port"`
-	GetM3u8Port             string `yaml:"get-m3u8-port"`
-	GetM3u8Mode             string `yaml:"get-m3u8-mode"`
-	GetM3u8FromDevice       bool   `yaml:"get-m3u8-from-device"`
-	AacType                 string `yaml:"aac-type"`
-	AlacMax                 int    `yaml:"alac-max"`
-	AtmosMax                int    `yaml:"atmos-max"`
-	LimitMax                int    `yaml:"limit-max"`
-	UseSongInfoForPlaylist  bool   `yaml:"use-songinfo-for-playlist"`
-	DlAlbumcoverForPlaylist bool   `yaml:"dl-albumcover-for-playlist"`
-	MVAudioType             string `yaml:"mv-audio-type"`
-	MVMax                   int    `yaml:"mv-max"`
+	Storefront              string            `yaml:"storefront"`
+	MediaUserToken          string            `yaml:"media-user-token"`
+	AuthorizationToken      string            `yaml:"authorization-token"`
+	Language                string            `yaml:"language"`
+	SaveLrcFile             bool              `yaml:"save-lrc-file"`
+	LrcType                 string            `yaml:"lrc-type"`
+	LrcFormat               string            `yaml:"lrc-format"`
+	SaveAnimatedArtwork     bool              `yaml:"save-animated-artwork"`
+	EmbyAnimatedArtwork     bool              `yaml:"emby-animated-artwork"`
+	EmbedLrc                bool              `yaml:"embed-lrc"`
+	EmbedCover              bool              `yaml:"embed-cover"`
+	SaveArtistCover         bool              `yaml:"save-artist-cover"`
+	SaveAlbumJson           bool              `yaml:"save-album-json"`
+	SaveNfo                 bool              `yaml:"save-nfo"`
+	SaveDescription         string            `yaml:"save-description"`
+	PlaylistFiles           []string          `yaml:"playlist-files"`
+	PlaylistMode            string            `yaml:"playlist-mode"`
+	PlaylistLinks           string            `yaml:"playlist-links"`
+	PlaylistSyncRemoved     string            `yaml:"playlist-sync-removed"`
+	PlaylistSyncNumbering   string            `yaml:"playlist-sync-numbering"`
+	QualityChain            []string          `yaml:"quality-chain"`
+	QualityChainFolder      string            `yaml:"quality-chain-folder"`
+	EditionPreference       string            `yaml:"edition-preference"`
+	CoverSize               string            `yaml:"cover-size"`
+	CoverFormat             string            `yaml:"cover-format"`
+	AlacSaveFolder          string            `yaml:"alac-save-folder"`
+	AtmosSaveFolder         string            `yaml:"atmos-save-folder"`
+	AacSaveFolder           string            `yaml:"aac-save-folder"`
+	AlbumFolderFormat       string            `yaml:"album-folder-format"`
+	PlaylistFolderFormat    string            `yaml:"playlist-folder-format"`
+	ArtistFolderFormat      string            `yaml:"artist-folder-format"`
+	ClassicalFolderFormat   string            `yaml:"classical-artist-folder-format"`
+	SongFileFormat          string            `yaml:"song-file-format"`
+	ExplicitChoice          string            `yaml:"explicit-choice"`
+	CleanChoice             string            `yaml:"clean-choice"`
+	AppleMasterChoice       string            `yaml:"apple-master-choice"`
+	MaxMemoryLimit          int               `yaml:"max-memory-limit"`
+	DecryptM3u8Port         string            `yaml:"decrypt-m3u8-port"`
+	GetM3u8Port             string            `yaml:"get-m3u8-port"`
+	GetM3u8Mode             string            `yaml:"get-m3u8-mode"`
+	GetM3u8FromDevice       bool              `yaml:"get-m3u8-from-device"`
+	AacType                 string            `yaml:"aac-type"`
+	AlacMax                 int               `yaml:"alac-max"`
+	AtmosMax                int               `yaml:"atmos-max"`
+	LimitMax                int               `yaml:"limit-max"`
+	UseSongInfoForPlaylist  bool              `yaml:"use-songinfo-for-playlist"`
+	DlAlbumcoverForPlaylist bool              `yaml:"dl-albumcover-for-playlist"`
+	MVAudioType             string            `yaml:"mv-audio-type"`
+	MVMax                   int               `yaml:"mv-max"`
+	LibraryIndex            string            `yaml:"library-index"`
+	Subsonic                SubsonicConfig    `yaml:"subsonic"`
+	ArchiveSecret           string            `yaml:"archive-secret"`
+	ArchiveLinkTTL          int               `yaml:"archive-link-ttl"`
+	Storage                 StorageConfig     `yaml:"storage"`
+	StagingFolder           string            `yaml:"staging-folder"`
+	VerifyTolerance         int               `yaml:"verify-duration-tolerance"`
+	ChecksumManifest        string            `yaml:"checksum-manifest"`
+	Tags                    TagsConfig        `yaml:"tags"`
+	AltLanguage             AltLanguageConfig `yaml:"alt-language"`
+}
+
+// TagsConfig 控制写入哪些标签以及自定义（----）原子的内容
+type TagsConfig struct {
+	Fields          []string          `yaml:"fields"`
+	Skip            []string          `yaml:"skip"`
+	SortFields      *bool             `yaml:"sort-fields"` // 未配置时为 true
+	PlaylistAlbum   string            `yaml:"playlist-album"`
+	ArtistSeparator string            `yaml:"artist-separator"`
+	Credits         bool              `yaml:"credits"`
+	CreditRoles     map[string]string `yaml:"credit-roles"`
+	Description     string            `yaml:"description"`
+	Custom          map[string]string `yaml:"custom"`
+}
+
+// AltLanguageConfig 配置第二目录语言：双语标签（显示/排序）与目录名
+type AltLanguageConfig struct {
+	Language string `yaml:"language"`
+	Policy   string `yaml:"policy"`
+	Folders  bool   `yaml:"folders"`
+}
+
+type SubsonicConfig struct {
+	Enabled  bool   `yaml:"enabled"`
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+}
+
+type StorageConfig struct {
+	Type        string       `yaml:"type"`
+	Prefix      string       `yaml:"prefix"`
+	DeleteLocal bool         `yaml:"delete-local"`
+	S3          S3Config     `yaml:"s3"`
+	WebDAV      WebDAVConfig `yaml:"webdav"`
+	SFTP        SFTPConfig   `yaml:"sftp"`
+}
+
+type S3Config struct {
+	Endpoint    string `yaml:"endpoint"`
+	Region      string `yaml:"region"`
+	Bucket      string `yaml:"bucket"`
+	AccessKey   string `yaml:"access-key"`
+	SecretKey   string `yaml:"secret-key"`
+	VirtualHost bool   `yaml:"virtual-host"`
+}
+
+type WebDAVConfig struct {
+	URL      string `yaml:"url"`
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+}
+
+type SFTPConfig struct {
+	Host         string `yaml:"host"`
+	Port         int    `yaml:"port"`
+	User         string `yaml:"user"`
+	IdentityFile string `yaml:"identity-file"`
+	Path         string `yaml:"path"`
 }
 
 type Counter struct {
@@ -89,6 +169,7 @@ type AutoGeneratedArtist struct {
 				Kind string `json:"kind"`
 			} `json:"playParams"`
 			TrackNumber  int    `json:"trackNumber"`
+			TrackCount   int    `json:"trackCount"`
 			AudioLocale  string `json:"audioLocale"`
 			ComposerName string `json:"composerName"`
 		} `json:"attributes"`
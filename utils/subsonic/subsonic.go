@@ -0,0 +1,641 @@
+package subsonic
+
+import (
+	"crypto/md5"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/xml"
+	"net/http"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"main/utils/library"
+	"main/utils/structs"
+
+	"github.com/gin-gonic/gin"
+)
+
+const apiVersion = "1.16.1"
+
+const (
+	errMissingParam = 10
+	errAuth         = 40
+	errNotFound     = 70
+)
+
+// Response 同时支持 XML（默认）与 JSON（f=json）两种输出
+type Response struct {
+	XMLName       xml.Name       `xml:"subsonic-response" json:"-"`
+	Xmlns         string         `xml:"xmlns,attr" json:"-"`
+	Status        string         `xml:"status,attr" json:"status"`
+	Version       string         `xml:"version,attr" json:"version"`
+	Type          string         `xml:"type,attr" json:"type"`
+	ServerVersion string         `xml:"serverVersion,attr" json:"serverVersion"`
+	OpenSubsonic  bool           `xml:"openSubsonic,attr" json:"openSubsonic"`
+	Error         *Error         `xml:"error,omitempty" json:"error,omitempty"`
+	License       *License       `xml:"license,omitempty" json:"license,omitempty"`
+	MusicFolders  *MusicFolders  `xml:"musicFolders,omitempty" json:"musicFolders,omitempty"`
+	Artists       *Artists       `xml:"artists,omitempty" json:"artists,omitempty"`
+	Artist        *ArtistID3     `xml:"artist,omitempty" json:"artist,omitempty"`
+	Album         *AlbumID3      `xml:"album,omitempty" json:"album,omitempty"`
+	Song          *Child         `xml:"song,omitempty" json:"song,omitempty"`
+	SearchResult3 *SearchResult3 `xml:"searchResult3,omitempty" json:"searchResult3,omitempty"`
+	Lyrics        *Lyrics        `xml:"lyrics,omitempty" json:"lyrics,omitempty"`
+	LyricsList    *LyricsList    `xml:"lyricsList,omitempty" json:"lyricsList,omitempty"`
+	Extensions    []Extension    `xml:"openSubsonicExtensions,omitempty" json:"openSubsonicExtensions,omitempty"`
+}
+
+type Error struct {
+	Code    int    `xml:"code,attr" json:"code"`
+	Message string `xml:"message,attr" json:"message"`
+}
+
+type License struct {
+	Valid bool `xml:"valid,attr" json:"valid"`
+}
+
+type MusicFolders struct {
+	Folders []MusicFolder `xml:"musicFolder" json:"musicFolder"`
+}
+
+type MusicFolder struct {
+	ID   int    `xml:"id,attr" json:"id"`
+	Name string `xml:"name,attr" json:"name"`
+}
+
+type Artists struct {
+	IgnoredArticles string  `xml:"ignoredArticles,attr" json:"ignoredArticles"`
+	Index           []Index `xml:"index" json:"index"`
+}
+
+type Index struct {
+	Name    string      `xml:"name,attr" json:"name"`
+	Artists []ArtistID3 `xml:"artist" json:"artist"`
+}
+
+type ArtistID3 struct {
+	ID         string     `xml:"id,attr" json:"id"`
+	Name       string     `xml:"name,attr" json:"name"`
+	CoverArt   string     `xml:"coverArt,attr,omitempty" json:"coverArt,omitempty"`
+	AlbumCount int        `xml:"albumCount,attr" json:"albumCount"`
+	Albums     []AlbumID3 `xml:"album,omitempty" json:"album,omitempty"`
+}
+
+type AlbumID3 struct {
+	ID        string  `xml:"id,attr" json:"id"`
+	Name      string  `xml:"name,attr" json:"name"`
+	Artist    string  `xml:"artist,attr,omitempty" json:"artist,omitempty"`
+	ArtistID  string  `xml:"artistId,attr,omitempty" json:"artistId,omitempty"`
+	CoverArt  string  `xml:"coverArt,attr,omitempty" json:"coverArt,omitempty"`
+	SongCount int     `xml:"songCount,attr" json:"songCount"`
+	Duration  int     `xml:"duration,attr" json:"duration"`
+	Created   string  `xml:"created,attr" json:"created"`
+	Year      int     `xml:"year,attr,omitempty" json:"year,omitempty"`
+	Genre     string  `xml:"genre,attr,omitempty" json:"genre,omitempty"`
+	Songs     []Child `xml:"song,omitempty" json:"song,omitempty"`
+}
+
+type Child struct {
+	ID           string `xml:"id,attr" json:"id"`
+	Parent       string `xml:"parent,attr,omitempty" json:"parent,omitempty"`
+	IsDir        bool   `xml:"isDir,attr" json:"isDir"`
+	Title        string `xml:"title,attr" json:"title"`
+	Album        string `xml:"album,attr,omitempty" json:"album,omitempty"`
+	Artist       string `xml:"artist,attr,omitempty" json:"artist,omitempty"`
+	Track        int    `xml:"track,attr,omitempty" json:"track,omitempty"`
+	Year         int    `xml:"year,attr,omitempty" json:"year,omitempty"`
+	Genre        string `xml:"genre,attr,omitempty" json:"genre,omitempty"`
+	CoverArt     string `xml:"coverArt,attr,omitempty" json:"coverArt,omitempty"`
+	Size         int64  `xml:"size,attr" json:"size"`
+	ContentType  string `xml:"contentType,attr" json:"contentType"`
+	Suffix       string `xml:"suffix,attr" json:"suffix"`
+	Duration     int    `xml:"duration,attr" json:"duration"`
+	BitRate      int    `xml:"bitRate,attr,omitempty" json:"bitRate,omitempty"`
+	Path         string `xml:"path,attr,omitempty" json:"path,omitempty"`
+	DiscNumber   int    `xml:"discNumber,attr,omitempty" json:"discNumber,omitempty"`
+	AlbumID      string `xml:"albumId,attr,omitempty" json:"albumId,omitempty"`
+	ArtistID     string `xml:"artistId,attr,omitempty" json:"artistId,omitempty"`
+	Type         string `xml:"type,attr" json:"type"`
+	Created      string `xml:"created,attr,omitempty" json:"created,omitempty"`
+	SamplingRate int    `xml:"samplingRate,attr,omitempty" json:"samplingRate,omitempty"`
+	BitDepth     int    `xml:"bitDepth,attr,omitempty" json:"bitDepth,omitempty"`
+	ChannelCount int    `xml:"channelCount,attr,omitempty" json:"channelCount,omitempty"`
+}
+
+type SearchResult3 struct {
+	Artists []ArtistID3 `xml:"artist" json:"artist"`
+	Albums  []AlbumID3  `xml:"album" json:"album"`
+	Songs   []Child     `xml:"song" json:"song"`
+}
+
+type Lyrics struct {
+	Artist string `xml:"artist,attr,omitempty" json:"artist,omitempty"`
+	Title  string `xml:"title,attr,omitempty" json:"title,omitempty"`
+	Value  string `xml:",chardata" json:"value"`
+}
+
+type LyricsList struct {
+	StructuredLyrics []StructuredLyrics `xml:"structuredLyrics" json:"structuredLyrics"`
+}
+
+type StructuredLyrics struct {
+	Lang          string `xml:"lang,attr" json:"lang"`
+	Synced        bool   `xml:"synced,attr" json:"synced"`
+	DisplayArtist string `xml:"displayArtist,attr,omitempty" json:"displayArtist,omitempty"`
+	DisplayTitle  string `xml:"displayTitle,attr,omitempty" json:"displayTitle,omitempty"`
+	Lines         []Line `xml:"line" json:"line"`
+}
+
+type Line struct {
+	Start *int64 `xml:"start,attr,omitempty" json:"start,omitempty"`
+	Value string `xml:",chardata" json:"value"`
+}
+
+type Extension struct {
+	Name     string `xml:"name,attr" json:"name"`
+	Versions []int  `xml:"versions" json:"versions"`
+}
+
+// id 前缀用来区分艺人/专辑/曲目，getCoverArt 同时接受专辑与曲目 id
+const (
+	artistPrefix = "ar-"
+	albumPrefix  = "al-"
+	trackPrefix  = "tr-"
+)
+
+type server struct {
+	idx *library.Index
+	cfg structs.SubsonicConfig
+}
+
+// Register mounts the Subsonic REST endpoints under /rest when cfg.Enabled is set.
+// Without a username and password nothing is mounted: an empty password would
+// let any client that knows the username authenticate.
+func Register(r *gin.Engine, idx *library.Index, cfg structs.SubsonicConfig) {
+	if !cfg.Enabled || idx == nil || cfg.Username == "" || cfg.Password == "" {
+		return
+	}
+	s := &server{idx: idx, cfg: cfg}
+	rest := r.Group("/rest", s.auth)
+	handlers := map[string]gin.HandlerFunc{
+		"ping":                      s.ping,
+		"getLicense":                s.getLicense,
+		"getOpenSubsonicExtensions": s.getExtensions,
+		"getMusicFolders":           s.getMusicFolders,
+		"getArtists":                s.getArtists,
+		"getArtist":                 s.getArtist,
+		"getAlbum":                  s.getAlbum,
+		"getSong":                   s.getSong,
+		"stream":                    s.stream,
+		"download":                  s.stream,
+		"getCoverArt":               s.getCoverArt,
+		"getLyrics":                 s.getLyrics,
+		"getLyricsBySongId":         s.getLyricsBySongID,
+		"search3":                   s.search3,
+	}
+	for name, h := range handlers {
+		for _, p := range []string{"/" + name, "/" + name + ".view"} {
+			rest.GET(p, h)
+			rest.POST(p, h)
+		}
+	}
+}
+
+func newResponse() *Response {
+	return &Response{
+		Xmlns:         "http://subsonic.org/restapi",
+		Status:        "ok",
+		Version:       apiVersion,
+		Type:          "apple-music-download-center",
+		ServerVersion: "1.0",
+		OpenSubsonic:  true,
+	}
+}
+
+// arg 读取 query 或 POST 表单参数，Subsonic 客户端两种方式都会使用
+func arg(c *gin.Context, key string) string {
+	return c.Request.FormValue(key)
+}
+
+func send(c *gin.Context, resp *Response) {
+	if arg(c, "f") == "json" {
+		c.JSON(http.StatusOK, gin.H{"subsonic-response": resp})
+		return
+	}
+	c.XML(http.StatusOK, resp)
+}
+
+func sendError(c *gin.Context, code int, msg string) {
+	resp := newResponse()
+	resp.Status = "failed"
+	resp.Error = &Error{Code: code, Message: msg}
+	send(c, resp)
+	c.Abort()
+}
+
+// auth 校验 u+p（明文或 enc:十六进制）以及 u+t+s（md5(password+salt)）两种认证方式
+func (s *server) auth(c *gin.Context) {
+	user := arg(c, "u")
+	if user == "" {
+		sendError(c, errMissingParam, "required parameter is missing: u")
+		return
+	}
+	ok := false
+	if t, salt := arg(c, "t"), arg(c, "s"); t != "" && salt != "" {
+		sum := md5.Sum([]byte(s.cfg.Password + salt))
+		ok = subtle.ConstantTimeCompare([]byte(strings.ToLower(t)), []byte(hex.EncodeToString(sum[:]))) == 1
+	} else if p := arg(c, "p"); p != "" {
+		if strings.HasPrefix(p, "enc:") {
+			if b, err := hex.DecodeString(p[4:]); err == nil {
+				p = string(b)
+			}
+		}
+		ok = subtle.ConstantTimeCompare([]byte(p), []byte(s.cfg.Password)) == 1
+	} else {
+		sendError(c, errMissingParam, "required parameter is missing: p or t/s")
+		return
+	}
+	if !ok || user != s.cfg.Username {
+		sendError(c, errAuth, "wrong username or password")
+		return
+	}
+	c.Next()
+}
+
+func (s *server) ping(c *gin.Context) {
+	send(c, newResponse())
+}
+
+func (s *server) getLicense(c *gin.Context) {
+	resp := newResponse()
+	resp.License = &License{Valid: true}
+	send(c, resp)
+}
+
+func (s *server) getExtensions(c *gin.Context) {
+	resp := newResponse()
+	resp.Extensions = []Extension{{Name: "songLyrics", Versions: []int{1}}}
+	send(c, resp)
+}
+
+func (s *server) getMusicFolders(c *gin.Context) {
+	resp := newResponse()
+	resp.MusicFolders = &MusicFolders{Folders: []MusicFolder{{ID: 1, Name: "Music"}}}
+	send(c, resp)
+}
+
+func (s *server) getArtists(c *gin.Context) {
+	albums := s.idx.Albums("")
+	covers := map[string]string{}
+	for _, a := range albums {
+		if _, ok := covers[a.ArtistID]; !ok {
+			covers[a.ArtistID] = albumPrefix + a.ID
+		}
+	}
+	groups := map[string][]ArtistID3{}
+	for _, a := range s.idx.Artists() {
+		key := indexKey(a.Name)
+		groups[key] = append(groups[key], ArtistID3{
+			ID:         artistPrefix + a.ID,
+			Name:       a.Name,
+			CoverArt:   covers[a.ID],
+			AlbumCount: a.AlbumCount,
+		})
+	}
+	keys := make([]string, 0, len(groups))
+	for k := range groups {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	out := &Artists{Index: []Index{}}
+	for _, k := range keys {
+		out.Index = append(out.Index, Index{Name: k, Artists: groups[k]})
+	}
+	resp := newResponse()
+	resp.Artists = out
+	send(c, resp)
+}
+
+func indexKey(name string) string {
+	for _, r := range name {
+		if unicode.IsLetter(r) && r < unicode.MaxASCII {
+			return strings.ToUpper(string(r))
+		}
+		break
+	}
+	return "#"
+}
+
+func (s *server) getArtist(c *gin.Context) {
+	id, ok := requireID(c, artistPrefix)
+	if !ok {
+		return
+	}
+	var artist *ArtistID3
+	for _, a := range s.idx.Artists() {
+		if a.ID == id {
+			artist = &ArtistID3{ID: artistPrefix + a.ID, Name: a.Name, AlbumCount: a.AlbumCount}
+		}
+	}
+	if artist == nil {
+		sendError(c, errNotFound, "artist not found")
+		return
+	}
+	for _, a := range s.idx.Albums(id) {
+		artist.Albums = append(artist.Albums, toAlbum(a))
+	}
+	if len(artist.Albums) > 0 {
+		artist.CoverArt = artist.Albums[0].CoverArt
+	}
+	resp := newResponse()
+	resp.Artist = artist
+	send(c, resp)
+}
+
+func (s *server) getAlbum(c *gin.Context) {
+	id, ok := requireID(c, albumPrefix)
+	if !ok {
+		return
+	}
+	a, ok := s.idx.Album(id)
+	if !ok {
+		sendError(c, errNotFound, "album not found")
+		return
+	}
+	album := toAlbum(a)
+	for _, t := range s.idx.Tracks(id, "") {
+		album.Songs = append(album.Songs, toChild(t))
+	}
+	resp := newResponse()
+	resp.Album = &album
+	send(c, resp)
+}
+
+func (s *server) getSong(c *gin.Context) {
+	t, ok := s.track(c)
+	if !ok {
+		return
+	}
+	song := toChild(t)
+	resp := newResponse()
+	resp.Song = &song
+	send(c, resp)
+}
+
+func (s *server) stream(c *gin.Context) {
+	t, ok := s.track(c)
+	if !ok {
+		return
+	}
+	c.Header("Content-Type", "audio/mp4")
+	c.File(t.Path)
+}
+
+func (s *server) getCoverArt(c *gin.Context) {
+	raw := arg(c, "id")
+	if raw == "" {
+		sendError(c, errMissingParam, "required parameter is missing: id")
+		return
+	}
+	var tracks []library.Track
+	switch {
+	case strings.HasPrefix(raw, albumPrefix):
+		tracks = s.idx.Tracks(strings.TrimPrefix(raw, albumPrefix), "")
+	case strings.HasPrefix(raw, trackPrefix):
+		if t, ok := s.idx.Track(strings.TrimPrefix(raw, trackPrefix)); ok {
+			tracks = []library.Track{t}
+		}
+	case strings.HasPrefix(raw, artistPrefix):
+		tracks = s.idx.Tracks("", strings.TrimPrefix(raw, artistPrefix))
+	}
+	if len(tracks) == 0 {
+		sendError(c, errNotFound, "cover art not found")
+		return
+	}
+	// 优先使用 writeCover 写出的 cover 文件，其次是嵌入封面
+	c.Header("Cache-Control", "max-age=86400")
+	if tracks[0].CoverPath != "" {
+		c.File(tracks[0].CoverPath)
+		return
+	}
+	data, err := library.EmbeddedCover(tracks[0].Path)
+	if err != nil {
+		sendError(c, errNotFound, "cover art not found")
+		return
+	}
+	c.Data(http.StatusOK, http.DetectContentType(data), data)
+}
+
+var lrcTag = regexp.MustCompile(`\[(\d+):(\d+(?:\.\d+)?)\]`)
+var lrcAnyTag = regexp.MustCompile(`\[[^\]]*\]`)
+
+// parseLrc 把 LRC 文本拆为带毫秒起点的行，忽略 [ar:] 之类的元信息行
+func parseLrc(text string) []Line {
+	var lines []Line
+	for _, raw := range strings.Split(strings.ReplaceAll(text, "\r\n", "\n"), "\n") {
+		tags := lrcTag.FindAllStringSubmatch(raw, -1)
+		if len(tags) == 0 {
+			continue
+		}
+		value := strings.TrimSpace(lrcAnyTag.ReplaceAllString(raw, ""))
+		for _, m := range tags {
+			min, _ := strconv.ParseInt(m[1], 10, 64)
+			sec, _ := strconv.ParseFloat(m[2], 64)
+			start := min*60000 + int64(sec*1000)
+			lines = append(lines, Line{Start: &start, Value: value})
+		}
+	}
+	sort.SliceStable(lines, func(i, j int) bool { return *lines[i].Start < *lines[j].Start })
+	return lines
+}
+
+func (s *server) getLyrics(c *gin.Context) {
+	artist, title := arg(c, "artist"), arg(c, "title")
+	resp := newResponse()
+	resp.Lyrics = &Lyrics{Artist: artist, Title: title}
+	if title != "" {
+		for _, t := range s.idx.Tracks("", "") {
+			if !strings.EqualFold(t.Title, title) || (artist != "" && !strings.EqualFold(t.Artist, artist) && !strings.EqualFold(t.AlbumArtist, artist)) {
+				continue
+			}
+			lrc, _, err := library.Lyrics(t)
+			if err != nil {
+				continue
+			}
+			var plain []string
+			for _, l := range parseLrc(lrc) {
+				plain = append(plain, l.Value)
+			}
+			resp.Lyrics = &Lyrics{Artist: t.Artist, Title: t.Title, Value: strings.Join(plain, "\n")}
+			break
+		}
+	}
+	send(c, resp)
+}
+
+func (s *server) getLyricsBySongID(c *gin.Context) {
+	t, ok := s.track(c)
+	if !ok {
+		return
+	}
+	resp := newResponse()
+	resp.LyricsList = &LyricsList{StructuredLyrics: []StructuredLyrics{}}
+	if lrc, _, err := library.Lyrics(t); err == nil {
+		if lines := parseLrc(lrc); len(lines) > 0 {
+			resp.LyricsList.StructuredLyrics = append(resp.LyricsList.StructuredLyrics, StructuredLyrics{
+				Lang:          "xxx",
+				Synced:        true,
+				DisplayArtist: t.Artist,
+				DisplayTitle:  t.Title,
+				Lines:         lines,
+			})
+		}
+	}
+	send(c, resp)
+}
+
+func (s *server) search3(c *gin.Context) {
+	q := strings.ToLower(strings.Trim(strings.TrimSpace(arg(c, "query")), `"`))
+	match := func(fields ...string) bool {
+		if q == "" {
+			return true
+		}
+		for _, f := range fields {
+			if strings.Contains(strings.ToLower(f), q) {
+				return true
+			}
+		}
+		return false
+	}
+	res := &SearchResult3{Artists: []ArtistID3{}, Albums: []AlbumID3{}, Songs: []Child{}}
+	n, off := pageParams(c, "artist")
+	for _, a := range s.idx.Artists() {
+		if match(a.Name) {
+			if off > 0 {
+				off--
+				continue
+			}
+			if len(res.Artists) < n {
+				res.Artists = append(res.Artists, ArtistID3{ID: artistPrefix + a.ID, Name: a.Name, AlbumCount: a.AlbumCount})
+			}
+		}
+	}
+	n, off = pageParams(c, "album")
+	for _, a := range s.idx.Albums("") {
+		if match(a.Title, a.Artist) {
+			if off > 0 {
+				off--
+				continue
+			}
+			if len(res.Albums) < n {
+				res.Albums = append(res.Albums, toAlbum(a))
+			}
+		}
+	}
+	n, off = pageParams(c, "song")
+	for _, t := range s.idx.Tracks("", "") {
+		if match(t.Title, t.Artist, t.Album) {
+			if off > 0 {
+				off--
+				continue
+			}
+			if len(res.Songs) < n {
+				res.Songs = append(res.Songs, toChild(t))
+			}
+		}
+	}
+	resp := newResponse()
+	resp.SearchResult3 = res
+	send(c, resp)
+}
+
+func pageParams(c *gin.Context, kind string) (int, int) {
+	n, err := strconv.Atoi(arg(c, kind+"Count"))
+	if err != nil || n < 0 {
+		n = 20
+	}
+	off, _ := strconv.Atoi(arg(c, kind+"Offset"))
+	if off < 0 {
+		off = 0
+	}
+	return n, off
+}
+
+func requireID(c *gin.Context, prefix string) (string, bool) {
+	id := arg(c, "id")
+	if id == "" {
+		sendError(c, errMissingParam, "required parameter is missing: id")
+		return "", false
+	}
+	return strings.TrimPrefix(id, prefix), true
+}
+
+func (s *server) track(c *gin.Context) (library.Track, bool) {
+	id, ok := requireID(c, trackPrefix)
+	if !ok {
+		return library.Track{}, false
+	}
+	t, ok := s.idx.Track(id)
+	if !ok {
+		sendError(c, errNotFound, "song not found")
+		return library.Track{}, false
+	}
+	return t, true
+}
+
+func created(nano int64) string {
+	return time.Unix(0, nano).UTC().Format(time.RFC3339)
+}
+
+func toAlbum(a library.Album) AlbumID3 {
+	return AlbumID3{
+		ID:        albumPrefix + a.ID,
+		Name:      a.Title,
+		Artist:    a.Artist,
+		ArtistID:  artistPrefix + a.ArtistID,
+		CoverArt:  albumPrefix + a.ID,
+		SongCount: a.TrackCount,
+		Duration:  int(a.DurationMs / 1000),
+		Created:   created(a.ModTime),
+		Year:      a.Year,
+		Genre:     a.Genre,
+	}
+}
+
+func toChild(t library.Track) Child {
+	ch := Child{
+		ID:           trackPrefix + t.ID,
+		Parent:       albumPrefix + t.AlbumKey,
+		Title:        t.Title,
+		Album:        t.Album,
+		Artist:       t.Artist,
+		Track:        t.TrackNumber,
+		Year:         t.Year,
+		Genre:        t.Genre,
+		CoverArt:     albumPrefix + t.AlbumKey,
+		Size:         t.Size,
+		ContentType:  "audio/mp4",
+		Suffix:       strings.TrimPrefix(filepath.Ext(t.Path), "."),
+		Duration:     int(t.DurationMs / 1000),
+		DiscNumber:   t.DiscNumber,
+		AlbumID:      albumPrefix + t.AlbumKey,
+		ArtistID:     artistPrefix + library.ArtistKey(t.AlbumArtist),
+		Type:         "music",
+		Created:      created(t.ModTime),
+		SamplingRate: t.SampleRate,
+		BitDepth:     t.BitDepth,
+		ChannelCount: t.Channels,
+	}
+	if rel, err := filepath.Rel(t.Root, t.Path); err == nil {
+		ch.Path = filepath.ToSlash(rel)
+	}
+	if t.DurationMs > 0 {
+		ch.BitRate = int(t.Size * 8 / t.DurationMs)
+	}
+	return ch
+}
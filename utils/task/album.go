@@ -27,6 +27,7 @@ type Album struct {
 	Resp     ampapi.AlbumResp
 	Name     string
 	Tracks   []Track
+	Alt      AltNames
 }
 
 func NewAlbum(st string, id string) *Album {
@@ -78,6 +79,37 @@ func (a *Album) GetResp(token, l string) error {
 	return nil
 }
 
+// GetAltNames 以第二语言再获取一次专辑，把专辑与各曲目的名称填入 Alt
+func (a *Album) GetAltNames(token, l string) error {
+	resp, err := ampapi.GetAlbumResp(a.Storefront, a.ID, l, token)
+	if err != nil {
+		return err
+	}
+	if len(resp.Data) == 0 {
+		return errors.New("empty album response")
+	}
+	attrs := resp.Data[0].Attributes
+	a.Alt = AltNames{Album: attrs.Name, AlbumArtist: attrs.ArtistName}
+	byID := map[string]ampapi.TrackRespData{}
+	for _, t := range resp.Data[0].Relationships.Tracks.Data {
+		byID[t.ID] = t
+	}
+	for i := range a.Tracks {
+		t, ok := byID[a.Tracks[i].ID]
+		if !ok {
+			continue
+		}
+		a.Tracks[i].Alt = AltNames{
+			Title:       t.Attributes.Name,
+			Artist:      t.Attributes.ArtistName,
+			Album:       attrs.Name,
+			AlbumArtist: attrs.ArtistName,
+			Composer:    t.Attributes.ComposerName,
+		}
+	}
+	return nil
+}
+
 func (a *Album) GetArtwork() string {
 	return a.Resp.Data[0].Attributes.Artwork.URL
 }
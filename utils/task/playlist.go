@@ -80,6 +80,34 @@ func (a *Playlist) GetResp(token, l string) error {
 	return nil
 }
 
+// GetAltNames 以第二语言再获取一次歌单，把各曲目的名称填入 Alt（专辑艺人不可得，保持为空）
+func (a *Playlist) GetAltNames(token, l string) error {
+	resp, err := ampapi.GetPlaylistResp(a.Storefront, a.ID, l, token)
+	if err != nil {
+		return err
+	}
+	if len(resp.Data) == 0 {
+		return errors.New("empty playlist response")
+	}
+	byID := map[string]ampapi.TrackRespData{}
+	for _, t := range resp.Data[0].Relationships.Tracks.Data {
+		byID[t.ID] = t
+	}
+	for i := range a.Tracks {
+		t, ok := byID[a.Tracks[i].ID]
+		if !ok {
+			continue
+		}
+		a.Tracks[i].Alt = AltNames{
+			Title:    t.Attributes.Name,
+			Artist:   t.Attributes.ArtistName,
+			Album:    t.Attributes.AlbumName,
+			Composer: t.Attributes.ComposerName,
+		}
+	}
+	return nil
+}
+
 func (a *Playlist) GetArtwork() string {
 	return a.Resp.Data[0].Attributes.Artwork.URL
 }
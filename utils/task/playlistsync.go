@@ -0,0 +1,73 @@
+package task
+
+import (
+	"encoding/json"
+	"os"
+	"time"
+)
+
+// PlaylistStateName 是歌单目录下保存同步状态的文件名
+const PlaylistStateName = ".playlist-sync.json"
+
+// PlaylistState 记录上次同步时歌单中的曲目，用于只下载新增曲目、处理被移除的曲目并保持编号稳定
+type PlaylistState struct {
+	Version    int                  `json:"version"`
+	PlaylistID string               `json:"playlistId"`
+	Storefront string               `json:"storefront"`
+	SyncedAt   time.Time            `json:"syncedAt"`
+	Tracks     []PlaylistStateTrack `json:"tracks"`
+}
+
+// PlaylistStateTrack 是一首已保存的曲目；File 与 Link 为相对于歌单目录的路径
+type PlaylistStateTrack struct {
+	ID     string `json:"id"`
+	Name   string `json:"name"`
+	Number int    `json:"number"`
+	File   string `json:"file"`
+	Link   string `json:"link,omitempty"`
+}
+
+// ReadPlaylistState 读取同步状态；文件不存在时返回空状态
+func ReadPlaylistState(path string) (*PlaylistState, error) {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return &PlaylistState{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	s := new(PlaylistState)
+	if err := json.Unmarshal(data, s); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Write 先写 .part 再替换，避免中断时留下不完整的状态
+func (s *PlaylistState) Write(path string) error {
+	s.Version = 1
+	s.SyncedAt = time.Now().UTC()
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := path + ".part"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+// Lookup 按曲目 id 返回状态中的条目
+func (s *PlaylistState) Lookup(id string) (PlaylistStateTrack, bool) {
+	for _, t := range s.Tracks {
+		if t.ID == id {
+			return t, true
+		}
+	}
+	return PlaylistStateTrack{}, false
+}
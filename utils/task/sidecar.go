@@ -0,0 +1,135 @@
+package task
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"main/utils/ampapi"
+)
+
+// AlbumSidecarName 是专辑目录下保存原始目录数据的文件名
+const AlbumSidecarName = "album.json"
+
+// AlbumSidecar 保存下载时使用的专辑/曲目/艺人/厂牌数据以及所选的版本与音质，
+// 之后可以不联网地重新生成标签、目录名等
+type AlbumSidecar struct {
+	Version    int                  `json:"version"`
+	SavedAt    time.Time            `json:"savedAt"`
+	Storefront string               `json:"storefront"`
+	Language   string               `json:"language"`
+	Codec      string               `json:"codec"`
+	Quality    string               `json:"quality,omitempty"`
+	Album      ampapi.AlbumRespData `json:"album"`
+	AltAlbum   AltNames             `json:"altAlbum"`
+	Tracks     []SidecarTrack       `json:"tracks"`
+}
+
+// SidecarTrack 是专辑中一首已保存的曲目
+type SidecarTrack struct {
+	File      string                  `json:"file"`
+	Quality   string                  `json:"quality,omitempty"`
+	DiscTotal int                     `json:"discTotal"`
+	Resp      ampapi.TrackRespData    `json:"resp"`
+	Alt       AltNames                `json:"alt"`
+	Credits   []ampapi.CreditCategory `json:"credits,omitempty"`
+}
+
+// NewAlbumSidecar 收集专辑中已经保存到 SaveDir 的曲目
+func NewAlbumSidecar(a *Album, codec, quality string) *AlbumSidecar {
+	s := &AlbumSidecar{
+		Version:    1,
+		SavedAt:    time.Now().UTC(),
+		Storefront: a.Storefront,
+		Language:   a.Language,
+		Codec:      codec,
+		Quality:    quality,
+		AltAlbum:   a.Alt,
+	}
+	if len(a.Resp.Data) > 0 {
+		s.Album = a.Resp.Data[0]
+		// 曲目单独保存在 Tracks 中
+		s.Album.Relationships.Tracks = ampapi.TrackResp{}
+	}
+	for _, t := range a.Tracks {
+		if t.SaveName == "" {
+			continue
+		}
+		if _, err := os.Stat(filepath.Join(t.SaveDir, t.SaveName)); err != nil {
+			continue
+		}
+		s.Tracks = append(s.Tracks, SidecarTrack{
+			File:      t.SaveName,
+			Quality:   t.Quality,
+			DiscTotal: t.DiscTotal,
+			Resp:      t.Resp,
+			Alt:       t.Alt,
+			Credits:   t.Credits,
+		})
+	}
+	return s
+}
+
+// Merge 保留旧 sidecar 中本次未下载、但文件仍在 dir 中的曲目
+func (s *AlbumSidecar) Merge(old *AlbumSidecar, dir string) {
+	have := map[string]bool{}
+	for _, t := range s.Tracks {
+		have[t.Resp.ID] = true
+	}
+	for _, t := range old.Tracks {
+		if have[t.Resp.ID] {
+			continue
+		}
+		if _, err := os.Stat(filepath.Join(dir, t.File)); err == nil {
+			s.Tracks = append(s.Tracks, t)
+		}
+	}
+	sort.SliceStable(s.Tracks, func(i, j int) bool {
+		a, b := s.Tracks[i].Resp.Attributes, s.Tracks[j].Resp.Attributes
+		if a.DiscNumber != b.DiscNumber {
+			return a.DiscNumber < b.DiscNumber
+		}
+		return a.TrackNumber < b.TrackNumber
+	})
+}
+
+// ReadAlbumSidecar 读取 album.json
+func ReadAlbumSidecar(path string) (*AlbumSidecar, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	s := new(AlbumSidecar)
+	if err := json.Unmarshal(data, s); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Track 把 sidecar 中的第 i 首曲目还原为 Track，dir 为专辑目录
+func (s *AlbumSidecar) Track(i int, dir string) Track {
+	st := s.Tracks[i]
+	return Track{
+		ID:         st.Resp.ID,
+		Type:       st.Resp.Type,
+		Name:       st.Resp.Attributes.Name,
+		Storefront: s.Storefront,
+		Language:   s.Language,
+		SaveDir:    dir,
+		SaveName:   st.File,
+		SavePath:   filepath.Join(dir, st.File),
+		Codec:      s.Codec,
+		TaskNum:    i + 1,
+		TaskTotal:  len(s.Tracks),
+		Quality:    st.Quality,
+		Resp:       st.Resp,
+		PreType:    "albums",
+		PreID:      s.Album.ID,
+		DiscTotal:  st.DiscTotal,
+		AlbumData:  s.Album,
+		Credits:    st.Credits,
+		Alt:        st.Alt,
+	}
+}
@@ -29,6 +29,10 @@ type Track struct {
 	DiscTotal    int
 	AlbumData    ampapi.AlbumRespData
 	PlaylistData ampapi.PlaylistRespData
+	Credits      []ampapi.CreditCategory
+	Alt          AltNames // 第二语言（alt-language）下的名称，未获取时为空
+	Lyrics       string   // 已获取的歌词，多格式任务中后续格式直接复用
+	HasLyrics    bool
 }
 
 func (t *Track) GetAlbumData(token string) error {
@@ -48,3 +52,22 @@ func (t *Track) GetAlbumData(token string) error {
 
 	return nil
 }
+
+// GetCredits 获取歌曲的制作人员名单
+func (t *Track) GetCredits(token string) error {
+	resp, err := ampapi.GetSongCredits(t.Storefront, t.ID, t.Language, token)
+	if err != nil {
+		return err
+	}
+	t.Credits = resp.Data
+	return nil
+}
+
+// AltNames 是同一条目在第二语言下的名称，用于双语标签与目录名
+type AltNames struct {
+	Title       string
+	Artist      string
+	Album       string
+	AlbumArtist string
+	Composer    string
+}